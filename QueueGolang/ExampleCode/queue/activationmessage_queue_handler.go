@@ -2,7 +2,6 @@ package queue
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 
 	"queue/options"
@@ -26,13 +25,5 @@ type ActivationMessagePublisher interface {
 }
 
 func (q *QueueHandler) PublishActivationMessage(m MediaGridActivation, opts ...options.PublishOptions) error {
-	byt, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("marshaling message into json: %w", err)
-	}
-	err = q.Publish(byt, opts...)
-	if err != nil {
-		return fmt.Errorf("publishing to queue: %w", err)
-	}
-	return nil
+	return NewPublisher[MediaGridActivation](q).Publish(m, opts...)
 }
@@ -0,0 +1,94 @@
+//go:build integration
+// +build integration
+
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"queue/queuetest"
+)
+
+type container struct {
+	testcontainers.Container
+	IP   string
+	Port string
+}
+
+func setupRabbitMQ(ctx context.Context) (*container, error) {
+	req := testcontainers.ContainerRequest{
+		Image:        "rabbitmq:3",
+		ExposedPorts: []string{"5672/tcp"},
+		WaitingFor:   wait.ForLog("Server startup complete"),
+	}
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := c.Host(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mappedPort, err := c.MappedPort(ctx, "5672")
+	if err != nil {
+		return nil, err
+	}
+
+	return &container{Container: c, IP: ip, Port: mappedPort.Port()}, nil
+}
+
+func TestAMQPQueueMux_Conformance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+
+	rabbitC, err := setupRabbitMQ(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rabbitC.Terminate(ctx)
+
+	queuetest.RunConformance(t, queuetest.Factory{
+		URI: func(name string) string {
+			return fmt.Sprintf("amqp://guest:guest@%s:%s/?exchange=conformance&queue=%s&prefetch=2", rabbitC.IP, rabbitC.Port, name)
+		},
+		Queue: NewAMQPQueueMux().Queue,
+	})
+}
+
+func TestAMQPQueueMux_Unroutable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+
+	rabbitC, err := setupRabbitMQ(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rabbitC.Terminate(ctx)
+
+	// No queue is bound to the exchange, so the broker returns the mandatory message.
+	q, err := NewAMQPQueueMux().Queue(fmt.Sprintf("amqp://guest:guest@%s:%s/?exchange=unbound&routingKey=orders", rabbitC.IP, rabbitC.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.Publish([]byte("unroutable")); !errors.Is(err, errReturned) {
+		t.Errorf("expected an unroutable message to be returned, got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package asyncapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"queue"
+	"queue/codec"
+	"queue/schema"
+)
+
+// Version is the AsyncAPI specification version of generated documents.
+const Version = "2.6.0"
+
+// correlationIDHeader is the header used to describe the correlation ID carried by messages.
+// Queue implementations carry it in a message attribute or envelope field.
+const correlationIDHeader = "correlation_id"
+
+// Document is an AsyncAPI document describing the queues used by a service.
+type Document struct {
+	AsyncAPI   string             `json:"asyncapi"`
+	Info       Info               `json:"info"`
+	Channels   map[string]Channel `json:"channels"`
+	Components Components         `json:"components"`
+}
+
+// Info describes the service.
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// Channel describes a queue, identified by its URI. In AsyncAPI 2.x operations are described
+// from the perspective of other applications: Publish describes the messages the service
+// handles and Subscribe the messages the service publishes.
+type Channel struct {
+	Publish   *Operation `json:"publish,omitempty"`
+	Subscribe *Operation `json:"subscribe,omitempty"`
+}
+
+// Operation describes the messages that are published to or consumed from a queue.
+type Operation struct {
+	OperationID string  `json:"operationId"`
+	Message     Message `json:"message"`
+}
+
+// Message describes a message type, or one of a number of message types.
+type Message struct {
+	OneOf         []Message       `json:"oneOf,omitempty"`
+	Name          string          `json:"name,omitempty"`
+	ContentType   string          `json:"contentType,omitempty"`
+	CorrelationID *CorrelationID  `json:"correlationId,omitempty"`
+	Headers       json.RawMessage `json:"headers,omitempty"`
+	Payload       *Reference      `json:"payload,omitempty"`
+}
+
+// CorrelationID describes the location of the correlation ID of a message.
+type CorrelationID struct {
+	Location string `json:"location"`
+}
+
+// Reference refers to a component of the document.
+type Reference struct {
+	Ref string `json:"$ref"`
+}
+
+// Components holds the payload schemas of the message types, keyed by name.
+type Components struct {
+	Schemas map[string]json.RawMessage `json:"schemas"`
+}
+
+// Generate returns an AsyncAPI document describing the provided queues and the message types
+// handled and published on them using the typed APIs, e.g. Generate(info, queue.Queues()...).
+func Generate(info Info, queues ...*queue.QueueHandler) (*Document, error) {
+	doc := &Document{
+		AsyncAPI: Version,
+		Info:     info,
+		Channels: make(map[string]Channel),
+		Components: Components{
+			Schemas: make(map[string]json.RawMessage),
+		},
+	}
+	for _, q := range queues {
+		var channel Channel
+		if types := q.HandledTypes(); len(types) > 0 {
+			msg, err := doc.message(q, types)
+			if err != nil {
+				return nil, err
+			}
+			channel.Publish = &Operation{OperationID: "handle " + q.URI(), Message: msg}
+		}
+		if types := q.PublishedTypes(); len(types) > 0 {
+			msg, err := doc.message(q, types)
+			if err != nil {
+				return nil, err
+			}
+			channel.Subscribe = &Operation{OperationID: "publish " + q.URI(), Message: msg}
+		}
+		doc.Channels[q.URI()] = channel
+	}
+	return doc, nil
+}
+
+// message returns the Message describing the message types on a queue, adding their payload
+// schemas to the components.
+func (doc *Document) message(q *queue.QueueHandler, types []reflect.Type) (Message, error) {
+	var msgs []Message
+	for _, t := range types {
+		if _, ok := doc.Components.Schemas[t.Name()]; !ok {
+			payload, err := schema.GenerateInline(t)
+			if err != nil {
+				return Message{}, fmt.Errorf("generating schema for %s: %w", t.Name(), err)
+			}
+			doc.Components.Schemas[t.Name()] = payload
+		}
+		contentType := q.Codec(t).ContentType()
+		headers, err := json.Marshal(map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				correlationIDHeader:       map[string]string{"type": "string"},
+				codec.Header:              map[string]string{"const": contentType},
+				queue.SchemaVersionHeader: map[string]string{"const": strconv.Itoa(queue.SchemaVersion(t))},
+			},
+		})
+		if err != nil {
+			return Message{}, err
+		}
+		msgs = append(msgs, Message{
+			Name:          t.Name(),
+			ContentType:   contentType,
+			CorrelationID: &CorrelationID{Location: "$message.header#/" + correlationIDHeader},
+			Headers:       headers,
+			Payload:       &Reference{Ref: "#/components/schemas/" + t.Name()},
+		})
+	}
+	if len(msgs) == 1 {
+		return msgs[0], nil
+	}
+	return Message{OneOf: msgs}, nil
+}
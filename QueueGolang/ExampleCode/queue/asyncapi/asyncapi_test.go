@@ -0,0 +1,58 @@
+package asyncapi
+
+import (
+	"context"
+	"testing"
+
+	"queue"
+	"queue/codec"
+)
+
+func TestGenerate(t *testing.T) {
+	q := queue.NewQueueHandler("sqs://imports", 1).
+		SetMessageCodec(queue.DV360ImportMessage{}, codec.MessagePack).
+		AddEmailMessageHandler(func(ctx context.Context, m queue.EmailMessage) error {
+			return nil
+		}).
+		AddDV360ImportMessageHandler(func(ctx context.Context, m queue.DV360ImportMessage) error {
+			return nil
+		})
+	queue.NewPublisher[queue.EmailMessage](q)
+	idle := queue.NewQueueHandler("mem://idle", 1)
+
+	doc, err := Generate(Info{Title: "imports", Version: "1.0.0"}, q, idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.AsyncAPI != Version {
+		t.Errorf("expected version %s, got %s", Version, doc.AsyncAPI)
+	}
+	channel, ok := doc.Channels["sqs://imports"]
+	if !ok {
+		t.Fatal("expected channel for sqs://imports")
+	}
+	if channel.Publish == nil || len(channel.Publish.Message.OneOf) != 2 {
+		t.Fatalf("expected handled messages to be described, got %+v", channel.Publish)
+	}
+	handled := channel.Publish.Message.OneOf
+	if handled[0].Name != "EmailMessage" || handled[0].ContentType != codec.ContentTypeJSON {
+		t.Errorf("expected EmailMessage with JSON content type, got %s %s", handled[0].Name, handled[0].ContentType)
+	}
+	if handled[1].Name != "DV360ImportMessage" || handled[1].ContentType != codec.ContentTypeMessagePack {
+		t.Errorf("expected DV360ImportMessage with MessagePack content type, got %s %s", handled[1].Name, handled[1].ContentType)
+	}
+	if channel.Subscribe == nil || channel.Subscribe.Message.Name != "EmailMessage" {
+		t.Errorf("expected published EmailMessage to be described, got %+v", channel.Subscribe)
+	}
+	if channel.Subscribe.Message.CorrelationID == nil {
+		t.Error("expected correlation ID to be described")
+	}
+	if _, ok := doc.Channels["mem://idle"]; !ok {
+		t.Error("expected channel for queue without typed handlers")
+	}
+	for _, name := range []string{"EmailMessage", "DV360ImportMessage"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("expected payload schema for %s", name)
+		}
+	}
+}
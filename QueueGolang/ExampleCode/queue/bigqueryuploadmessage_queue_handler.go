@@ -1,28 +1,22 @@
+// Code generated by queuegen. DO NOT EDIT.
+
 package queue
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"sync"
 
 	"queue/options"
 )
 
+func init() {
+	RegisterMessageType[BigQueryUploadMessage]()
+}
+
 type BigQueryUploadMessageHandler func(ctx context.Context, r BigQueryUploadMessage) error
 
 func (q *QueueHandler) AddBigQueryUploadMessageHandler(handler BigQueryUploadMessageHandler) *QueueHandler {
-	return q.AddHandler(func(ctx context.Context, data []byte) error {
-		var msg BigQueryUploadMessage
-		err := json.Unmarshal(data, &msg)
-		if err != nil {
-			return fmt.Errorf("parsing message json: %w", err)
-		}
-		err = handler(ctx, msg)
-		if err != nil {
-			return fmt.Errorf("handling message: %w", err)
-		}
-		return nil
-	})
+	return Handle[BigQueryUploadMessage](q, handler)
 }
 
 type BigQueryUploadMessagePublisher interface {
@@ -30,13 +24,36 @@ type BigQueryUploadMessagePublisher interface {
 }
 
 func (q *QueueHandler) PublishBigQueryUploadMessage(m BigQueryUploadMessage, opts ...options.PublishOptions) error {
-	byt, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("marshaling message into json: %w", err)
-	}
-	err = q.Publish(byt, opts...)
-	if err != nil {
-		return fmt.Errorf("publishing to queue: %w", err)
+	return NewPublisher[BigQueryUploadMessage](q).Publish(m, opts...)
+}
+
+// NewBigQueryUploadMessagePublisher returns the QueueHandler as a BigQueryUploadMessagePublisher, recording BigQueryUploadMessage as a type it publishes.
+func NewBigQueryUploadMessagePublisher(q *QueueHandler) BigQueryUploadMessagePublisher {
+	NewPublisher[BigQueryUploadMessage](q)
+	return q
+}
+
+// FakeBigQueryUploadMessagePublisher is a BigQueryUploadMessagePublisher that records published messages, for use in tests.
+type FakeBigQueryUploadMessagePublisher struct {
+	mtx      sync.Mutex
+	messages []BigQueryUploadMessage
+	// Err is returned by PublishBigQueryUploadMessage when set, in which case the message is not recorded.
+	Err error
+}
+
+func (f *FakeBigQueryUploadMessagePublisher) PublishBigQueryUploadMessage(m BigQueryUploadMessage, opts ...options.PublishOptions) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.Err != nil {
+		return f.Err
 	}
+	f.messages = append(f.messages, m)
 	return nil
 }
+
+// Published returns the messages that have been published.
+func (f *FakeBigQueryUploadMessagePublisher) Published() []BigQueryUploadMessage {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]BigQueryUploadMessage(nil), f.messages...)
+}
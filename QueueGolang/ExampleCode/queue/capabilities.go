@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// ErrUnsupported is returned when an operation is not supported by the underlying queue
+// implementation.
+var ErrUnsupported = errors.New("operation not supported by queue implementation")
+
+// Counter is implemented by QueueMuxes that can count the messages waiting in a queue.
+type Counter interface {
+	// Count returns the number of messages waiting in the queue with the provided URI. It may
+	// be approximate.
+	Count(ctx context.Context, uri string) (int, error)
+}
+
+// Purger is implemented by QueueMuxes that can delete all the messages in a queue.
+type Purger interface {
+	// Purge deletes all the messages waiting in the queue with the provided URI.
+	Purge(ctx context.Context, uri string) error
+}
+
+// Peeker is implemented by QueueMuxes that can return messages without consuming them.
+type Peeker interface {
+	// Peek returns up to max messages waiting in the queue with the provided URI without
+	// removing them from the queue.
+	Peek(ctx context.Context, uri string, max int) ([]PeekedMessage, error)
+}
+
+// PeekedMessage is a message returned by Peek. Data is the payload as published to the
+// underlying queue, i.e. before any compression, encryption or claim check is reversed.
+type PeekedMessage struct {
+	ID            string
+	CorrelationID string
+	Headers       map[string]string
+	Data          []byte
+}
+
+// Count returns the number of messages waiting in the queue with the provided URI, or
+// ErrUnsupported if the underlying queue implementation cannot count messages.
+func Count(ctx context.Context, uri string) (int, error) {
+	mux, err := queueMux(uri)
+	if err != nil {
+		return 0, err
+	}
+	counter, ok := mux.(Counter)
+	if !ok {
+		return 0, ErrUnsupported
+	}
+	return counter.Count(ctx, uri)
+}
+
+// Purge deletes all the messages waiting in the queue with the provided URI, or returns
+// ErrUnsupported if the underlying queue implementation cannot purge queues.
+func Purge(ctx context.Context, uri string) error {
+	mux, err := queueMux(uri)
+	if err != nil {
+		return err
+	}
+	purger, ok := mux.(Purger)
+	if !ok {
+		return ErrUnsupported
+	}
+	return purger.Purge(ctx, uri)
+}
+
+// Peek returns up to max messages waiting in the queue with the provided URI without removing
+// them, or ErrUnsupported if the underlying queue implementation cannot peek.
+func Peek(ctx context.Context, uri string, max int) ([]PeekedMessage, error) {
+	mux, err := queueMux(uri)
+	if err != nil {
+		return nil, err
+	}
+	peeker, ok := mux.(Peeker)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return peeker.Peek(ctx, uri, max)
+}
+
+// queueMux returns the registered QueueMux for the scheme of the provided URI.
+func queueMux(uri string) (QueueMux, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	mux, ok := queueRegistry[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("queue mux with scheme %s not found", u.Scheme)
+	}
+	return mux, nil
+}
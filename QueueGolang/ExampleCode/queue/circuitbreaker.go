@@ -0,0 +1,238 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	defaultCircuitBreakerErrorThreshold  = 0.5
+	defaultCircuitBreakerWindow          = 20
+	defaultCircuitBreakerMinimumMessages = 10
+	defaultCircuitBreakerCoolDown        = 30 * time.Second
+
+	circuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "queue_circuit_breaker_state",
+		Help: "The state of the queue circuit breaker (0 closed, 1 open, 2 half-open).",
+	}, []string{"uri"})
+)
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed indicates messages are being consumed as normal.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen indicates consumption has stopped after sustained handler failures.
+	CircuitOpen
+	// CircuitHalfOpen indicates a single probe message is being consumed to test recovery.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreakerOptions configure a CircuitBreaker.
+type CircuitBreakerOptions struct {
+	// ErrorThreshold is the fraction (0-1] of failed messages within the window at which the
+	// breaker opens. It defaults to 0.5 when outside of that range.
+	ErrorThreshold float64
+	// Window is the number of most recent message outcomes used to calculate the error rate.
+	// It defaults to 20.
+	Window int
+	// MinimumMessages is the number of outcomes required within the window before the breaker
+	// can open. It defaults to 10.
+	MinimumMessages int
+	// CoolDown is how long the breaker stays open before probing with a single message. It
+	// defaults to 30 seconds.
+	CoolDown time.Duration
+	// OnStateChange is called whenever the breaker changes state.
+	OnStateChange func(uri string, from, to CircuitState)
+}
+
+// CircuitBreaker stops a QueueHandler consuming messages when its handlers fail at a sustained
+// rate, leaving messages on the underlying queue. After a cool down a single message is consumed
+// as a probe, if it succeeds consumption resumes, otherwise the breaker opens again.
+type CircuitBreaker struct {
+	opts CircuitBreakerOptions
+	uri  string
+
+	mtx      sync.Mutex
+	state    CircuitState
+	outcomes []bool
+	next     int
+	failures int
+	openedAt time.Time
+	probedAt time.Time
+	probing  bool
+	changed  chan struct{}
+}
+
+// NewCircuitBreaker returns a CircuitBreaker with the provided options.
+func NewCircuitBreaker(opts CircuitBreakerOptions) *CircuitBreaker {
+	if opts.ErrorThreshold <= 0 || opts.ErrorThreshold > 1 {
+		opts.ErrorThreshold = defaultCircuitBreakerErrorThreshold
+	}
+	if opts.Window <= 0 {
+		opts.Window = defaultCircuitBreakerWindow
+	}
+	if opts.MinimumMessages <= 0 {
+		opts.MinimumMessages = defaultCircuitBreakerMinimumMessages
+	}
+	if opts.MinimumMessages > opts.Window {
+		opts.MinimumMessages = opts.Window
+	}
+	if opts.CoolDown <= 0 {
+		opts.CoolDown = defaultCircuitBreakerCoolDown
+	}
+	return &CircuitBreaker{
+		opts:     opts,
+		outcomes: make([]bool, 0, opts.Window),
+		changed:  make(chan struct{}),
+	}
+}
+
+// State returns the current state of the breaker.
+func (c *CircuitBreaker) State() CircuitState {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.state
+}
+
+// Wait blocks while the breaker is open. When half open it permits a single probe message
+// and blocks other callers until the outcome of the probe is recorded. If no outcome is
+// recorded within the cool down (e.g. the queue was empty) another probe is permitted.
+func (c *CircuitBreaker) Wait(ctx context.Context) error {
+	for {
+		c.mtx.Lock()
+		var wait time.Duration
+		switch c.state {
+		case CircuitClosed:
+			c.mtx.Unlock()
+			return nil
+		case CircuitOpen:
+			wait = time.Until(c.openedAt.Add(c.opts.CoolDown))
+			if wait <= 0 {
+				from := c.setState(CircuitHalfOpen)
+				c.mtx.Unlock()
+				c.notify(from, CircuitHalfOpen)
+				continue
+			}
+		case CircuitHalfOpen:
+			wait = time.Until(c.probedAt.Add(c.opts.CoolDown))
+			if !c.probing || wait <= 0 {
+				c.probing = true
+				c.probedAt = time.Now()
+				c.mtx.Unlock()
+				return nil
+			}
+		}
+		changed := c.changed
+		c.mtx.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-changed:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Record records the outcome of handling a message.
+func (c *CircuitBreaker) Record(err error) {
+	c.mtx.Lock()
+	from := c.state
+	to := c.record(err)
+	c.mtx.Unlock()
+	if from != to {
+		c.notify(from, to)
+	}
+}
+
+// record records the outcome of handling a message and returns the resulting state. It must
+// be called with the mutex held.
+func (c *CircuitBreaker) record(err error) CircuitState {
+	switch c.state {
+	case CircuitHalfOpen:
+		if err != nil {
+			c.setState(CircuitOpen)
+		} else {
+			c.setState(CircuitClosed)
+		}
+		return c.state
+	case CircuitOpen:
+		// Messages buffered before the breaker opened do not affect its state.
+		return c.state
+	}
+	failed := err != nil
+	if len(c.outcomes) < c.opts.Window {
+		c.outcomes = append(c.outcomes, failed)
+	} else {
+		if c.outcomes[c.next] {
+			c.failures--
+		}
+		c.outcomes[c.next] = failed
+	}
+	c.next = (c.next + 1) % c.opts.Window
+	if failed {
+		c.failures++
+	}
+	if len(c.outcomes) >= c.opts.MinimumMessages &&
+		float64(c.failures)/float64(len(c.outcomes)) >= c.opts.ErrorThreshold {
+		c.setState(CircuitOpen)
+	}
+	return c.state
+}
+
+// setState transitions the breaker to the provided state and returns the previous state. It
+// must be called with the mutex held.
+func (c *CircuitBreaker) setState(state CircuitState) CircuitState {
+	from := c.state
+	c.state = state
+	c.probing = false
+	switch state {
+	case CircuitOpen:
+		c.openedAt = time.Now()
+	case CircuitClosed:
+		c.outcomes = c.outcomes[:0]
+		c.next = 0
+		c.failures = 0
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+	circuitBreakerState.WithLabelValues(c.uri).Set(float64(state))
+	return from
+}
+
+// notify calls the OnStateChange callback. It must be called without the mutex held.
+func (c *CircuitBreaker) notify(from, to CircuitState) {
+	if c.opts.OnStateChange != nil {
+		c.opts.OnStateChange(c.uri, from, to)
+	}
+}
+
+// SetCircuitBreaker sets the CircuitBreaker that stops the underlying queue implementation
+// consuming messages when the handlers fail at a sustained rate. A CircuitBreaker must not
+// be shared between QueueHandlers. It returns the QueueHandler for chaining.
+func (q *QueueHandler) SetCircuitBreaker(c *CircuitBreaker) *QueueHandler {
+	c.uri = q.uri
+	circuitBreakerState.WithLabelValues(c.uri).Set(float64(c.State()))
+	q.circuitBreaker = c
+	return q
+}
@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var mtx sync.Mutex
+	var transitions []CircuitState
+	c := NewCircuitBreaker(CircuitBreakerOptions{
+		ErrorThreshold:  0.5,
+		Window:          4,
+		MinimumMessages: 2,
+		CoolDown:        50 * time.Millisecond,
+		OnStateChange: func(uri string, from, to CircuitState) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			transitions = append(transitions, to)
+		},
+	})
+	NewQueueHandler("test://breaker", 1).SetCircuitBreaker(c)
+	errHandling := errors.New("handling")
+
+	c.Record(nil)
+	c.Record(errHandling)
+	if c.State() != CircuitOpen {
+		t.Fatalf("expected breaker to open, got %s", c.State())
+	}
+
+	// The first wait blocks for the cool down and is then permitted as the probe.
+	tStart := time.Now()
+	if err := c.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(tStart); elapsed < 40*time.Millisecond {
+		t.Errorf("expected wait to block for the cool down, took %s", elapsed)
+	}
+	if c.State() != CircuitHalfOpen {
+		t.Fatalf("expected breaker to be half-open, got %s", c.State())
+	}
+
+	// Other waits block until the probe succeeds.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.Wait(ctx); err == nil {
+		t.Fatal("expected wait to block while probing")
+	}
+	c.Record(nil)
+	if err := c.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	expected := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if !reflect.DeepEqual(transitions, expected) {
+		t.Errorf("expected transitions %v, got %v", expected, transitions)
+	}
+}
+
+func TestNewCircuitBreaker_ErrorThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold float64
+		want      float64
+	}{
+		{"unset", 0, defaultCircuitBreakerErrorThreshold},
+		{"negative", -0.5, defaultCircuitBreakerErrorThreshold},
+		{"above one", 1.5, defaultCircuitBreakerErrorThreshold},
+		{"configured", 0.25, 0.25},
+		{"every message", 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCircuitBreaker(CircuitBreakerOptions{ErrorThreshold: tt.threshold})
+			if c.opts.ErrorThreshold != tt.want {
+				t.Errorf("expected error threshold %v, got %v", tt.want, c.opts.ErrorThreshold)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker_DefaultErrorThresholdSuccesses(t *testing.T) {
+	c := NewCircuitBreaker(CircuitBreakerOptions{})
+	for i := 0; i < 2*defaultCircuitBreakerWindow; i++ {
+		c.Record(nil)
+	}
+	if c.State() != CircuitClosed {
+		t.Errorf("expected breaker to stay closed when every message succeeds, got %s", c.State())
+	}
+}
@@ -0,0 +1,84 @@
+package claimcheck
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// DefaultThreshold is the payload size in bytes above which payloads are offloaded. It
+	// leaves headroom below the 256KB SQS limit for message attributes.
+	DefaultThreshold = 192 * 1024
+
+	// ErrNotFound is returned by a Store when a payload does not exist.
+	ErrNotFound = errors.New("claim check payload not found")
+)
+
+const (
+	// Header is the message header carrying the key of an offloaded payload.
+	Header = "claim_check"
+	// DigestHeader is the message header carrying the base64 encoded SHA-256 digest of an
+	// offloaded payload, so a signature over the message headers also covers the payload.
+	DigestHeader = "claim_check_digest"
+)
+
+// Store is a blob store used to hold offloaded payloads. Producers and consumers of a queue
+// must use Stores backed by the same location.
+type Store interface {
+	// Put stores the payload under the provided key.
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns the payload stored under the provided key.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete deletes the payload stored under the provided key.
+	Delete(ctx context.Context, key string) error
+}
+
+// FileStore is a Store backed by a directory on the local filesystem, intended for tests
+// and local development.
+type FileStore struct {
+	dir string
+}
+
+// Digest returns the value of the DigestHeader for the payload.
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// NewFileStore returns a FileStore that stores payloads in the provided directory, which
+// is created if it does not exist.
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (f *FileStore) Put(ctx context.Context, key string, data []byte) error {
+	return os.WriteFile(f.path(key), data, 0o644)
+}
+
+func (f *FileStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(f.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (f *FileStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(f.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (f *FileStore) path(key string) string {
+	return filepath.Join(f.dir, filepath.Base(key))
+}
@@ -0,0 +1,56 @@
+package gcs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+
+	"cloud.google.com/go/storage"
+
+	"queue/claimcheck"
+)
+
+// Store is a claimcheck.Store backed by a Google Cloud Storage bucket.
+type Store struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+// NewStore returns a Store that stores payloads in the provided bucket under the key prefix.
+func NewStore(client *storage.Client, bucket, prefix string) *Store {
+	return &Store{
+		bucket: client.Bucket(bucket),
+		prefix: prefix,
+	}
+}
+
+func (s *Store) Put(ctx context.Context, key string, data []byte) error {
+	w := s.bucket.Object(path.Join(s.prefix, key)).NewWriter(ctx)
+	_, err := w.Write(data)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	r, err := s.bucket.Object(path.Join(s.prefix, key)).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, claimcheck.ErrNotFound
+		}
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (s *Store) Delete(ctx context.Context, key string) error {
+	err := s.bucket.Object(path.Join(s.prefix, key)).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"queue/claimcheck"
+)
+
+var GetS3 = getS3
+
+// Store is a claimcheck.Store backed by an S3 bucket.
+type Store struct {
+	svc    s3iface.S3API
+	bucket string
+	prefix string
+}
+
+// NewStore returns a Store that stores payloads in the provided bucket under the key prefix.
+func NewStore(bucket, prefix string) *Store {
+	return &Store{
+		svc:    GetS3(),
+		bucket: bucket,
+		prefix: prefix,
+	}
+}
+
+func (s *Store) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, key)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	res, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, key)),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, claimcheck.ErrNotFound
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
+}
+
+func (s *Store) Delete(ctx context.Context, key string) error {
+	_, err := s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, key)),
+	})
+	return err
+}
+
+func getS3() s3iface.S3API {
+	sess := session.New(aws.NewConfig())
+	return s3.New(sess)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"queue"
+	"queue/options"
+	"queue/redrive"
+)
+
+// headerFlag collects repeated -header key=value flags.
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlag) Set(v string) error {
+	key, value, ok := strings.Cut(v, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid header %q, should be key=value", v)
+	}
+	h[key] = value
+	return nil
+}
+
+// parse parses the flags of a command, which must be followed by the queue URI.
+func parse(fs *flag.FlagSet, env env, args []string) (string, error) {
+	fs.SetOutput(env.stderr)
+	err := fs.Parse(args)
+	if err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("%s requires a queue uri", fs.Name())
+	}
+	return fs.Arg(0), nil
+}
+
+func publish(ctx context.Context, env env, args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+	file := fs.String("file", "", "file to read the message from, defaults to stdin")
+	correlationID := fs.String("correlation-id", "", "correlation ID of the message")
+	headers := headerFlag{}
+	fs.Var(headers, "header", "message header as key=value, may be repeated")
+	uri, err := parse(fs, env, args)
+	if err != nil {
+		return err
+	}
+
+	r := env.stdin
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading message: %w", err)
+	}
+	opts := []options.PublishOptions{options.WithHeaders(headers)}
+	if *correlationID != "" {
+		opts = append(opts, options.WithCorrelationID(*correlationID))
+	}
+
+	q, err := queue.Queue(uri)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	return q.Publish(data, opts...)
+}
+
+func consume(ctx context.Context, env env, args []string) error {
+	fs := flag.NewFlagSet("consume", flag.ContinueOnError)
+	typeName := fs.String("type", "", "message type used to decode messages")
+	n := fs.Int("n", 0, "number of messages to consume before exiting, 0 consumes until interrupted")
+	uri, err := parse(fs, env, args)
+	if err != nil {
+		return err
+	}
+	decoder, err := newDecoder(*typeName)
+	if err != nil {
+		return err
+	}
+
+	q, err := queue.Queue(uri)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	done := make(chan struct{})
+	var once sync.Once
+	var mtx sync.Mutex
+	consumed := 0
+	q.AddHandler(func(msgCtx context.Context, data []byte) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if *n > 0 && consumed >= *n {
+			// Messages received after the limit are left on the queue, without being
+			// recorded as failures.
+			options.SetMessageDelete(msgCtx, false)
+			return nil
+		}
+		consumed++
+		printMessage(env.stdout, message{
+			ID:            options.MessageIDFromContext(msgCtx),
+			CorrelationID: options.CorrelationIDFromContext(msgCtx),
+			Headers:       options.HeadersFromContext(msgCtx),
+			Body:          decoder.decode(msgCtx, q, data),
+		})
+		if *n > 0 && consumed == *n {
+			// Stop consuming further messages while shutting down.
+			q.Pause()
+			once.Do(func() { close(done) })
+		}
+		return nil
+	})
+	q.Start()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func peek(ctx context.Context, env env, args []string) error {
+	fs := flag.NewFlagSet("peek", flag.ContinueOnError)
+	typeName := fs.String("type", "", "message type used to decode messages")
+	n := fs.Int("n", 10, "maximum number of messages to peek")
+	uri, err := parse(fs, env, args)
+	if err != nil {
+		return err
+	}
+	decoder, err := newDecoder(*typeName)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := queue.Peek(ctx, uri, *n)
+	if err != nil {
+		return err
+	}
+	q := queue.NewQueueHandler(uri, 1)
+	for _, msg := range msgs {
+		msgCtx := options.ContextWithPublishOptions(ctx, options.WithHeaders(msg.Headers))
+		printMessage(env.stdout, message{
+			ID:            msg.ID,
+			CorrelationID: msg.CorrelationID,
+			Headers:       msg.Headers,
+			Body:          decoder.decode(msgCtx, q, decompress(msg)),
+		})
+	}
+	return nil
+}
+
+func count(ctx context.Context, env env, args []string) error {
+	fs := flag.NewFlagSet("count", flag.ContinueOnError)
+	uri, err := parse(fs, env, args)
+	if err != nil {
+		return err
+	}
+	n, err := queue.Count(ctx, uri)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(env.stdout, n)
+	return nil
+}
+
+func purge(ctx context.Context, env env, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "confirm that all messages should be deleted")
+	uri, err := parse(fs, env, args)
+	if err != nil {
+		return err
+	}
+	if !*yes {
+		return errors.New("purge deletes all the messages in the queue, pass -yes to confirm")
+	}
+	return queue.Purge(ctx, uri)
+}
+
+// timeFlag parses an RFC 3339 time flag.
+type timeFlag struct {
+	t *time.Time
+}
+
+func (f timeFlag) String() string {
+	if f.t == nil || f.t.IsZero() {
+		return ""
+	}
+	return f.t.Format(time.RFC3339)
+}
+
+func (f timeFlag) Set(v string) error {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return fmt.Errorf("invalid time %q, should be RFC 3339", v)
+	}
+	*f.t = t
+	return nil
+}
+
+// stringsFlag collects repeated string flags.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func redriveMessages(ctx context.Context, env env, args []string) error {
+	fs := flag.NewFlagSet("redrive", flag.ContinueOnError)
+	fs.SetOutput(env.stderr)
+	var opts redrive.Options
+	errorReason := fs.String("error-reason", "", "regular expression matching the error reason of the messages to move, only set by mem queues")
+	fs.Var(timeFlag{&opts.Filter.After}, "after", "only move messages sent at or after this RFC 3339 time")
+	fs.Var(timeFlag{&opts.Filter.Before}, "before", "only move messages sent before this RFC 3339 time")
+	fs.Var((*stringsFlag)(&opts.Filter.CorrelationIDs), "correlation-id", "only move messages with this correlation ID, may be repeated")
+	fs.Float64Var(&opts.RateLimit.PerSecond, "rate", 0, "maximum number of messages to move per second, 0 is unlimited")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "print the messages that would be moved without moving them")
+	fs.IntVar(&opts.Max, "max", 0, "maximum number of messages to move, 0 moves all matching messages")
+	fs.DurationVar(&opts.IdleTimeout, "idle", redrive.DefaultIdleTimeout, "exit after receiving no new messages for this duration")
+	transform := fs.String("transform", "", "shell command that transforms each payload from stdin to stdout, transformed messages are republished unsigned")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("redrive requires a source and a destination queue uri")
+	}
+	if *errorReason != "" {
+		opts.Filter.ErrorReason, err = regexp.Compile(*errorReason)
+		if err != nil {
+			return fmt.Errorf("invalid error reason: %w", err)
+		}
+	}
+	if *transform != "" {
+		opts.Transform = shellTransform(*transform)
+	} else {
+		// Messages are moved byte for byte so signed and encrypted messages remain valid.
+		opts.PassThrough = true
+	}
+	opts.OnMessage = func(r redrive.Result) {
+		if r.Err != nil {
+			fmt.Fprintf(env.stdout, "%s %s correlation_id=%s: %s\n", r.Action, r.ID, r.CorrelationID, r.Err)
+			return
+		}
+		fmt.Fprintf(env.stdout, "%s %s correlation_id=%s\n", r.Action, r.ID, r.CorrelationID)
+	}
+
+	report, err := redrive.Redrive(ctx, fs.Arg(0), fs.Arg(1), opts)
+	fmt.Fprintf(env.stdout, "received %d, moved %d, matched %d, skipped %d, failed %d\n",
+		report.Received, report.Moved, report.Matched, report.Skipped, report.Failed)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// shellTransform returns a redrive.TransformFunc that pipes payloads through a shell command.
+func shellTransform(command string) redrive.TransformFunc {
+	return func(ctx context.Context, data []byte) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Stdin = bytes.NewReader(data)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("transforming message: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return out, nil
+	}
+}
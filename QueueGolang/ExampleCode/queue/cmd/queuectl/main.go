@@ -0,0 +1,96 @@
+// Command queuectl publishes, consumes and inspects messages on any registered queue scheme
+// (mem, sqs, nsqd, nsqlookupd, file, redis, rediss, amqp and amqps), and redrives messages from
+// dead letter queues.
+//
+// Usage:
+//
+//	queuectl publish [-file path] [-correlation-id id] [-header key=value]... uri
+//	queuectl consume [-type name] [-n count] uri
+//	queuectl tail [-type name] [-n count] uri
+//	queuectl peek [-type name] [-n count] uri
+//	queuectl count uri
+//	queuectl purge -yes uri
+//	queuectl redrive [-after time] [-before time] [-correlation-id id]...
+//		[-rate n] [-dry-run] [-max n] [-idle duration] [-transform command] source destination
+//
+// Message types that are registered by generated code can be used with -type to decode and
+// pretty print payloads.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/cli"
+
+	"queue"
+	_ "queue/amqp"
+	_ "queue/file"
+	_ "queue/mem"
+	_ "queue/nsq"
+	_ "queue/redis"
+	_ "queue/sqs"
+)
+
+const usage = `usage: queuectl <command> [flags] uri
+
+commands:
+  publish   publish a message from stdin or a file
+  consume   consume, print and acknowledge messages
+  tail      alias of consume
+  peek      print messages without acknowledging them
+  count     print the number of messages waiting in the queue
+  purge     delete all the messages waiting in the queue
+  redrive   move messages from a source queue, e.g. a dead letter queue, to a destination
+`
+
+var errUsage = errors.New(usage)
+
+// commands maps the command names to their implementations.
+var commands = map[string]func(ctx context.Context, env env, args []string) error{
+	"publish": publish,
+	"consume": consume,
+	"tail":    consume,
+	"peek":    peek,
+	"count":   count,
+	"purge":   purge,
+	"redrive": redriveMessages,
+}
+
+// env holds the streams used by commands so they can be tested.
+type env struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err := run(ctx, env{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "queuectl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, env env, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+	// Only warnings and errors are logged so they do not interleave with printed messages.
+	queue.SetDefaultLogger(queue.NewApexLogger(&log.Logger{
+		Handler: cli.New(env.stderr),
+		Level:   log.WarnLevel,
+	}))
+	return cmd(ctx, env, args[1:])
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"queue"
+)
+
+func runCommand(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	err := run(ctx, env{stdin: strings.NewReader(stdin), stdout: &stdout, stderr: &stderr}, args)
+	return stdout.String(), err
+}
+
+func TestPublishConsume(t *testing.T) {
+	uri := "mem://queuectl-consume"
+	_, err := runCommand(t, `{"id":"1","to":"to@example.com"}`,
+		"publish", "-header", "source=queuectl", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := runCommand(t, "", "count", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "1\n" {
+		t.Errorf("expected count of 1, got %q", out)
+	}
+
+	out, err = runCommand(t, "", "consume", "-type", "EmailMessage", "-n", "1", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"source: queuectl", `"to": "to@example.com"`, `"JobType": ""`} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected output to contain %q, got:\n%s", s, out)
+		}
+	}
+}
+
+func TestPurge(t *testing.T) {
+	uri := "mem://queuectl-purge"
+	for i := 0; i < 2; i++ {
+		if _, err := runCommand(t, "message", "publish", uri); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := runCommand(t, "", "purge", uri); err == nil {
+		t.Error("expected purge to require confirmation")
+	}
+	if _, err := runCommand(t, "", "purge", "-yes", uri); err != nil {
+		t.Fatal(err)
+	}
+	out, err := runCommand(t, "", "count", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "0\n" {
+		t.Errorf("expected count of 0 after purge, got %q", out)
+	}
+}
+
+func TestRedrive(t *testing.T) {
+	dlq, uri := "mem://queuectl-redrive-dlq", "mem://queuectl-redrive"
+	for _, reason := range []string{"handler timeout", "invalid message"} {
+		_, err := runCommand(t, "message", "publish", "-header", queue.ErrorReasonHeader+"="+reason, dlq)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := runCommand(t, "", "redrive", "-error-reason", "timeout", "-idle", "200ms",
+		"-transform", "tr a-z A-Z", dlq, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "received 2, moved 1, matched 0, skipped 1, failed 0") {
+		t.Errorf("expected redrive summary, got:\n%s", out)
+	}
+
+	out, err = runCommand(t, "", "consume", "-n", "1", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"error_reason: handler timeout", "MESSAGE"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected output to contain %q, got:\n%s", s, out)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "no command"},
+		{name: "unknown command", args: []string{"drain", "mem://queue"}},
+		{name: "missing uri", args: []string{"count"}},
+		{name: "unknown type", args: []string{"consume", "-type", "Unknown", "mem://queue"}},
+		{name: "invalid header", args: []string{"publish", "-header", "source", "mem://queue"}},
+		{name: "missing destination", args: []string{"redrive", "mem://queue"}},
+		{name: "invalid time", args: []string{"redrive", "-after", "yesterday", "mem://dlq", "mem://queue"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := runCommand(t, "", tt.args...); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+	if _, err := runCommand(t, "", "peek", "nsqd://localhost:4150/topic/channel"); !errors.Is(err, queue.ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported peeking an nsq queue, got %v", err)
+	}
+}
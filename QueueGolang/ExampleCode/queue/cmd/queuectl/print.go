@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"queue"
+	"queue/compression"
+)
+
+// message is a consumed or peeked message to print.
+type message struct {
+	ID            string
+	CorrelationID string
+	Headers       map[string]string
+	Body          string
+}
+
+func printMessage(w io.Writer, m message) {
+	fmt.Fprintf(w, "id: %s\n", m.ID)
+	fmt.Fprintf(w, "correlation_id: %s\n", m.CorrelationID)
+	if len(m.Headers) > 0 {
+		keys := make([]string, 0, len(m.Headers))
+		for k := range m.Headers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintln(w, "headers:")
+		for _, k := range keys {
+			fmt.Fprintf(w, "  %s: %s\n", k, m.Headers[k])
+		}
+	}
+	fmt.Fprintf(w, "body:\n%s\n\n", m.Body)
+}
+
+// decoder formats message payloads for printing, decoding them into a registered message type
+// if one is configured.
+type decoder struct {
+	t reflect.Type
+}
+
+func newDecoder(typeName string) (decoder, error) {
+	if typeName == "" {
+		return decoder{}, nil
+	}
+	var names []string
+	for _, t := range queue.MessageTypes() {
+		if t.Name() == typeName {
+			return decoder{t: t}, nil
+		}
+		names = append(names, t.Name())
+	}
+	return decoder{}, fmt.Errorf("unknown message type %q, should be one of %s", typeName, strings.Join(names, ", "))
+}
+
+// decode returns the payload decoded into the message type and formatted as indented JSON.
+// Payloads that cannot be decoded are formatted as is.
+func (d decoder) decode(ctx context.Context, q *queue.QueueHandler, data []byte) string {
+	if d.t != nil {
+		v := reflect.New(d.t)
+		err := q.Unmarshal(ctx, data, v.Interface())
+		if err != nil {
+			return fmt.Sprintf("decoding %s: %s\n%s", d.t.Name(), err, raw(data))
+		}
+		byt, err := json.MarshalIndent(v.Interface(), "", "  ")
+		if err == nil {
+			return string(byt)
+		}
+	}
+	return raw(data)
+}
+
+// raw formats a payload, indenting JSON and quoting binary payloads.
+func raw(data []byte) string {
+	var buf bytes.Buffer
+	if json.Indent(&buf, data, "", "  ") == nil {
+		return buf.String()
+	}
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return fmt.Sprintf("%q", data)
+}
+
+// decompress returns the payload of a peeked message, decompressing it if it was compressed
+// when published.
+func decompress(m queue.PeekedMessage) []byte {
+	encoding := m.Headers[compression.Header]
+	if encoding == "" {
+		return m.Data
+	}
+	data, err := compression.Decompress(encoding, m.Data)
+	if err != nil {
+		return m.Data
+	}
+	return data
+}
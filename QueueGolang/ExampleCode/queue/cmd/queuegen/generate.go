@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	// annotation marks a message type for which code should be generated.
+	annotation = "//queue:message"
+	// generatedHeader identifies files generated by queuegen.
+	generatedHeader = "// Code generated by queuegen. DO NOT EDIT."
+	// fileSuffix is the suffix of generated files, which are named after the message type.
+	fileSuffix = "_queue_handler.go"
+)
+
+var (
+	//go:embed queue_handler.go.tmpl
+	queueHandlerTemplate string
+	tmpl                 = template.Must(template.New("queue_handler").Parse(queueHandlerTemplate))
+)
+
+type message struct {
+	Package       string
+	OptionsImport string
+	Type          string
+}
+
+// generate scans the package in dir for annotated message types and returns the generated
+// files keyed by file name.
+func generate(dir string) (map[string][]byte, error) {
+	fset := token.NewFileSet()
+	names, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	var pkg, optionsImport string
+	var types []string
+	for _, name := range names {
+		if strings.HasSuffix(name, "_test.go") || strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		pkg = f.Name.Name
+		for _, imp := range f.Imports {
+			p, err := strconv.Unquote(imp.Path.Value)
+			if err == nil && path.Base(p) == "options" {
+				optionsImport = p
+			}
+		}
+		types = append(types, annotatedTypes(f)...)
+	}
+	if len(types) == 0 {
+		return nil, nil
+	}
+	if optionsImport == "" {
+		return nil, errors.New("no options package imported by package " + pkg)
+	}
+	files := make(map[string][]byte)
+	for _, t := range types {
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, message{Package: pkg, OptionsImport: optionsImport, Type: t})
+		if err != nil {
+			return nil, err
+		}
+		src, err := format.Source(buf.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("formatting %s: %w", t, err)
+		}
+		files[strings.ToLower(t)+fileSuffix] = src
+	}
+	return files, nil
+}
+
+// annotatedTypes returns the names of the types declared in the file that are annotated with
+// the message annotation.
+func annotatedTypes(f *ast.File) []string {
+	var types []string
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			doc := ts.Doc
+			if doc == nil && len(gen.Specs) == 1 {
+				doc = gen.Doc
+			}
+			if isAnnotated(doc) {
+				types = append(types, ts.Name.Name)
+			}
+		}
+	}
+	return types
+}
+
+func isAnnotated(doc *ast.CommentGroup) bool {
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if strings.TrimSpace(c.Text) == annotation {
+			return true
+		}
+	}
+	return false
+}
+
+// write writes the generated files to dir and removes previously generated files for types
+// that are no longer annotated.
+func write(dir string, files map[string][]byte) error {
+	stale, err := staleFiles(dir, files)
+	if err != nil {
+		return err
+	}
+	for _, name := range stale {
+		src, ok := files[name]
+		if !ok {
+			err = os.Remove(filepath.Join(dir, name))
+		} else {
+			err = os.WriteFile(filepath.Join(dir, name), src, 0o644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// staleFiles returns the names of the files in dir that are missing, differ from the generated
+// files or were generated for types that are no longer annotated.
+func staleFiles(dir string, files map[string][]byte) ([]string, error) {
+	var stale []string
+	for name, src := range files {
+		existing, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if !bytes.Equal(existing, src) {
+			stale = append(stale, name)
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+fileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if _, ok := files[filepath.Base(name)]; ok {
+			continue
+		}
+		src, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(src, []byte(generatedHeader)) {
+			stale = append(stale, filepath.Base(name))
+		}
+	}
+	sort.Strings(stale)
+	return stale, nil
+}
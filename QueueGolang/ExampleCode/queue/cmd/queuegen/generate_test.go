@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const messages = `package example
+
+import "example/options"
+
+//queue:message
+type OrderMessage struct {
+	ID string
+}
+
+type (
+	//queue:message
+	RefundMessage struct {
+		ID string
+	}
+	unannotated struct{}
+)
+
+//queue:message
+type Alias = OrderMessage
+
+var _ options.PublishOptions
+`
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "messages.go", messages)
+
+	files, err := generate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	expected := []string{"alias_queue_handler.go", "ordermessage_queue_handler.go", "refundmessage_queue_handler.go"}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected files %v, got %v", expected, names)
+	}
+	src := string(files["ordermessage_queue_handler.go"])
+	for _, s := range []string{
+		generatedHeader,
+		"package example",
+		`"example/options"`,
+		"func (q *QueueHandler) AddOrderMessageHandler(handler OrderMessageHandler) *QueueHandler",
+		"func (q *QueueHandler) PublishOrderMessage(m OrderMessage, opts ...options.PublishOptions) error",
+		"type OrderMessagePublisher interface",
+		"func NewOrderMessagePublisher(q *QueueHandler) OrderMessagePublisher",
+		"type FakeOrderMessagePublisher struct",
+	} {
+		if !strings.Contains(src, s) {
+			t.Errorf("expected generated code to contain %q", s)
+		}
+	}
+}
+
+func TestStaleFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "messages.go", messages)
+	files, err := generate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := staleFiles(dir, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != len(files) {
+		t.Errorf("expected all files to be stale before writing, got %v", stale)
+	}
+
+	if err := write(dir, files); err != nil {
+		t.Fatal(err)
+	}
+	if stale, _ := staleFiles(dir, files); len(stale) != 0 {
+		t.Errorf("expected no stale files after writing, got %v", stale)
+	}
+
+	// Modified, orphaned and hand written files.
+	writeFile(t, dir, "alias_queue_handler.go", generatedHeader+"\n\npackage example\n")
+	writeFile(t, dir, "removed_queue_handler.go", generatedHeader+"\n\npackage example\n")
+	writeFile(t, dir, "handwritten_queue_handler.go", "package example\n")
+	stale, err = staleFiles(dir, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"alias_queue_handler.go", "removed_queue_handler.go"}
+	if !reflect.DeepEqual(stale, expected) {
+		t.Errorf("expected stale files %v, got %v", expected, stale)
+	}
+
+	if err := write(dir, files); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "removed_queue_handler.go")); !os.IsNotExist(err) {
+		t.Error("expected orphaned generated file to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "handwritten_queue_handler.go")); err != nil {
+		t.Error("expected hand written file to be kept")
+	}
+}
+
+// TestQueuePackage fails when the generated files in the queue package are stale.
+func TestQueuePackage(t *testing.T) {
+	dir := filepath.Join("..", "..")
+	files, err := generate(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := staleFiles(dir, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) > 0 {
+		t.Errorf("stale generated files, run go generate: %v", stale)
+	}
+}
+
+func writeFile(t *testing.T, dir, name, src string) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,55 @@
+// Command queuegen generates the typed Add<Type>Handler, Publish<Type>, <Type>Publisher and
+// New<Type>Publisher code, and a Fake<Type>Publisher for use in tests, for message types in a
+// package annotated with:
+//
+//	//queue:message
+//	type EmailMessage struct {
+//		...
+//	}
+//
+// Usage:
+//
+//	queuegen [-check] [dir]
+//
+// It is run by go generate in the queue package. With -check it writes nothing and exits with
+// a non-zero status if any generated files are stale.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	check := flag.Bool("check", false, "exit with a non-zero status if generated files are stale instead of writing them")
+	flag.Parse()
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+
+	files, err := generate(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "queuegen:", err)
+		os.Exit(1)
+	}
+	if *check {
+		stale, err := staleFiles(dir, files)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "queuegen:", err)
+			os.Exit(1)
+		}
+		if len(stale) > 0 {
+			fmt.Fprintf(os.Stderr, "queuegen: stale generated files, run go generate: %s\n", strings.Join(stale, ", "))
+			os.Exit(1)
+		}
+		return
+	}
+	err = write(dir, files)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "queuegen:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,59 @@
+// Command queueschema dumps the JSON Schemas of the registered message types so producers in
+// other languages can validate their messages.
+//
+// Usage:
+//
+//	queueschema [-out dir]
+//
+// Without -out the schemas are written to stdout as a single JSON object keyed by message type,
+// otherwise a <Type>.json file is written to dir for each message type.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"queue"
+	"queue/schema"
+)
+
+func main() {
+	out := flag.String("out", "", "directory to write a schema file per message type to")
+	flag.Parse()
+
+	err := dump(*out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "queueschema:", err)
+		os.Exit(1)
+	}
+}
+
+func dump(out string) error {
+	schemas := make(map[string]json.RawMessage)
+	for _, t := range queue.MessageTypes() {
+		doc, err := schema.Generate(t)
+		if err != nil {
+			return fmt.Errorf("generating schema for %s: %w", t.Name(), err)
+		}
+		schemas[t.Name()] = doc
+	}
+	if out == "" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(schemas)
+	}
+	err := os.MkdirAll(out, 0o755)
+	if err != nil {
+		return err
+	}
+	for name, doc := range schemas {
+		err := os.WriteFile(filepath.Join(out, name+".json"), append(doc, '\n'), 0o644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+
+	"queue/codec"
+	"queue/options"
+	"queue/schema"
+)
+
+// SetCodec sets the default Codec used to marshal published messages, codec.JSON is used if
+// it is not set. It returns the QueueHandler for chaining.
+func (q *QueueHandler) SetCodec(c codec.Codec) *QueueHandler {
+	q.codec = c
+	return q
+}
+
+// SetMessageCodec sets the Codec used to marshal published messages of the same type as m,
+// overriding the default Codec for that type. It returns the QueueHandler for chaining.
+func (q *QueueHandler) SetMessageCodec(m interface{}, c codec.Codec) *QueueHandler {
+	if q.messageCodecs == nil {
+		q.messageCodecs = make(map[reflect.Type]codec.Codec)
+	}
+	q.messageCodecs[reflect.TypeOf(m)] = c
+	return q
+}
+
+// Codec returns the Codec used to marshal published messages of type t.
+func (q *QueueHandler) Codec(t reflect.Type) codec.Codec {
+	if c, ok := q.messageCodecs[t]; ok {
+		return c
+	}
+	if q.codec != nil {
+		return q.codec
+	}
+	return codec.JSON
+}
+
+// SetValidator sets the Validator used to validate messages against the JSON Schema of their
+// type when they are published and received. Messages that do not conform are rejected with a
+// *schema.ValidationError. Payloads using the protobuf codec are not validated as their schema
+// is defined by their .proto file. It returns the QueueHandler for chaining.
+func (q *QueueHandler) SetValidator(v *schema.Validator) *QueueHandler {
+	q.validator = v
+	return q
+}
+
+// Marshal marshals a message using the Codec configured for its type. It returns the payload
+// and the options recording its content type and schema version, which should be published
+// with it.
+func (q *QueueHandler) Marshal(m interface{}) ([]byte, options.PublishOptions, error) {
+	t := reflect.TypeOf(m)
+	c := q.Codec(t)
+	if q.validator != nil && c.ContentType() != codec.ContentTypeProtobuf {
+		err := q.validator.Validate(t, m)
+		if err != nil {
+			return nil, options.PublishOptions{}, err
+		}
+	}
+	data, err := c.Marshal(m)
+	if err != nil {
+		return nil, options.PublishOptions{}, err
+	}
+	return data, options.WithHeaders(map[string]string{
+		codec.Header:        c.ContentType(),
+		SchemaVersionHeader: strconv.Itoa(SchemaVersion(t)),
+	}), nil
+}
+
+// Unmarshal unmarshals a received payload into m, which must be a pointer, using the Codec
+// registered for the content type in the message context. Payloads without a content type are
+// unmarshaled as JSON, so consumers can decode messages regardless of the Codec configured by
+// the producer. Messages published with an older schema version are upgraded using the
+// registered Upcasters before being validated. JSON payloads are validated as received, other
+// payloads are validated once unmarshaled, using their JSON encoding, as the field names of
+// other codecs may differ from those of the schema.
+func (q *QueueHandler) Unmarshal(ctx context.Context, data []byte, m interface{}) error {
+	c, err := codec.Lookup(options.HeaderFromContext(ctx, codec.Header))
+	if err != nil {
+		return err
+	}
+	version, err := parseSchemaVersion(options.HeaderFromContext(ctx, SchemaVersionHeader))
+	if err != nil {
+		return err
+	}
+	t := reflect.TypeOf(m).Elem()
+	validate := q.validator != nil && c.ContentType() != codec.ContentTypeProtobuf
+	if version != SchemaVersion(t) {
+		fields, err := decodeFields(c, t, data)
+		if err != nil {
+			return err
+		}
+		fields, err = upcast(t, version, fields)
+		if err != nil {
+			return err
+		}
+		data, err = c.Marshal(fields)
+		if err != nil {
+			return err
+		}
+	}
+	if validate && c.ContentType() == codec.ContentTypeJSON {
+		var doc interface{}
+		err = json.Unmarshal(data, &doc)
+		if err != nil {
+			return err
+		}
+		err = q.validator.Validate(t, doc)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Unmarshal(data, m)
+	if err != nil {
+		return err
+	}
+	if validate && c.ContentType() != codec.ContentTypeJSON {
+		return q.validator.Validate(t, reflect.ValueOf(m).Elem().Interface())
+	}
+	return nil
+}
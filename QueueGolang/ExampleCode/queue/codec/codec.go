@@ -0,0 +1,147 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Header is the message header recording the content type of a payload.
+const Header = "content_type"
+
+// Content types of the provided codecs.
+const (
+	ContentTypeJSON        = "application/json"
+	ContentTypeProtobuf    = "application/x-protobuf"
+	ContentTypeMessagePack = "application/msgpack"
+	ContentTypeCBOR        = "application/cbor"
+)
+
+// Codec marshals messages to and from the payloads published to a queue.
+type Codec interface {
+	// ContentType returns the content type recorded in the header of payloads marshaled by
+	// the Codec.
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON marshals messages using encoding/json. It is the default codec and is used to
+	// unmarshal payloads without a content type header.
+	JSON Codec = jsonCodec{}
+	// Protobuf marshals messages that implement proto.Message.
+	Protobuf Codec = protobufCodec{}
+	// MessagePack marshals messages using MessagePack.
+	MessagePack Codec = msgpackCodec{}
+	// CBOR marshals messages using CBOR.
+	CBOR Codec = cborCodec{}
+
+	registryMtx sync.RWMutex
+	registry    = map[string]Codec{
+		ContentTypeJSON:        JSON,
+		ContentTypeProtobuf:    Protobuf,
+		ContentTypeMessagePack: MessagePack,
+		ContentTypeCBOR:        CBOR,
+	}
+)
+
+// Register registers a Codec by its content type so that payloads with that content type can
+// be unmarshaled. The provided codecs are registered by default.
+func Register(c Codec) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	registry[c.ContentType()] = c
+}
+
+// Lookup returns the registered Codec for the provided content type. An empty content type
+// returns the JSON codec.
+func Lookup(contentType string) (Codec, error) {
+	if contentType == "" {
+		return JSON, nil
+	}
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	c, ok := registry[contentType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content type %q", contentType)
+	}
+	return c, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	// Generated messages are used by pointer, so typed handlers unmarshal into a pointer to a
+	// pointer, which is allocated if nil.
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Kind() == reflect.Ptr {
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		v = rv.Elem().Interface()
+	}
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return ContentTypeMessagePack
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) ContentType() string {
+	return ContentTypeCBOR
+}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
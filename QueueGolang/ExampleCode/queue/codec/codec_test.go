@@ -0,0 +1,88 @@
+package codec
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type message struct {
+	ID    string
+	Count int
+	Tags  []string
+}
+
+func TestCodecs(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+	}{
+		{name: "json", codec: JSON},
+		{name: "msgpack", codec: MessagePack},
+		{name: "cbor", codec: CBOR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := message{ID: "1", Count: 2, Tags: []string{"a", "b"}}
+			data, err := tt.codec.Marshal(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out message
+			err = tt.codec.Unmarshal(data, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(in, out) {
+				t.Errorf("expected %+v, got %+v", in, out)
+			}
+			c, err := Lookup(tt.codec.ContentType())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c != tt.codec {
+				t.Errorf("expected lookup of %s to return the codec", tt.codec.ContentType())
+			}
+		})
+	}
+}
+
+func TestProtobuf(t *testing.T) {
+	data, err := Protobuf.Marshal(wrapperspb.String("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out wrapperspb.StringValue
+	err = Protobuf.Unmarshal(data, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.GetValue() != "value" {
+		t.Errorf("expected value, got %s", out.GetValue())
+	}
+	var ptr *wrapperspb.StringValue
+	err = Protobuf.Unmarshal(data, &ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr.GetValue() != "value" {
+		t.Errorf("expected value unmarshaling into a pointer to a pointer, got %s", ptr.GetValue())
+	}
+	if _, err := Protobuf.Marshal(message{}); err == nil {
+		t.Error("expected error marshaling a type that is not a proto.Message")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	c, err := Lookup("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != JSON {
+		t.Error("expected payloads without a content type to use the JSON codec")
+	}
+	if _, err := Lookup("application/unknown"); err == nil {
+		t.Error("expected error looking up an unregistered content type")
+	}
+}
@@ -0,0 +1,128 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"queue/codec"
+	"queue/options"
+	"queue/schema"
+)
+
+func TestQueueHandler_Codec(t *testing.T) {
+	received := make(chan EmailMessage, 1)
+	q := NewQueueHandler("test://codec", 1).
+		SetCodec(codec.MessagePack).
+		AddEmailMessageHandler(func(ctx context.Context, m EmailMessage) error {
+			received <- m
+			return nil
+		})
+	q.Start()
+	loopback(q)
+	defer q.Close()
+
+	m := EmailMessage{ID: "1", To: "to@example.com"}
+	// Consumers decode by the content type header so switching codecs does not require
+	// consumers to be reconfigured.
+	for _, c := range []codec.Codec{codec.MessagePack, codec.CBOR, codec.JSON} {
+		q.SetMessageCodec(EmailMessage{}, c)
+		if err := q.PublishEmailMessage(m); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-received; got != m {
+			t.Errorf("%s: expected %+v, got %+v", c.ContentType(), m, got)
+		}
+	}
+}
+
+func TestQueueHandler_Marshal(t *testing.T) {
+	q := NewQueueHandler("test://codec", 1)
+	_, opts, err := q.Marshal(EmailMessage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType := opts.Headers[codec.Header]; contentType != codec.ContentTypeJSON {
+		t.Errorf("expected default content type %s, got %s", codec.ContentTypeJSON, contentType)
+	}
+	q.SetCodec(codec.CBOR).SetMessageCodec(EmailMessage{}, codec.MessagePack)
+	for m, expected := range map[interface{}]string{
+		EmailMessage{}:       codec.ContentTypeMessagePack,
+		DV360ImportMessage{}: codec.ContentTypeCBOR,
+	} {
+		_, opts, err := q.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType := opts.Headers[codec.Header]; contentType != expected {
+			t.Errorf("%T: expected content type %s, got %s", m, expected, contentType)
+		}
+	}
+}
+
+func TestQueueHandler_Validation(t *testing.T) {
+	received := make(chan DV360ImportMessage, 1)
+	q := NewQueueHandler("test://validation", 1).
+		SetValidator(schema.NewValidator()).
+		AddDV360ImportMessageHandler(func(ctx context.Context, m DV360ImportMessage) error {
+			received <- m
+			return nil
+		})
+	q.Start()
+	loopback(q)
+	defer q.Close()
+
+	m := DV360ImportMessage{InputURI: "gs://bucket/file"}
+	if err := q.PublishDV360ImportMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got.InputURI != m.InputURI {
+		t.Errorf("expected %+v, got %+v", m, got)
+	}
+
+	// A non-conforming payload from a producer that does not use the generated publisher.
+	err := <-q.Receive(context.Background(), []byte(`{"InputURI":1}`))
+	var verr *schema.ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected ValidationError, got %v", err)
+	}
+	expected := []schema.FieldError{
+		{Field: "", Message: "missing properties: 'ImportJob'"},
+		{Field: "/InputURI", Message: "expected string, but got number"},
+	}
+	if !reflect.DeepEqual(verr.Fields, expected) {
+		t.Errorf("expected field errors %+v, got %+v", expected, verr.Fields)
+	}
+}
+
+type auditFields struct {
+	Source string `json:"source"`
+}
+
+type auditMessage struct {
+	auditFields
+	ID string `json:"id"`
+}
+
+func TestQueueHandler_ValidationMessagePack(t *testing.T) {
+	q := NewQueueHandler("test://validation", 1).
+		SetCodec(codec.MessagePack).
+		SetValidator(schema.NewValidator())
+
+	// MessagePack encodes the Go field names, not the json tags used by the schema, and the
+	// embedded struct as a nested field.
+	m := auditMessage{auditFields: auditFields{Source: "test"}, ID: "1"}
+	data, opts, err := q.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got auditMessage
+	err = q.Unmarshal(options.ContextWithPublishOptions(context.Background(), opts), data, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != m {
+		t.Errorf("expected %+v, got %+v", m, got)
+	}
+}
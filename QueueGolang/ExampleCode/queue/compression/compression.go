@@ -0,0 +1,115 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Header is the message header recording the encoding of a compressed payload.
+const Header = "content_encoding"
+
+// Supported encodings.
+const (
+	Gzip   = "gzip"
+	Zstd   = "zstd"
+	Snappy = "snappy"
+)
+
+// DefaultMaxSize is the maximum size of a payload decompressed by Decompress.
+const DefaultMaxSize = 256 << 20
+
+// ErrTooLarge is returned when a decompressed payload exceeds the maximum size.
+var ErrTooLarge = errors.New("decompressed payload exceeds the maximum size")
+
+// EncodeAll is safe for concurrent use so a single encoder is shared.
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// Compress compresses the data using the provided encoding.
+func Compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case Snappy:
+		return snappy.Encode(nil, data), nil
+	}
+	return nil, fmt.Errorf("unsupported compression encoding %q", encoding)
+}
+
+// Decompress decompresses data that was compressed using the provided encoding. It returns
+// ErrTooLarge if the decompressed data exceeds DefaultMaxSize.
+func Decompress(encoding string, data []byte) ([]byte, error) {
+	return DecompressLimit(encoding, data, DefaultMaxSize)
+}
+
+// DecompressLimit decompresses data that was compressed using the provided encoding. It returns
+// ErrTooLarge, without decompressing the remaining data, once the decompressed data exceeds
+// maxSize bytes.
+func DecompressLimit(encoding string, data []byte, maxSize int64) ([]byte, error) {
+	switch encoding {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimit(r, maxSize)
+	case Zstd:
+		r, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimit(r, maxSize)
+	case Snappy:
+		// The decoded length is recorded before the data, and decoding fails if it does not
+		// match, so it can be checked before allocating.
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if int64(n) > maxSize {
+			return nil, ErrTooLarge
+		}
+		return snappy.Decode(nil, data)
+	}
+	return nil, fmt.Errorf("unsupported compression encoding %q", encoding)
+}
+
+// readLimit reads all of the data from the reader, returning ErrTooLarge if it exceeds maxSize.
+func readLimit(r io.Reader, maxSize int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
+// Supported returns whether the encoding is supported.
+func Supported(encoding string) bool {
+	switch encoding {
+	case Gzip, Zstd, Snappy:
+		return true
+	}
+	return false
+}
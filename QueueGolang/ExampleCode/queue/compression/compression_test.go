@@ -0,0 +1,54 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCompressDecompress(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"measurement":"value"},`), 100)
+	for _, encoding := range []string{Gzip, Zstd, Snappy} {
+		t.Run(encoding, func(t *testing.T) {
+			compressed, err := Compress(encoding, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(compressed) >= len(data) {
+				t.Errorf("expected compressed size %d to be less than %d", len(compressed), len(data))
+			}
+			decompressed, err := Decompress(encoding, compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decompressed, data) {
+				t.Error("expected decompressed data to equal the original")
+			}
+		})
+	}
+	if _, err := Compress("brotli", data); err == nil {
+		t.Error("expected unsupported encoding to error")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	data := bytes.Repeat([]byte{0}, 1<<20)
+	for _, encoding := range []string{Gzip, Zstd, Snappy} {
+		t.Run(encoding, func(t *testing.T) {
+			compressed, err := Compress(encoding, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := DecompressLimit(encoding, compressed, int64(len(data))-1); !errors.Is(err, ErrTooLarge) {
+				t.Errorf("expected ErrTooLarge, got %v", err)
+			}
+			decompressed, err := DecompressLimit(encoding, compressed, int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decompressed, data) {
+				t.Error("expected decompressed data at the limit to equal the original")
+			}
+		})
+	}
+}
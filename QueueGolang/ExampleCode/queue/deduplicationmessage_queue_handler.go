@@ -1,28 +1,22 @@
+// Code generated by queuegen. DO NOT EDIT.
+
 package queue
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"sync"
 
 	"queue/options"
 )
 
+func init() {
+	RegisterMessageType[DeduplicationMessage]()
+}
+
 type DeduplicationMessageHandler func(ctx context.Context, r DeduplicationMessage) error
 
 func (q *QueueHandler) AddDeduplicationMessageHandler(handler DeduplicationMessageHandler) *QueueHandler {
-	return q.AddHandler(func(ctx context.Context, data []byte) error {
-		var msg DeduplicationMessage
-		err := json.Unmarshal(data, &msg)
-		if err != nil {
-			return fmt.Errorf("parsing message json: %w", err)
-		}
-		err = handler(ctx, msg)
-		if err != nil {
-			return fmt.Errorf("handling message: %w", err)
-		}
-		return nil
-	})
+	return Handle[DeduplicationMessage](q, handler)
 }
 
 type DeduplicationMessagePublisher interface {
@@ -30,13 +24,36 @@ type DeduplicationMessagePublisher interface {
 }
 
 func (q *QueueHandler) PublishDeduplicationMessage(m DeduplicationMessage, opts ...options.PublishOptions) error {
-	byt, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("marshaling message into json: %w", err)
-	}
-	err = q.Publish(byt, opts...)
-	if err != nil {
-		return fmt.Errorf("publishing to queue: %w", err)
+	return NewPublisher[DeduplicationMessage](q).Publish(m, opts...)
+}
+
+// NewDeduplicationMessagePublisher returns the QueueHandler as a DeduplicationMessagePublisher, recording DeduplicationMessage as a type it publishes.
+func NewDeduplicationMessagePublisher(q *QueueHandler) DeduplicationMessagePublisher {
+	NewPublisher[DeduplicationMessage](q)
+	return q
+}
+
+// FakeDeduplicationMessagePublisher is a DeduplicationMessagePublisher that records published messages, for use in tests.
+type FakeDeduplicationMessagePublisher struct {
+	mtx      sync.Mutex
+	messages []DeduplicationMessage
+	// Err is returned by PublishDeduplicationMessage when set, in which case the message is not recorded.
+	Err error
+}
+
+func (f *FakeDeduplicationMessagePublisher) PublishDeduplicationMessage(m DeduplicationMessage, opts ...options.PublishOptions) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.Err != nil {
+		return f.Err
 	}
+	f.messages = append(f.messages, m)
 	return nil
 }
+
+// Published returns the messages that have been published.
+func (f *FakeDeduplicationMessagePublisher) Published() []DeduplicationMessage {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]DeduplicationMessage(nil), f.messages...)
+}
@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"reflect"
+	"sync"
+)
+
+var (
+	queuesMtx sync.Mutex
+	queues    []*QueueHandler
+)
+
+// Queues returns the open QueueHandlers returned by Queue, in the order they were configured. It
+// allows tooling to describe the queues used by a service, e.g. to generate documentation.
+func Queues() []*QueueHandler {
+	queuesMtx.Lock()
+	defer queuesMtx.Unlock()
+	return append([]*QueueHandler(nil), queues...)
+}
+
+func addQueue(q *QueueHandler) {
+	queuesMtx.Lock()
+	defer queuesMtx.Unlock()
+	queues = append(queues, q)
+}
+
+// removeQueue removes a closed QueueHandler from the queues returned by Queues.
+func removeQueue(q *QueueHandler) {
+	queuesMtx.Lock()
+	defer queuesMtx.Unlock()
+	for i, existing := range queues {
+		if existing == q {
+			queues = append(queues[:i:i], queues[i+1:]...)
+			return
+		}
+	}
+}
+
+// HandledTypes returns the message types handled by the QueueHandler, i.e. those passed to
+// Handle or a generated Add<Type>Handler method.
+func (q *QueueHandler) HandledTypes() []reflect.Type {
+	q.typesMtx.Lock()
+	defer q.typesMtx.Unlock()
+	return append([]reflect.Type(nil), q.handledTypes...)
+}
+
+// PublishedTypes returns the message types published by the QueueHandler, i.e. those for which
+// a Publisher has been created using NewPublisher or a generated New<Type>Publisher function,
+// or a generated Publish<Type> method called.
+func (q *QueueHandler) PublishedTypes() []reflect.Type {
+	q.typesMtx.Lock()
+	defer q.typesMtx.Unlock()
+	return append([]reflect.Type(nil), q.publishedTypes...)
+}
+
+// addType adds a message type to the slice if it is not already present.
+func (q *QueueHandler) addType(types *[]reflect.Type, t reflect.Type) {
+	q.typesMtx.Lock()
+	defer q.typesMtx.Unlock()
+	for _, existing := range *types {
+		if existing == t {
+			return
+		}
+	}
+	*types = append(*types, t)
+}
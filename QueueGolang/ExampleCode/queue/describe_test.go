@@ -0,0 +1,47 @@
+package queue
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+type describeMux struct{}
+
+func (describeMux) Queue(uri string) (*QueueHandler, error) {
+	return NewQueueHandler(uri, 1), nil
+}
+
+func TestQueues(t *testing.T) {
+	Register("describe", describeMux{})
+	q, err := Queue("describe://orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, configured := range Queues() {
+		found = found || configured == q
+	}
+	if !found {
+		t.Error("expected queue to be returned by Queues")
+	}
+
+	q.AddEmailMessageHandler(func(ctx context.Context, m EmailMessage) error {
+		return nil
+	})
+	var _ DV360ImportMessagePublisher = NewDV360ImportMessagePublisher(q)
+	NewPublisher[DV360ImportMessage](q)
+	if types := q.HandledTypes(); !reflect.DeepEqual(types, []reflect.Type{reflect.TypeOf(EmailMessage{})}) {
+		t.Errorf("expected handled EmailMessage, got %v", types)
+	}
+	if types := q.PublishedTypes(); !reflect.DeepEqual(types, []reflect.Type{reflect.TypeOf(DV360ImportMessage{})}) {
+		t.Errorf("expected published DV360ImportMessage, got %v", types)
+	}
+
+	q.Close()
+	for _, configured := range Queues() {
+		if configured == q {
+			t.Error("expected closed queue not to be returned by Queues")
+		}
+	}
+}
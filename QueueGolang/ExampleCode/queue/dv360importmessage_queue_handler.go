@@ -1,28 +1,22 @@
+// Code generated by queuegen. DO NOT EDIT.
+
 package queue
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"sync"
 
 	"queue/options"
 )
 
+func init() {
+	RegisterMessageType[DV360ImportMessage]()
+}
+
 type DV360ImportMessageHandler func(ctx context.Context, r DV360ImportMessage) error
 
 func (q *QueueHandler) AddDV360ImportMessageHandler(handler DV360ImportMessageHandler) *QueueHandler {
-	return q.AddHandler(func(ctx context.Context, data []byte) error {
-		var msg DV360ImportMessage
-		err := json.Unmarshal(data, &msg)
-		if err != nil {
-			return fmt.Errorf("parsing message json: %w", err)
-		}
-		err = handler(ctx, msg)
-		if err != nil {
-			return fmt.Errorf("handling message: %w", err)
-		}
-		return nil
-	})
+	return Handle[DV360ImportMessage](q, handler)
 }
 
 type DV360ImportMessagePublisher interface {
@@ -30,13 +24,36 @@ type DV360ImportMessagePublisher interface {
 }
 
 func (q *QueueHandler) PublishDV360ImportMessage(m DV360ImportMessage, opts ...options.PublishOptions) error {
-	byt, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("marshaling message into json: %w", err)
-	}
-	err = q.Publish(byt, opts...)
-	if err != nil {
-		return fmt.Errorf("publishing to queue: %w", err)
+	return NewPublisher[DV360ImportMessage](q).Publish(m, opts...)
+}
+
+// NewDV360ImportMessagePublisher returns the QueueHandler as a DV360ImportMessagePublisher, recording DV360ImportMessage as a type it publishes.
+func NewDV360ImportMessagePublisher(q *QueueHandler) DV360ImportMessagePublisher {
+	NewPublisher[DV360ImportMessage](q)
+	return q
+}
+
+// FakeDV360ImportMessagePublisher is a DV360ImportMessagePublisher that records published messages, for use in tests.
+type FakeDV360ImportMessagePublisher struct {
+	mtx      sync.Mutex
+	messages []DV360ImportMessage
+	// Err is returned by PublishDV360ImportMessage when set, in which case the message is not recorded.
+	Err error
+}
+
+func (f *FakeDV360ImportMessagePublisher) PublishDV360ImportMessage(m DV360ImportMessage, opts ...options.PublishOptions) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.Err != nil {
+		return f.Err
 	}
+	f.messages = append(f.messages, m)
 	return nil
 }
+
+// Published returns the messages that have been published.
+func (f *FakeDV360ImportMessagePublisher) Published() []DV360ImportMessage {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]DV360ImportMessage(nil), f.messages...)
+}
@@ -1,28 +1,22 @@
+// Code generated by queuegen. DO NOT EDIT.
+
 package queue
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"sync"
 
 	"queue/options"
 )
 
+func init() {
+	RegisterMessageType[EmailMessage]()
+}
+
 type EmailMessageHandler func(ctx context.Context, r EmailMessage) error
 
 func (q *QueueHandler) AddEmailMessageHandler(handler EmailMessageHandler) *QueueHandler {
-	return q.AddHandler(func(ctx context.Context, data []byte) error {
-		var msg EmailMessage
-		err := json.Unmarshal(data, &msg)
-		if err != nil {
-			return fmt.Errorf("parsing message json: %w", err)
-		}
-		err = handler(ctx, msg)
-		if err != nil {
-			return fmt.Errorf("handling message: %w", err)
-		}
-		return nil
-	})
+	return Handle[EmailMessage](q, handler)
 }
 
 type EmailMessagePublisher interface {
@@ -30,13 +24,36 @@ type EmailMessagePublisher interface {
 }
 
 func (q *QueueHandler) PublishEmailMessage(m EmailMessage, opts ...options.PublishOptions) error {
-	byt, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("marshaling message into json: %w", err)
-	}
-	err = q.Publish(byt, opts...)
-	if err != nil {
-		return fmt.Errorf("publishing to queue: %w", err)
+	return NewPublisher[EmailMessage](q).Publish(m, opts...)
+}
+
+// NewEmailMessagePublisher returns the QueueHandler as a EmailMessagePublisher, recording EmailMessage as a type it publishes.
+func NewEmailMessagePublisher(q *QueueHandler) EmailMessagePublisher {
+	NewPublisher[EmailMessage](q)
+	return q
+}
+
+// FakeEmailMessagePublisher is a EmailMessagePublisher that records published messages, for use in tests.
+type FakeEmailMessagePublisher struct {
+	mtx      sync.Mutex
+	messages []EmailMessage
+	// Err is returned by PublishEmailMessage when set, in which case the message is not recorded.
+	Err error
+}
+
+func (f *FakeEmailMessagePublisher) PublishEmailMessage(m EmailMessage, opts ...options.PublishOptions) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.Err != nil {
+		return f.Err
 	}
+	f.messages = append(f.messages, m)
 	return nil
 }
+
+// Published returns the messages that have been published.
+func (f *FakeEmailMessagePublisher) Published() []EmailMessage {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]EmailMessage(nil), f.messages...)
+}
@@ -0,0 +1,180 @@
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Message headers carrying the wrapped data key used to encrypt a payload.
+const (
+	KeyIDHeader   = "encryption_key_id"
+	DataKeyHeader = "encryption_data_key"
+)
+
+var (
+	dataKeySize = 32
+
+	// ErrUnknownKey is returned by a KeyProvider when a key ID is not known to it.
+	ErrUnknownKey = errors.New("unknown encryption key")
+)
+
+// KeyProvider wraps and unwraps the data keys used to encrypt payloads. Multiple key IDs
+// can be active for unwrapping, allowing keys to be rotated without draining queues.
+type KeyProvider interface {
+	// WrapKey encrypts the data key with the current key, returning its ID and the wrapped key.
+	WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key that was wrapped with the key with the provided ID.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Encrypt encrypts the payload with AES-GCM using a new data key wrapped by the provider. It
+// returns the ciphertext and the headers required to decrypt it.
+func Encrypt(ctx context.Context, provider KeyProvider, data []byte) ([]byte, map[string]string, error) {
+	dataKey := make([]byte, dataKeySize)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID, wrapped, err := provider.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrapping data key: %w", err)
+	}
+	ciphertext, err := seal(dataKey, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ciphertext, map[string]string{
+		KeyIDHeader:   keyID,
+		DataKeyHeader: base64.StdEncoding.EncodeToString(wrapped),
+	}, nil
+}
+
+// Decrypt decrypts a payload encrypted by Encrypt using the provided headers.
+func Decrypt(ctx context.Context, provider KeyProvider, headers map[string]string, data []byte) ([]byte, error) {
+	wrapped, err := base64.StdEncoding.DecodeString(headers[DataKeyHeader])
+	if err != nil {
+		return nil, fmt.Errorf("decoding data key: %w", err)
+	}
+	dataKey, err := provider.UnwrapKey(ctx, headers[KeyIDHeader], wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key: %w", err)
+	}
+	return open(dataKey, data)
+}
+
+// IsEncrypted returns whether the headers indicate an encrypted payload.
+func IsEncrypted(headers map[string]string) bool {
+	return headers[KeyIDHeader] != ""
+}
+
+// seal encrypts the plaintext with AES-GCM prefixing the random nonce to the ciphertext.
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts ciphertext produced by seal.
+func open(key, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// StaticKeyProvider is a KeyProvider that wraps data keys with locally held AES keys. It is
+// intended for tests and local development.
+type StaticKeyProvider struct {
+	mtx     sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewStaticKeyProvider returns a StaticKeyProvider that wraps data keys with the key with the
+// provided ID. The key must be 16, 24 or 32 bytes.
+func NewStaticKeyProvider(keyID string, key []byte) (*StaticKeyProvider, error) {
+	s := &StaticKeyProvider{keys: make(map[string][]byte)}
+	err := s.AddKey(keyID, key)
+	if err != nil {
+		return nil, err
+	}
+	s.current = keyID
+	return s, nil
+}
+
+// AddKey adds a key that can be used to unwrap data keys.
+func (s *StaticKeyProvider) AddKey(keyID string, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.keys[keyID] = key
+	return nil
+}
+
+// Rotate sets the key used to wrap new data keys. Keys previously used remain available for
+// unwrapping until removed.
+func (s *StaticKeyProvider) Rotate(keyID string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.keys[keyID]; !ok {
+		return ErrUnknownKey
+	}
+	s.current = keyID
+	return nil
+}
+
+// RemoveKey removes a key that is no longer used by any messages. The current key cannot be removed.
+func (s *StaticKeyProvider) RemoveKey(keyID string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if keyID != s.current {
+		delete(s.keys, keyID)
+	}
+}
+
+func (s *StaticKeyProvider) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	s.mtx.RLock()
+	keyID, key := s.current, s.keys[s.current]
+	s.mtx.RUnlock()
+	wrapped, err := seal(key, dataKey)
+	return keyID, wrapped, err
+}
+
+func (s *StaticKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	s.mtx.RLock()
+	key, ok := s.keys[keyID]
+	s.mtx.RUnlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return open(key, wrapped)
+}
@@ -0,0 +1,55 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestEncryptDecrypt_KeyRotation(t *testing.T) {
+	ctx := context.Background()
+	provider, err := NewStaticKeyProvider("one", bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`{"to":"someone@example.com"}`)
+	ciphertext, headers, err := Encrypt(ctx, provider, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ciphertext, data) {
+		t.Fatal("expected payload to be encrypted")
+	}
+
+	// Messages encrypted with the previous key can be decrypted after rotation.
+	err = provider.AddKey("two", bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = provider.Rotate("two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := Decrypt(ctx, provider, headers, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, data) {
+		t.Errorf("expected %s, got %s", data, plaintext)
+	}
+	_, headers, err = Encrypt(ctx, provider, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers[KeyIDHeader] != "two" {
+		t.Errorf("expected data key to be wrapped with key two, got %s", headers[KeyIDHeader])
+	}
+
+	// Once removed the previous key can no longer be used.
+	provider.RemoveKey("one")
+	_, err = Decrypt(ctx, provider, map[string]string{KeyIDHeader: "one", DataKeyHeader: ""}, ciphertext)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+}
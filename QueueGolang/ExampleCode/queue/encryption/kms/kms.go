@@ -0,0 +1,56 @@
+package kms
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+var GetKMS = getKMS
+
+// KeyProvider is an encryption.KeyProvider that wraps data keys using AWS KMS. Rotating the
+// key ID used for wrapping does not affect unwrapping, as long as the previous KMS keys remain
+// enabled.
+type KeyProvider struct {
+	svc   kmsiface.KMSAPI
+	keyID string
+}
+
+// NewKeyProvider returns a KeyProvider that wraps data keys with the KMS key with the provided
+// ID, ARN or alias.
+func NewKeyProvider(keyID string) *KeyProvider {
+	return &KeyProvider{
+		svc:   GetKMS(),
+		keyID: keyID,
+	}
+}
+
+func (k *KeyProvider) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	res, err := k.svc.EncryptWithContext(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(k.keyID),
+		Plaintext: dataKey,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return aws.StringValue(res.KeyId), res.CiphertextBlob, nil
+}
+
+func (k *KeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	res, err := k.svc.DecryptWithContext(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(keyID),
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Plaintext, nil
+}
+
+func getKMS() kmsiface.KMSAPI {
+	sess := session.New(aws.NewConfig())
+	return kms.New(sess)
+}
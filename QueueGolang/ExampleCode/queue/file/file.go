@@ -0,0 +1,414 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"queue"
+	"queue/internal/lease"
+	"queue/options"
+)
+
+var (
+	defaultBuffer      = 1000
+	defaultVisibility  = 30 * time.Second
+	defaultSegmentSize = int64(64 << 20)
+	errIncorrectScheme = errors.New("incorrect scheme, should be file")
+	fileScheme         = "file"
+
+	// ErrLocked is returned when opening a queue directory that is open in another process.
+	ErrLocked = errors.New("queue directory is open in another process")
+
+	DefaultFileQueueMux = NewFileQueueMux()
+)
+
+func init() {
+	queue.Register(fileScheme, DefaultFileQueueMux)
+}
+
+// FileQueueMux is a durable queue implementation persisting messages to a local directory, for
+// edge deployments and local development where running SQS or NSQ is not practical. The URI is
+// the directory of the queue, i.e. file:///var/lib/queues/orders, or file://queues/orders for a
+// directory relative to the working directory.
+//
+// Published messages are appended to a log of segment files and acknowledged messages are
+// recorded in an ack index, so messages that have not been handled successfully survive the
+// process restarting. Segments are deleted once all their messages have been acknowledged.
+// Received messages are leased for the visibility timeout and redelivered once it expires
+// unless they are deleted, leases are not persisted so in flight messages are redelivered after
+// a restart.
+//
+// QueueHandlers opened for the same directory share its messages and compete for them. The
+// unacknowledged messages of a queue are held in memory, so the directory is locked while the
+// queue is open and opening it in another process, including to purge it, fails with ErrLocked.
+// Count and Peek read the directory without opening it, so they can inspect a queue that is open
+// in another process. Queues are configured by the query parameters of the URI they are first
+// opened with, i.e. file:///var/lib/queues/orders?visibility=30s&segmentSize=67108864&sync=true
+type FileQueueMux struct {
+	mtx    sync.Mutex
+	queues map[string]*fileQueue
+}
+
+// NewFileQueueMux returns a new FileQueueMux.
+func NewFileQueueMux() *FileQueueMux {
+	return &FileQueueMux{queues: make(map[string]*fileQueue)}
+}
+
+// queueConfig configures a file queue.
+type queueConfig struct {
+	// The duration received messages are hidden from other consumers.
+	visibility time.Duration
+	// The size in bytes a segment grows to before a new segment is started.
+	segmentSize int64
+	// Whether writes are synced to disk before a message is published or deleted.
+	sync bool
+}
+
+func parseQueueConfig(u *url.URL) (queueConfig, error) {
+	cfg := queueConfig{visibility: defaultVisibility, segmentSize: defaultSegmentSize, sync: true}
+	q := u.Query()
+	if v := q.Get("visibility"); v != "" {
+		visibility, err := time.ParseDuration(v)
+		if err != nil || visibility < 0 {
+			return cfg, fmt.Errorf("invalid visibility %q, should be a duration", v)
+		}
+		cfg.visibility = visibility
+	}
+	if v := q.Get("segmentSize"); v != "" {
+		segmentSize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || segmentSize < 1 {
+			return cfg, fmt.Errorf("invalid segmentSize %q, should be a positive number of bytes", v)
+		}
+		cfg.segmentSize = segmentSize
+	}
+	if v := q.Get("sync"); v != "" {
+		sync, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid sync %q, should be a boolean", v)
+		}
+		cfg.sync = sync
+	}
+	return cfg, nil
+}
+
+// parseDir returns the absolute directory of a file URI.
+func parseDir(u *url.URL) (string, error) {
+	if u.Scheme != fileScheme {
+		return "", errIncorrectScheme
+	}
+	dir := u.Host + u.Path
+	if dir == "" {
+		return "", fmt.Errorf("invalid file uri %q, should be file:///path/to/queue", u.String())
+	}
+	return filepath.Abs(dir)
+}
+
+// fileQueue holds the messages of a queue directory, it is shared by the QueueHandlers opened
+// for the directory.
+type fileQueue struct {
+	mtx sync.Mutex
+	cfg queueConfig
+	log *messageLog
+	// The number of open QueueHandlers and admin calls, the log is closed once they are all
+	// closed. It is guarded by the FileQueueMux mutex.
+	handlers int
+	closed   bool
+	// The unacknowledged messages, receives are counted since the queue was opened.
+	msgs *lease.Queue[fileMessage]
+}
+
+// fileMessage is a message in the log.
+type fileMessage struct {
+	record
+	segment *segment
+}
+
+func (s *FileQueueMux) Queue(uri string) (*queue.QueueHandler, error) {
+	q, closeQueue, err := s.open(uri)
+	if err != nil {
+		return nil, err
+	}
+	handler := queue.NewQueueHandler(uri, defaultBuffer)
+	handler.Visibility = q.cfg.visibility
+	go func() {
+		<-handler.Done
+		closeQueue()
+	}()
+	pollForIncomingMessages(handler, q)
+	pollForOutgoingMessages(handler, q)
+	return handler, nil
+}
+
+// open returns the queue for the URI, loading it from its directory if it is not already open,
+// and a func to call once it is no longer used. The log is closed once every use is closed.
+func (s *FileQueueMux) open(uri string) (*fileQueue, func(), error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, err := parseDir(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, err := parseQueueConfig(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	q, ok := s.queues[dir]
+	if !ok {
+		log, msgs, err := openLog(dir, cfg.segmentSize, cfg.sync)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening file queue %s: %w", dir, err)
+		}
+		q = &fileQueue{cfg: cfg, log: log, msgs: lease.New[fileMessage]()}
+		for _, msg := range msgs {
+			q.msgs.Add(&lease.Message[fileMessage]{ID: msg.ID, Value: msg})
+		}
+		s.queues[dir] = q
+	}
+	q.handlers++
+	return q, func() { s.closeQueue(dir, q) }, nil
+}
+
+// closeQueue records that a use of the queue was closed, closing the log once no uses remain.
+func (s *FileQueueMux) closeQueue(dir string, q *fileQueue) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	q.handlers--
+	if q.handlers > 0 {
+		return
+	}
+	delete(s.queues, dir)
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.closed = true
+	q.log.close()
+}
+
+// current returns whether the lease is still held, i.e. the queue is open and the message is
+// in flight and has not been received again. It must be called with the mutex held.
+func (q *fileQueue) current(l lease.Lease[fileMessage]) bool {
+	return !q.closed && q.msgs.Current(l)
+}
+
+func pollForIncomingMessages(handler *queue.QueueHandler, q *fileQueue) {
+	go func() {
+		<-handler.Ready
+		handler.Logger().Info("queue consumer starting")
+		for {
+			// Wait until the handler is permitted to consume another message.
+			if err := handler.Wait(); err != nil {
+				break
+			}
+			l, ok := q.receive(handler)
+			if !ok {
+				break
+			}
+			q.handle(handler, l)
+		}
+		handler.Logger().Info("queue consumer shutting down")
+	}()
+}
+
+// receive leases the next available message, waiting until one is available. It returns false
+// if the handler is closed while waiting.
+func (q *fileQueue) receive(handler *queue.QueueHandler) (lease.Lease[fileMessage], bool) {
+	for {
+		q.mtx.Lock()
+		now := time.Now()
+		q.msgs.Expire(now)
+		if msg, ok := q.msgs.Next(); ok {
+			l := q.msgs.Lease(msg, now, q.cfg.visibility)
+			q.mtx.Unlock()
+			return l, true
+		}
+		var expired <-chan time.Time
+		if next := q.msgs.NextExpiry(); !next.IsZero() {
+			expired = time.After(next.Sub(now))
+		}
+		changed := q.msgs.Changed()
+		q.mtx.Unlock()
+		select {
+		case <-handler.Done:
+			return lease.Lease[fileMessage]{}, false
+		case <-changed:
+		case <-expired:
+		}
+	}
+}
+
+func (q *fileQueue) handle(handler *queue.QueueHandler, l lease.Lease[fileMessage]) {
+	msg := l.Msg.Value
+	ctx := options.ContextWithPublishOptions(options.ContextWithMessageDelete(context.Background()), options.PublishOptions{
+		CorrelationID: &msg.CorrelationID,
+		Headers:       msg.Headers,
+	})
+	ctx = options.ContextWithMessageID(ctx, msg.ID)
+	ctx = options.ContextWithSentTime(ctx, msg.Sent)
+	// Release messages received while the handler was closing.
+	select {
+	case <-handler.Done:
+		q.release(l)
+		return
+	default:
+	}
+	err := <-handler.Receive(ctx, msg.Data)
+	// The message should be deleted if there is no error, otherwise, if the handler
+	// has set the message delete value it should use that behaviour.
+	shouldDelete := err == nil
+	if shouldDeleteValue, isDeleteSet := options.GetMessageDeleteValue(ctx); isDeleteSet {
+		shouldDelete = shouldDeleteValue
+	}
+	// Messages that are not deleted are redelivered once their lease expires.
+	if !shouldDelete {
+		return
+	}
+	if _, err := q.delete(l); err != nil {
+		handler.MessageLogger(ctx).WithError(err).Error("deleting message")
+	}
+}
+
+// delete acknowledges a leased message, it returns false if the lease had expired.
+func (q *fileQueue) delete(l lease.Lease[fileMessage]) (bool, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if !q.current(l) {
+		return false, nil
+	}
+	if err := q.log.ack(l.Msg.ID, l.Msg.Value.segment); err != nil {
+		return false, err
+	}
+	return q.msgs.Delete(l), nil
+}
+
+// release makes a leased message available again.
+func (q *fileQueue) release(l lease.Lease[fileMessage]) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if !q.closed {
+		q.msgs.Release(l)
+	}
+}
+
+// publish appends a message to the log and makes it available to consumers.
+func (q *fileQueue) publish(outgoing queue.QueueMessage) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.closed {
+		return queue.ErrClosed
+	}
+	r := record{
+		ID:            uuid.NewString(),
+		CorrelationID: options.CorrelationIDFromContext(outgoing.Context),
+		Headers:       options.HeadersFromContext(outgoing.Context),
+		Data:          outgoing.Data,
+		Sent:          time.Now().UTC(),
+	}
+	seg, err := q.log.append(r)
+	if err != nil {
+		return err
+	}
+	q.msgs.Add(&lease.Message[fileMessage]{ID: r.ID, Value: fileMessage{record: r, segment: seg}})
+	return nil
+}
+
+func pollForOutgoingMessages(handler *queue.QueueHandler, q *fileQueue) {
+	go func() {
+		handler.Logger().Info("queue publisher starting")
+	LOOP:
+		for {
+			select {
+			case <-handler.Done:
+				handler.Logger().Info("queue publisher shutting down")
+				break LOOP
+			case outgoing := <-handler.Outgoing:
+				if err := q.publish(outgoing); err != nil {
+					outgoing.Err <- err
+				}
+				outgoing.Close()
+			}
+		}
+	}()
+}
+
+// Count returns the number of messages available in the queue, excluding messages in flight.
+// Messages leased by another process are included, as leases are not persisted.
+func (s *FileQueueMux) Count(ctx context.Context, uri string) (int, error) {
+	records, err := s.available(uri)
+	return len(records), err
+}
+
+// Purge deletes the messages in the queue, including messages in flight.
+func (s *FileQueueMux) Purge(ctx context.Context, uri string) error {
+	q, closeQueue, err := s.open(uri)
+	if err != nil {
+		return err
+	}
+	defer closeQueue()
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if err := q.log.purge(); err != nil {
+		return err
+	}
+	q.msgs.Purge()
+	return nil
+}
+
+// Peek returns up to max messages available in the queue without leasing them. Messages leased
+// by another process are included, as leases are not persisted.
+func (s *FileQueueMux) Peek(ctx context.Context, uri string, max int) ([]queue.PeekedMessage, error) {
+	records, err := s.available(uri)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []queue.PeekedMessage
+	for _, r := range records {
+		if len(msgs) == max {
+			break
+		}
+		msgs = append(msgs, queue.PeekedMessage{
+			ID:            r.ID,
+			CorrelationID: r.CorrelationID,
+			Headers:       r.Headers,
+			Data:          r.Data,
+		})
+	}
+	return msgs, nil
+}
+
+// available returns the messages available in the queue. If the queue is open it returns its
+// messages that are not in flight, otherwise it reads the directory without opening it.
+func (s *FileQueueMux) available(uri string) ([]record, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := parseDir(u)
+	if err != nil {
+		return nil, err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	q, ok := s.queues[dir]
+	if !ok {
+		return readLog(dir)
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.msgs.Expire(time.Now())
+	records := make([]record, 0, len(q.msgs.Ready()))
+	for _, msg := range q.msgs.Ready() {
+		records = append(records, msg.Value.record)
+	}
+	return records, nil
+}
@@ -0,0 +1,314 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"queue"
+	"queue/options"
+	"queue/queuetest"
+)
+
+func TestFileQueueMux_Conformance(t *testing.T) {
+	dir := t.TempDir()
+	queuetest.RunConformance(t, queuetest.Factory{
+		URI: func(name string) string {
+			return "file://" + filepath.Join(dir, name) + "?visibility=50ms&sync=false"
+		},
+		Queue:  NewFileQueueMux().Queue,
+		Settle: 250 * time.Millisecond,
+	})
+}
+
+func TestParseQueueConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		want    queueConfig
+		wantErr bool
+	}{
+		{
+			"defaults",
+			"file:///var/lib/queues/orders",
+			queueConfig{visibility: 30 * time.Second, segmentSize: 64 << 20, sync: true},
+			false,
+		},
+		{
+			"configured",
+			"file:///var/lib/queues/orders?visibility=1m&segmentSize=1024&sync=false",
+			queueConfig{visibility: time.Minute, segmentSize: 1024},
+			false,
+		},
+		{
+			"invalid visibility",
+			"file:///var/lib/queues/orders?visibility=soon",
+			queueConfig{},
+			true,
+		},
+		{
+			"invalid segment size",
+			"file:///var/lib/queues/orders?segmentSize=0",
+			queueConfig{},
+			true,
+		},
+		{
+			"invalid sync",
+			"file:///var/lib/queues/orders?sync=sometimes",
+			queueConfig{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseQueueConfig(u)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseQueueConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseQueueConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// receive waits for a message to be received.
+func receive(t *testing.T, received <-chan context.Context) context.Context {
+	t.Helper()
+	select {
+	case ctx := <-received:
+		return ctx
+	case <-time.After(time.Second):
+		t.Fatal("expected a message to be received within a second")
+		return nil
+	}
+}
+
+// closeQueue closes the QueueHandler and waits for the mux to close the log of its directory,
+// releasing the lock.
+func closeQueue(t *testing.T, mux *FileQueueMux, q *queue.QueueHandler) {
+	t.Helper()
+	q.Close()
+	queuetest.Eventually(t, func() bool {
+		mux.mtx.Lock()
+		defer mux.mtx.Unlock()
+		return len(mux.queues) == 0
+	})
+}
+
+func TestFileQueueMux_Restart(t *testing.T) {
+	dir := t.TempDir()
+	uri := "file://" + dir + "?visibility=1m"
+	ctx := context.Background()
+	mux := NewFileQueueMux()
+	q, err := mux.Queue(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err := q.Publish([]byte(strconv.Itoa(i)), options.WithCorrelationID("order-"+strconv.Itoa(i)), options.WithHeader("source", "test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.AddHandler(func(ctx context.Context, data []byte) error {
+		// Only the first message is deleted before the restart, the others remain in flight.
+		if options.CorrelationIDFromContext(ctx) == "order-0" {
+			return nil
+		}
+		return errors.New("downstream unavailable")
+	})
+	q.Start()
+	queuetest.Eventually(t, func() bool {
+		acks, _ := os.ReadFile(filepath.Join(dir, ackIndexName))
+		return len(acks) > 0
+	})
+	closeQueue(t, mux, q)
+
+	// A new FileQueueMux reloads the messages that were not deleted from the directory, in flight
+	// messages are available again as their leases are not persisted.
+	mux = NewFileQueueMux()
+	if n, err := mux.Count(ctx, uri); err != nil || n != 2 {
+		t.Fatalf("expected 2 messages to survive the restart, got %d (%v)", n, err)
+	}
+	q, err = mux.Queue(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	received := make(chan context.Context, 10)
+	q.AddHandler(func(ctx context.Context, data []byte) error {
+		received <- ctx
+		return nil
+	})
+	q.Start()
+	for _, id := range []string{"order-1", "order-2"} {
+		ctx := receive(t, received)
+		if options.CorrelationIDFromContext(ctx) != id || options.HeaderFromContext(ctx, "source") != "test" {
+			t.Errorf("expected %s with its metadata, got %s %v", id, options.CorrelationIDFromContext(ctx), options.HeadersFromContext(ctx))
+		}
+		if options.SentTimeFromContext(ctx).IsZero() {
+			t.Error("expected the sent time to be preserved")
+		}
+	}
+}
+
+func TestFileQueueMux_Visibility(t *testing.T) {
+	mux := NewFileQueueMux()
+	q, err := mux.Queue("file://" + t.TempDir() + "?visibility=100ms&sync=false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Visibility != 100*time.Millisecond {
+		t.Errorf("expected handler visibility of 100ms, got %s", q.Visibility)
+	}
+	received := make(chan time.Time, 10)
+	q.AddHandler(func(ctx context.Context, data []byte) error {
+		received <- time.Now()
+		options.SetMessageDelete(ctx, false)
+		return nil
+	})
+	if err := q.Publish([]byte("retained")); err != nil {
+		t.Fatal(err)
+	}
+	q.Start()
+	first := <-received
+	second := <-received
+	if d := second.Sub(first); d < 100*time.Millisecond {
+		t.Errorf("expected the message to be redelivered after the visibility timeout, got %s", d)
+	}
+}
+
+// segments returns the names of the segment files in the directory.
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestFileQueueMux_Compaction(t *testing.T) {
+	dir := t.TempDir()
+	// Every message is written to its own segment.
+	uri := "file://" + dir + "?segmentSize=1"
+	ctx := context.Background()
+	mux := NewFileQueueMux()
+	q, err := mux.Queue(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < 5; i++ {
+		if err := q.Publish([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(segments(t, dir)); n != 5 {
+		t.Fatalf("expected 5 segments, got %d", n)
+	}
+	msgs, err := mux.Peek(ctx, uri, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 5 || string(msgs[0].Data) != "0" || string(msgs[4].Data) != "4" {
+		t.Errorf("expected the messages in the order they were published, got %+v", msgs)
+	}
+
+	handled := make(chan struct{}, 10)
+	q.AddHandler(func(ctx context.Context, data []byte) error {
+		handled <- struct{}{}
+		return nil
+	})
+	q.Start()
+	for i := 0; i < 5; i++ {
+		<-handled
+	}
+	// Segments are deleted once their messages are acknowledged, other than the active segment,
+	// and the ack index only holds the acknowledgement of the message in the active segment.
+	queuetest.Eventually(t, func() bool {
+		acks, _ := os.ReadFile(filepath.Join(dir, ackIndexName))
+		return len(segments(t, dir)) == 1 && strings.Count(string(acks), "\n") == 1
+	})
+}
+
+func TestFileQueueMux_Purge(t *testing.T) {
+	dir := t.TempDir()
+	uri := "file://" + dir
+	ctx := context.Background()
+	mux := NewFileQueueMux()
+	q, err := mux.Queue(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, payload := range []string{"a", "b", "c"} {
+		if err := q.Publish([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mux.Purge(ctx, uri); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := mux.Count(ctx, uri); n != 0 {
+		t.Errorf("expected purged queue to be empty, got count %d", n)
+	}
+	if n := len(segments(t, dir)); n != 1 {
+		t.Errorf("expected the purged segments to be deleted, got %d segments", n)
+	}
+	if err := q.Publish([]byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := mux.Count(ctx, uri); n != 1 {
+		t.Errorf("expected the message published after the purge, got count %d", n)
+	}
+}
+
+func TestOpenLog_IncompleteRecord(t *testing.T) {
+	dir := t.TempDir()
+	mux := NewFileQueueMux()
+	q, err := mux.Queue("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Publish([]byte("complete")); err != nil {
+		t.Fatal(err)
+	}
+	closeQueue(t, mux, q)
+	// Simulate a crash while a record was being appended.
+	path := segmentPath(dir, 1)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"id":"incomplete","da`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l, msgs, err := openLog(dir, defaultSegmentSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+	if len(msgs) != 1 || string(msgs[0].Data) != "complete" {
+		t.Errorf("expected only the complete record, got %+v", msgs)
+	}
+	if _, _, err := readSegment(path, rejectTail); err != nil {
+		t.Errorf("expected the incomplete record to be truncated, got %s", err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package file
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockDir creates the lock file of the directory without locking it, as flock is not available
+// on this platform, so a directory must only be opened by one process at a time.
+func lockDir(dir string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir, lockName), os.O_CREATE|os.O_RDWR, 0o644)
+}
@@ -0,0 +1,93 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package file
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenLog_Locked(t *testing.T) {
+	dir := t.TempDir()
+	l, _, err := openLog(dir, defaultSegmentSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openLog(dir, defaultSegmentSize, false); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked opening a directory that is already open, got %v", err)
+	}
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+	l, _, err = openLog(dir, defaultSegmentSize, false)
+	if err != nil {
+		t.Fatalf("expected the directory to be unlocked once closed, got %v", err)
+	}
+	l.close()
+}
+
+func TestFileQueueMux_Locked(t *testing.T) {
+	dir := t.TempDir()
+	uri := "file://" + dir
+	ctx := context.Background()
+	q, err := NewFileQueueMux().Queue(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, payload := range []string{"a", "b"} {
+		if err := q.Publish([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Simulate a record being appended by the process that has the queue open.
+	path := segmentPath(dir, 1)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"id":"incomplete","da`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process, emulated by another FileQueueMux, can not open or purge the queue.
+	other := NewFileQueueMux()
+	if _, err := other.Queue(uri); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked opening a queue open in another process, got %v", err)
+	}
+	if err := other.Purge(ctx, uri); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked purging a queue open in another process, got %v", err)
+	}
+	// It can inspect the queue, without modifying its directory.
+	if n, err := other.Count(ctx, uri); err != nil || n != 2 {
+		t.Errorf("expected a count of 2, got %d (%v)", n, err)
+	}
+	msgs, err := other.Peek(ctx, uri, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || string(msgs[0].Data) != "a" || string(msgs[1].Data) != "b" {
+		t.Errorf("expected the complete records, got %+v", msgs)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Error("expected the segment to not be repaired by Count and Peek")
+	}
+	if n, err := other.Count(ctx, "file://"+filepath.Join(dir, "missing")); err != nil || n != 0 {
+		t.Errorf("expected a count of 0 for a missing directory, got %d (%v)", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Error("expected Count to not create the directory")
+	}
+}
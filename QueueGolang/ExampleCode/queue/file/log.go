@@ -0,0 +1,417 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	segmentExt   = ".seg"
+	ackIndexName = "acks.idx"
+	lockName     = "queue.lock"
+)
+
+// record is a message as it is written to a segment, one JSON document per line.
+type record struct {
+	ID            string            `json:"id"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Data          []byte            `json:"data"`
+	Sent          time.Time         `json:"sent"`
+}
+
+// segment is a file of the append-only message log.
+type segment struct {
+	seq  int64
+	path string
+	size int64
+	// The number of messages in the segment that have not been acknowledged, the segment is
+	// deleted by compaction once it is zero and the segment is no longer being appended to.
+	pending int
+}
+
+// messageLog is the append-only segment log of a queue directory and its ack index, the IDs of
+// the messages that have been acknowledged.
+type messageLog struct {
+	dir         string
+	segmentSize int64
+	sync        bool
+
+	segments []*segment
+	active   *os.File
+	acks     *os.File
+	// The lock file held while the log is open.
+	lock *os.File
+	// The acknowledged messages in the retained segments.
+	acked map[string]*segment
+}
+
+func segmentPath(dir string, seq int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// openLog opens the log in the directory, creating it if it does not exist, and returns the
+// messages that have not been acknowledged in the order they were appended. Records left
+// incomplete at the end of the log by a crash are truncated. The directory is locked until the
+// log is closed, it returns ErrLocked if it is open in another process.
+func openLog(dir string, segmentSize int64, sync bool) (*messageLog, []fileMessage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, msgs, err := loadLog(dir, segmentSize, sync)
+	if err != nil {
+		lock.Close()
+		return nil, nil, err
+	}
+	l.lock = lock
+	return l, msgs, nil
+}
+
+// loadLog reads and repairs the log in the locked directory.
+func loadLog(dir string, segmentSize int64, sync bool) (*messageLog, []fileMessage, error) {
+	l := &messageLog{
+		dir:         dir,
+		segmentSize: segmentSize,
+		sync:        sync,
+		acked:       make(map[string]*segment),
+	}
+	acked, err := readAckIndex(filepath.Join(dir, ackIndexName), truncateTail)
+	if err != nil {
+		return nil, nil, err
+	}
+	seqs, err := segmentSeqs(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var msgs []fileMessage
+	for i, seq := range seqs {
+		seg := &segment{seq: seq, path: segmentPath(dir, seq)}
+		// Only the last segment is repaired, an incomplete record in an earlier segment means
+		// the log is corrupt.
+		tail := rejectTail
+		if i == len(seqs)-1 {
+			tail = truncateTail
+		}
+		records, size, err := readSegment(seg.path, tail)
+		if err != nil {
+			return nil, nil, err
+		}
+		seg.size = size
+		for _, r := range records {
+			if acked[r.ID] {
+				l.acked[r.ID] = seg
+				continue
+			}
+			seg.pending++
+			msgs = append(msgs, fileMessage{record: r, segment: seg})
+		}
+		l.segments = append(l.segments, seg)
+	}
+	if len(l.segments) == 0 {
+		l.segments = append(l.segments, &segment{seq: 1, path: segmentPath(dir, 1)})
+	}
+	active := l.segments[len(l.segments)-1]
+	l.active, err = os.OpenFile(active.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Compaction rewrites the ack index, dropping the acknowledgements of deleted segments.
+	if err := l.compact(); err != nil {
+		l.close()
+		return nil, nil, err
+	}
+	return l, msgs, nil
+}
+
+// readLog returns the records that have not been acknowledged in the log in the directory, in
+// the order they were appended, without opening it. The log is not repaired or compacted, so it
+// can be read while it is open in another process, and an incomplete record at the end of the
+// log is skipped as it may still be being appended.
+func readLog(dir string) ([]record, error) {
+	// The ack index is read first, as compaction deletes segments before rewriting it.
+	acked, err := readAckIndex(filepath.Join(dir, ackIndexName), skipTail)
+	if err != nil {
+		return nil, err
+	}
+	seqs, err := segmentSeqs(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pending []record
+	for i, seq := range seqs {
+		tail := rejectTail
+		if i == len(seqs)-1 {
+			tail = skipTail
+		}
+		records, _, err := readSegment(segmentPath(dir, seq), tail)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if !acked[r.ID] {
+				pending = append(pending, r)
+			}
+		}
+	}
+	return pending, nil
+}
+
+// segmentSeqs returns the sequence numbers of the segments in the directory in order.
+func segmentSeqs(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// tailMode is how readLines handles a final line without a newline, which is the result of an
+// interrupted write or of a write in progress.
+type tailMode int
+
+const (
+	// rejectTail returns an incomplete final line as an error.
+	rejectTail tailMode = iota
+	// truncateTail truncates the file to remove an incomplete final line.
+	truncateTail
+	// skipTail ignores an incomplete final line without modifying the file.
+	skipTail
+)
+
+// readLines returns the complete lines of the file and the size of the file they were read
+// from, handling an incomplete final line according to the tail mode.
+func readLines(path string, tail tailMode) ([][]byte, int64, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	size := int64(bytes.LastIndexByte(data, '\n') + 1)
+	if size != int64(len(data)) {
+		switch tail {
+		case rejectTail:
+			return nil, 0, fmt.Errorf("incomplete record at the end of %s", path)
+		case truncateTail:
+			if err := os.Truncate(path, size); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	var lines [][]byte
+	s := bufio.NewScanner(bytes.NewReader(data[:size]))
+	s.Buffer(nil, len(data)+1)
+	for s.Scan() {
+		lines = append(lines, s.Bytes())
+	}
+	return lines, size, s.Err()
+}
+
+// readSegment returns the records of a segment and its size.
+func readSegment(path string, tail tailMode) ([]record, int64, error) {
+	lines, size, err := readLines(path, tail)
+	if err != nil {
+		return nil, 0, err
+	}
+	records := make([]record, 0, len(lines))
+	for n, line := range lines {
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return nil, 0, fmt.Errorf("reading record %d of %s: %w", n+1, path, err)
+		}
+		records = append(records, r)
+	}
+	return records, size, nil
+}
+
+// readAckIndex returns the IDs of the acknowledged messages in the ack index, one per line.
+func readAckIndex(path string, tail tailMode) (map[string]bool, error) {
+	lines, _, err := readLines(path, tail)
+	if err != nil {
+		return nil, err
+	}
+	acked := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		acked[string(line)] = true
+	}
+	return acked, nil
+}
+
+// write writes the line to the file, syncing it to disk if configured.
+func (l *messageLog) write(f *os.File, line []byte) error {
+	if _, err := f.Write(line); err != nil {
+		return err
+	}
+	if l.sync {
+		return f.Sync()
+	}
+	return nil
+}
+
+// append appends the record to the active segment, starting a new segment once the active
+// segment reaches the segment size. It returns the segment the record was appended to.
+func (l *messageLog) append(r record) (*segment, error) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	seg := l.segments[len(l.segments)-1]
+	if seg.size > 0 && seg.size+int64(len(line))+1 > l.segmentSize {
+		if seg, err = l.roll(); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.write(l.active, append(line, '\n')); err != nil {
+		return nil, err
+	}
+	seg.size += int64(len(line)) + 1
+	seg.pending++
+	return seg, nil
+}
+
+// roll starts a new active segment, compacting the previous segment if all its messages have
+// been acknowledged.
+func (l *messageLog) roll() (*segment, error) {
+	prev := l.segments[len(l.segments)-1]
+	seg := &segment{seq: prev.seq + 1, path: segmentPath(l.dir, prev.seq+1)}
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.active.Close(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.active = f
+	l.segments = append(l.segments, seg)
+	if prev.pending == 0 {
+		if err := l.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return seg, nil
+}
+
+// ack records the message as acknowledged in the ack index, compacting its segment once all
+// its messages have been acknowledged.
+func (l *messageLog) ack(id string, seg *segment) error {
+	if l.acks == nil {
+		f, err := os.OpenFile(filepath.Join(l.dir, ackIndexName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		l.acks = f
+	}
+	if err := l.write(l.acks, []byte(id+"\n")); err != nil {
+		return err
+	}
+	l.acked[id] = seg
+	seg.pending--
+	if seg.pending == 0 && seg != l.segments[len(l.segments)-1] {
+		return l.compact()
+	}
+	return nil
+}
+
+// compact deletes the segments, other than the active segment, whose messages have all been
+// acknowledged and rewrites the ack index without their acknowledgements. Segments are deleted
+// before the ack index is replaced, so a crash only leaves acknowledgements of deleted
+// messages in the index.
+func (l *messageLog) compact() error {
+	active := l.segments[len(l.segments)-1]
+	retained := l.segments[:0]
+	deleted := make(map[*segment]bool)
+	for _, seg := range l.segments {
+		if seg == active || seg.pending > 0 {
+			retained = append(retained, seg)
+			continue
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		deleted[seg] = true
+	}
+	l.segments = retained
+	var buf bytes.Buffer
+	for id, seg := range l.acked {
+		if deleted[seg] {
+			delete(l.acked, id)
+			continue
+		}
+		buf.WriteString(id + "\n")
+	}
+	return l.rewriteAckIndex(buf.Bytes())
+}
+
+// rewriteAckIndex atomically replaces the ack index.
+func (l *messageLog) rewriteAckIndex(data []byte) error {
+	path := filepath.Join(l.dir, ackIndexName)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := l.write(f, data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if l.acks != nil {
+		l.acks.Close()
+		l.acks = nil
+	}
+	return os.Rename(tmp, path)
+}
+
+// purge deletes every message in the log, starting a new empty segment.
+func (l *messageLog) purge() error {
+	for _, seg := range l.segments {
+		seg.pending = 0
+	}
+	// Rolling compacts the previous segment as it no longer has pending messages.
+	_, err := l.roll()
+	return err
+}
+
+func (l *messageLog) close() error {
+	if l.acks != nil {
+		l.acks.Close()
+	}
+	err := l.active.Close()
+	// Closing the lock file releases the lock on the directory.
+	if l.lock != nil {
+		l.lock.Close()
+	}
+	return err
+}
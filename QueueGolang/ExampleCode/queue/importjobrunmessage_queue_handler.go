@@ -1,28 +1,22 @@
+// Code generated by queuegen. DO NOT EDIT.
+
 package queue
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"sync"
 
 	"queue/options"
 )
 
+func init() {
+	RegisterMessageType[ImportJobRunMessage]()
+}
+
 type ImportJobRunMessageHandler func(ctx context.Context, r ImportJobRunMessage) error
 
 func (q *QueueHandler) AddImportJobRunMessageHandler(handler ImportJobRunMessageHandler) *QueueHandler {
-	return q.AddHandler(func(ctx context.Context, data []byte) error {
-		var msg ImportJobRunMessage
-		err := json.Unmarshal(data, &msg)
-		if err != nil {
-			return fmt.Errorf("parsing message json: %w", err)
-		}
-		err = handler(ctx, msg)
-		if err != nil {
-			return fmt.Errorf("handling message: %w", err)
-		}
-		return nil
-	})
+	return Handle[ImportJobRunMessage](q, handler)
 }
 
 type ImportJobRunMessagePublisher interface {
@@ -30,13 +24,36 @@ type ImportJobRunMessagePublisher interface {
 }
 
 func (q *QueueHandler) PublishImportJobRunMessage(m ImportJobRunMessage, opts ...options.PublishOptions) error {
-	byt, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("marshaling message into json: %w", err)
-	}
-	err = q.Publish(byt, opts...)
-	if err != nil {
-		return fmt.Errorf("publishing to queue: %w", err)
+	return NewPublisher[ImportJobRunMessage](q).Publish(m, opts...)
+}
+
+// NewImportJobRunMessagePublisher returns the QueueHandler as a ImportJobRunMessagePublisher, recording ImportJobRunMessage as a type it publishes.
+func NewImportJobRunMessagePublisher(q *QueueHandler) ImportJobRunMessagePublisher {
+	NewPublisher[ImportJobRunMessage](q)
+	return q
+}
+
+// FakeImportJobRunMessagePublisher is a ImportJobRunMessagePublisher that records published messages, for use in tests.
+type FakeImportJobRunMessagePublisher struct {
+	mtx      sync.Mutex
+	messages []ImportJobRunMessage
+	// Err is returned by PublishImportJobRunMessage when set, in which case the message is not recorded.
+	Err error
+}
+
+func (f *FakeImportJobRunMessagePublisher) PublishImportJobRunMessage(m ImportJobRunMessage, opts ...options.PublishOptions) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.Err != nil {
+		return f.Err
 	}
+	f.messages = append(f.messages, m)
 	return nil
 }
+
+// Published returns the messages that have been published.
+func (f *FakeImportJobRunMessagePublisher) Published() []ImportJobRunMessage {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]ImportJobRunMessage(nil), f.messages...)
+}
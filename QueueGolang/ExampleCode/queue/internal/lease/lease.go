@@ -0,0 +1,151 @@
+// Package lease implements the visibility timeout bookkeeping of queue implementations that
+// lease messages to consumers themselves, rather than relying on a broker, i.e. mem and file.
+package lease
+
+import (
+	"sort"
+	"time"
+)
+
+// Message is a message held by a Queue.
+type Message[T any] struct {
+	ID    string
+	Value T
+	// The number of times the message has been received.
+	Receives int
+	// When the lease of an in flight message expires.
+	VisibleAt time.Time
+}
+
+// Lease is a message received by a consumer. It is stale if the message has since been
+// received again.
+type Lease[T any] struct {
+	Msg      *Message[T]
+	Receives int
+}
+
+// Queue holds the messages available to consumers and those leased to them. It is not safe for
+// concurrent use, callers guard it with their own mutex.
+type Queue[T any] struct {
+	// Messages available to consumers, in the order they became available.
+	ready []*Message[T]
+	// Messages leased to consumers, by message ID.
+	inflight map[string]*Message[T]
+	// Closed and replaced whenever messages become available.
+	changed chan struct{}
+}
+
+// New returns an empty Queue.
+func New[T any]() *Queue[T] {
+	return &Queue[T]{
+		inflight: make(map[string]*Message[T]),
+		changed:  make(chan struct{}),
+	}
+}
+
+// Add makes messages available to consumers.
+func (q *Queue[T]) Add(msgs ...*Message[T]) {
+	q.ready = append(q.ready, msgs...)
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// Ready returns the messages available to consumers, in the order they became available. The
+// slice must not be modified.
+func (q *Queue[T]) Ready() []*Message[T] {
+	return q.ready
+}
+
+// Take removes and returns the messages available to consumers.
+func (q *Queue[T]) Take() []*Message[T] {
+	ready := q.ready
+	q.ready = nil
+	return ready
+}
+
+// Next removes and returns the next message available to consumers, it returns false if there
+// are none. The message must be leased or added again.
+func (q *Queue[T]) Next() (*Message[T], bool) {
+	if len(q.ready) == 0 {
+		return nil, false
+	}
+	msg := q.ready[0]
+	q.ready = q.ready[1:]
+	return msg, true
+}
+
+// Lease leases a message returned by Next for the visibility timeout, counting the receive.
+func (q *Queue[T]) Lease(msg *Message[T], now time.Time, visibility time.Duration) Lease[T] {
+	msg.Receives++
+	msg.VisibleAt = now.Add(visibility)
+	q.inflight[msg.ID] = msg
+	return Lease[T]{Msg: msg, Receives: msg.Receives}
+}
+
+// Expire makes in flight messages whose lease has expired available again.
+func (q *Queue[T]) Expire(now time.Time) {
+	var expired []*Message[T]
+	for id, msg := range q.inflight {
+		if !msg.VisibleAt.After(now) {
+			delete(q.inflight, id)
+			expired = append(expired, msg)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	// Messages become available in the order their leases expired.
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].VisibleAt.Before(expired[j].VisibleAt)
+	})
+	q.Add(expired...)
+}
+
+// NextExpiry returns when the next lease expires, or the zero time if there are no in flight
+// messages.
+func (q *Queue[T]) NextExpiry() time.Time {
+	var next time.Time
+	for _, msg := range q.inflight {
+		if next.IsZero() || msg.VisibleAt.Before(next) {
+			next = msg.VisibleAt
+		}
+	}
+	return next
+}
+
+// Changed returns a channel that is closed when messages next become available.
+func (q *Queue[T]) Changed() <-chan struct{} {
+	return q.changed
+}
+
+// Current returns whether the lease is still held, i.e. the message is in flight and has not
+// been received again.
+func (q *Queue[T]) Current(l Lease[T]) bool {
+	return q.inflight[l.Msg.ID] == l.Msg && l.Msg.Receives == l.Receives
+}
+
+// Delete removes a leased message, it returns false if the lease had expired.
+func (q *Queue[T]) Delete(l Lease[T]) bool {
+	if !q.Current(l) {
+		return false
+	}
+	delete(q.inflight, l.Msg.ID)
+	return true
+}
+
+// Release makes a leased message available again without counting the receive, it returns
+// false if the lease had expired.
+func (q *Queue[T]) Release(l Lease[T]) bool {
+	if !q.Delete(l) {
+		return false
+	}
+	l.Msg.Receives--
+	q.Add(l.Msg)
+	return true
+}
+
+// Purge removes all messages, including messages in flight.
+func (q *Queue[T]) Purge() {
+	q.ready = nil
+	q.inflight = make(map[string]*Message[T])
+}
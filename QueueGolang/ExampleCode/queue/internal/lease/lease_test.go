@@ -0,0 +1,90 @@
+package lease
+
+import (
+	"testing"
+	"time"
+)
+
+// ids returns the IDs of the messages available to consumers.
+func ids(q *Queue[int]) []string {
+	var ids []string
+	for _, msg := range q.Ready() {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+func TestQueue_Expire(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	q := New[int]()
+	q.Add(&Message[int]{ID: "a", Value: 1}, &Message[int]{ID: "b", Value: 2})
+	a, _ := q.Next()
+	b, _ := q.Next()
+	la := q.Lease(a, start, time.Minute)
+	q.Lease(b, start, 30*time.Second)
+	if _, ok := q.Next(); ok {
+		t.Fatal("expected no messages to be available while leased")
+	}
+	if next := q.NextExpiry(); !next.Equal(start.Add(30 * time.Second)) {
+		t.Errorf("NextExpiry() = %s, want %s", next, start.Add(30*time.Second))
+	}
+	changed := q.Changed()
+	q.Expire(start.Add(time.Minute))
+	select {
+	case <-changed:
+	default:
+		t.Error("expected Changed() to be closed once leases expired")
+	}
+	// Messages become available in the order their leases expired.
+	if got := ids(q); len(got) != 2 || got[0] != "b" || got[1] != "a" {
+		t.Errorf("Ready() = %v, want [b a]", got)
+	}
+	if !q.NextExpiry().IsZero() {
+		t.Error("expected no leases to expire once all messages are available")
+	}
+	// The expired lease is stale once the message is received again.
+	q.Next()
+	a, _ = q.Next()
+	la2 := q.Lease(a, start.Add(time.Minute), time.Minute)
+	if a.Receives != 2 {
+		t.Errorf("Receives = %d, want 2", a.Receives)
+	}
+	if q.Current(la) || q.Delete(la) || q.Release(la) {
+		t.Error("expected the expired lease to no longer be held")
+	}
+	if !q.Current(la2) {
+		t.Error("expected the lease to be held")
+	}
+}
+
+func TestQueue_DeleteAndRelease(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	q := New[int]()
+	q.Add(&Message[int]{ID: "a"}, &Message[int]{ID: "b"})
+	a, _ := q.Next()
+	b, _ := q.Next()
+	la := q.Lease(a, now, time.Minute)
+	lb := q.Lease(b, now, time.Minute)
+	if !q.Delete(la) {
+		t.Error("expected the held lease to be deleted")
+	}
+	if q.Delete(la) {
+		t.Error("expected a deleted message to not be deleted again")
+	}
+	if !q.Release(lb) {
+		t.Error("expected the held lease to be released")
+	}
+	// Releasing a message does not count the receive.
+	if got := ids(q); len(got) != 1 || got[0] != "b" || b.Receives != 0 {
+		t.Errorf("Ready() = %v with %d receives, want [b] with 0 receives", got, b.Receives)
+	}
+	q.Expire(now.Add(time.Hour))
+	if got := ids(q); len(got) != 1 {
+		t.Errorf("Ready() = %v, want [b] as deleted messages do not expire", got)
+	}
+	q.Lease(b, now, time.Minute)
+	q.Purge()
+	if len(q.Ready()) != 0 || !q.NextExpiry().IsZero() {
+		t.Error("expected no messages once purged")
+	}
+}
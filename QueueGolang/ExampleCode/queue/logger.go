@@ -0,0 +1,129 @@
+package queue
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+
+	"queue/options"
+)
+
+const (
+	// LogFieldURI is the log field holding the URI of the queue.
+	LogFieldURI = "uri"
+	// LogFieldCorrelationID is the log field holding the correlation ID of a message.
+	LogFieldCorrelationID = "correlation_id"
+	// LogFieldMessageID is the log field holding the ID assigned to a message by the underlying queue.
+	LogFieldMessageID = "message_id"
+)
+
+var (
+	defaultLoggerMtx sync.RWMutex
+	defaultLogger    Logger = NewApexLogger(log.Log)
+	// Loggers used by the QueueHandlers of the QueueMux registered with a scheme, by scheme.
+	muxLoggers = make(map[string]Logger)
+)
+
+// Logger is a structured logger used by a QueueHandler and the underlying queue
+// implementations. Its methods mirror those of apex/log so that any structured
+// logger (slog, zap etc.) can be adapted to it.
+type Logger interface {
+	// WithField returns a Logger that includes the provided field on every log line.
+	WithField(key string, value interface{}) Logger
+	// WithError returns a Logger that includes the provided error on every log line.
+	WithError(err error) Logger
+	Debug(msg string)
+	Info(msg string)
+	Warn(msg string)
+	Error(msg string)
+}
+
+// SetDefaultLogger sets the Logger used by QueueHandlers created after the call.
+// By default the global apex/log logger is used.
+func SetDefaultLogger(l Logger) {
+	defaultLoggerMtx.Lock()
+	defer defaultLoggerMtx.Unlock()
+	defaultLogger = l
+}
+
+// DefaultLogger returns the Logger used by newly created QueueHandlers.
+func DefaultLogger() Logger {
+	defaultLoggerMtx.RLock()
+	defer defaultLoggerMtx.RUnlock()
+	return defaultLogger
+}
+
+// SetMuxLogger sets the Logger used by QueueHandlers created after the call by the QueueMux
+// registered with the scheme, in place of the default Logger. Unlike SetLogger, the Logger is
+// used from the moment the QueueHandler is created, including by the goroutines the QueueMux
+// starts before Queue returns. A nil Logger restores the default Logger.
+func SetMuxLogger(scheme string, l Logger) {
+	defaultLoggerMtx.Lock()
+	defer defaultLoggerMtx.Unlock()
+	if l == nil {
+		delete(muxLoggers, scheme)
+		return
+	}
+	muxLoggers[scheme] = l
+}
+
+// uriLogger returns the Logger for a QueueHandler created for the URI.
+func uriLogger(uri string) Logger {
+	defaultLoggerMtx.RLock()
+	defer defaultLoggerMtx.RUnlock()
+	scheme, _, _ := strings.Cut(uri, "://")
+	if l, ok := muxLoggers[scheme]; ok {
+		return l
+	}
+	return defaultLogger
+}
+
+type loggerKey struct{}
+
+// ContextWithLogger returns a copy of the parent context carrying the provided Logger.
+func ContextWithLogger(parent context.Context, l Logger) context.Context {
+	return context.WithValue(parent, loggerKey{}, l)
+}
+
+// LoggerFromContext returns the Logger carried by the context. Handlers receive a
+// context carrying a per-message Logger which is enriched with the queue URI,
+// correlation ID and message ID. If the context carries no Logger the default
+// Logger is returned.
+func LoggerFromContext(ctx context.Context) Logger {
+	if l, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+	return DefaultLogger()
+}
+
+// MessageLogger returns the queue's Logger for a single message, enriched with the
+// correlation ID and message ID carried by the message context.
+func (q *QueueHandler) MessageLogger(ctx context.Context) Logger {
+	l := q.Logger()
+	if correlationID := options.CorrelationIDFromContext(ctx); correlationID != "" {
+		l = l.WithField(LogFieldCorrelationID, correlationID)
+	}
+	if messageID := options.MessageIDFromContext(ctx); messageID != "" {
+		l = l.WithField(LogFieldMessageID, messageID)
+	}
+	return l
+}
+
+// NewApexLogger returns a Logger that writes to the provided apex/log logger.
+func NewApexLogger(l log.Interface) Logger {
+	return apexLogger{l}
+}
+
+type apexLogger struct {
+	log.Interface
+}
+
+func (a apexLogger) WithField(key string, value interface{}) Logger {
+	return apexLogger{a.Interface.WithField(key, value)}
+}
+
+func (a apexLogger) WithError(err error) Logger {
+	return apexLogger{a.Interface.WithError(err)}
+}
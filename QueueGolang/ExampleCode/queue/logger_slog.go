@@ -0,0 +1,39 @@
+//go:build go1.21
+// +build go1.21
+
+package queue
+
+import "log/slog"
+
+// NewSlogLogger returns a Logger that writes to the provided slog logger.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) WithField(key string, value interface{}) Logger {
+	return slogLogger{s.l.With(key, value)}
+}
+
+func (s slogLogger) WithError(err error) Logger {
+	return slogLogger{s.l.With("error", err)}
+}
+
+func (s slogLogger) Debug(msg string) {
+	s.l.Debug(msg)
+}
+
+func (s slogLogger) Info(msg string) {
+	s.l.Info(msg)
+}
+
+func (s slogLogger) Warn(msg string) {
+	s.l.Warn(msg)
+}
+
+func (s slogLogger) Error(msg string) {
+	s.l.Error(msg)
+}
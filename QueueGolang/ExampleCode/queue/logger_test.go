@@ -0,0 +1,87 @@
+package queue
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"queue/options"
+)
+
+type testLogger struct {
+	fields map[string]interface{}
+}
+
+func (t testLogger) WithField(key string, value interface{}) Logger {
+	fields := map[string]interface{}{key: value}
+	for k, v := range t.fields {
+		fields[k] = v
+	}
+	return testLogger{fields}
+}
+
+func (t testLogger) WithError(err error) Logger {
+	return t.WithField("error", err)
+}
+
+func (t testLogger) Debug(msg string) {}
+func (t testLogger) Info(msg string)  {}
+func (t testLogger) Warn(msg string)  {}
+func (t testLogger) Error(msg string) {}
+
+func TestLoggerFromContext(t *testing.T) {
+	var got Logger
+	q := NewQueueHandler("test://logger", 1).
+		SetLogger(testLogger{}).
+		AddHandler(func(ctx context.Context, data []byte) error {
+			got = LoggerFromContext(ctx)
+			return nil
+		})
+	q.Start()
+	defer q.Close()
+
+	ctx := options.ContextWithPublishOptions(context.Background(), options.WithCorrelationID("correlation"))
+	ctx = options.ContextWithMessageID(ctx, "message")
+	if err := <-q.Receive(ctx, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		LogFieldURI:           "test://logger",
+		LogFieldCorrelationID: "correlation",
+		LogFieldMessageID:     "message",
+	}
+	if l, ok := got.(testLogger); !ok || !reflect.DeepEqual(l.fields, expected) {
+		t.Errorf("expected logger with fields %v, got %v", expected, got)
+	}
+}
+
+func TestSetMuxLogger(t *testing.T) {
+	SetMuxLogger("muxlogger", testLogger{fields: map[string]interface{}{"mux": true}})
+	defer SetMuxLogger("muxlogger", nil)
+
+	q := NewQueueHandler("muxlogger://queue", 1)
+	expected := map[string]interface{}{"mux": true, LogFieldURI: "muxlogger://queue"}
+	if l, ok := q.Logger().(testLogger); !ok || !reflect.DeepEqual(l.fields, expected) {
+		t.Errorf("expected the mux logger with fields %v, got %v", expected, q.Logger())
+	}
+	if _, ok := NewQueueHandler("other://queue", 1).Logger().(testLogger); ok {
+		t.Error("expected queues of other schemes to use the default logger")
+	}
+}
+
+func TestSetLogger_Concurrent(t *testing.T) {
+	q := NewQueueHandler("test://logger", 1)
+	done := make(chan struct{})
+	// Queue implementations log from their own goroutines while the logger is set.
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			q.Logger().Info("polling")
+		}
+	}()
+	q.SetLogger(testLogger{})
+	<-done
+	if _, ok := q.Logger().(testLogger); !ok {
+		t.Errorf("expected the logger to be set, got %v", q.Logger())
+	}
+}
@@ -1,28 +1,22 @@
+// Code generated by queuegen. DO NOT EDIT.
+
 package queue
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"sync"
 
 	"queue/options"
 )
 
+func init() {
+	RegisterMessageType[LumenScriptJobMessage]()
+}
+
 type LumenScriptJobMessageHandler func(ctx context.Context, r LumenScriptJobMessage) error
 
 func (q *QueueHandler) AddLumenScriptJobMessageHandler(handler LumenScriptJobMessageHandler) *QueueHandler {
-	return q.AddHandler(func(ctx context.Context, data []byte) error {
-		var msg LumenScriptJobMessage
-		err := json.Unmarshal(data, &msg)
-		if err != nil {
-			return fmt.Errorf("parsing message json: %w", err)
-		}
-		err = handler(ctx, msg)
-		if err != nil {
-			return fmt.Errorf("handling message: %w", err)
-		}
-		return nil
-	})
+	return Handle[LumenScriptJobMessage](q, handler)
 }
 
 type LumenScriptJobMessagePublisher interface {
@@ -30,13 +24,36 @@ type LumenScriptJobMessagePublisher interface {
 }
 
 func (q *QueueHandler) PublishLumenScriptJobMessage(m LumenScriptJobMessage, opts ...options.PublishOptions) error {
-	byt, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("marshaling message into json: %w", err)
-	}
-	err = q.Publish(byt, opts...)
-	if err != nil {
-		return fmt.Errorf("publishing to queue: %w", err)
+	return NewPublisher[LumenScriptJobMessage](q).Publish(m, opts...)
+}
+
+// NewLumenScriptJobMessagePublisher returns the QueueHandler as a LumenScriptJobMessagePublisher, recording LumenScriptJobMessage as a type it publishes.
+func NewLumenScriptJobMessagePublisher(q *QueueHandler) LumenScriptJobMessagePublisher {
+	NewPublisher[LumenScriptJobMessage](q)
+	return q
+}
+
+// FakeLumenScriptJobMessagePublisher is a LumenScriptJobMessagePublisher that records published messages, for use in tests.
+type FakeLumenScriptJobMessagePublisher struct {
+	mtx      sync.Mutex
+	messages []LumenScriptJobMessage
+	// Err is returned by PublishLumenScriptJobMessage when set, in which case the message is not recorded.
+	Err error
+}
+
+func (f *FakeLumenScriptJobMessagePublisher) PublishLumenScriptJobMessage(m LumenScriptJobMessage, opts ...options.PublishOptions) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.Err != nil {
+		return f.Err
 	}
+	f.messages = append(f.messages, m)
 	return nil
 }
+
+// Published returns the messages that have been published.
+func (f *FakeLumenScriptJobMessagePublisher) Published() []LumenScriptJobMessage {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]LumenScriptJobMessage(nil), f.messages...)
+}
@@ -1,28 +1,22 @@
+// Code generated by queuegen. DO NOT EDIT.
+
 package queue
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"sync"
 
-	"code.avct.cloud/attention-measurement-platform/internal/queue/options"
+	"queue/options"
 )
 
+func init() {
+	RegisterMessageType[Measurement]()
+}
+
 type MeasurementHandler func(ctx context.Context, r Measurement) error
 
 func (q *QueueHandler) AddMeasurementHandler(handler MeasurementHandler) *QueueHandler {
-	return q.AddHandler(func(ctx context.Context, data []byte) error {
-		var msg Measurement
-		err := json.Unmarshal(data, &msg)
-		if err != nil {
-			return fmt.Errorf("parsing message json: %w", err)
-		}
-		err = handler(ctx, msg)
-		if err != nil {
-			return fmt.Errorf("handling message: %w", err)
-		}
-		return nil
-	})
+	return Handle[Measurement](q, handler)
 }
 
 type MeasurementPublisher interface {
@@ -30,13 +24,36 @@ type MeasurementPublisher interface {
 }
 
 func (q *QueueHandler) PublishMeasurement(m Measurement, opts ...options.PublishOptions) error {
-	byt, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("marshaling message into json: %w", err)
-	}
-	err = q.Publish(byt, opts...)
-	if err != nil {
-		return fmt.Errorf("publishing to queue: %w", err)
+	return NewPublisher[Measurement](q).Publish(m, opts...)
+}
+
+// NewMeasurementPublisher returns the QueueHandler as a MeasurementPublisher, recording Measurement as a type it publishes.
+func NewMeasurementPublisher(q *QueueHandler) MeasurementPublisher {
+	NewPublisher[Measurement](q)
+	return q
+}
+
+// FakeMeasurementPublisher is a MeasurementPublisher that records published messages, for use in tests.
+type FakeMeasurementPublisher struct {
+	mtx      sync.Mutex
+	messages []Measurement
+	// Err is returned by PublishMeasurement when set, in which case the message is not recorded.
+	Err error
+}
+
+func (f *FakeMeasurementPublisher) PublishMeasurement(m Measurement, opts ...options.PublishOptions) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.Err != nil {
+		return f.Err
 	}
+	f.messages = append(f.messages, m)
 	return nil
 }
+
+// Published returns the messages that have been published.
+func (f *FakeMeasurementPublisher) Published() []Measurement {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]Measurement(nil), f.messages...)
+}
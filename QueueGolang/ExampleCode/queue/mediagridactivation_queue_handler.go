@@ -1,27 +1,22 @@
+// Code generated by queuegen. DO NOT EDIT.
+
 package queue
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"sync"
+
 	"queue/options"
 )
 
+func init() {
+	RegisterMessageType[MediaGridActivation]()
+}
+
 type MediaGridActivationHandler func(ctx context.Context, r MediaGridActivation) error
 
 func (q *QueueHandler) AddMediaGridActivationHandler(handler MediaGridActivationHandler) *QueueHandler {
-	return q.AddHandler(func(ctx context.Context, data []byte) error {
-		var msg MediaGridActivation
-		err := json.Unmarshal(data, &msg)
-		if err != nil {
-			return fmt.Errorf("parsing message json: %w", err)
-		}
-		err = handler(ctx, msg)
-		if err != nil {
-			return fmt.Errorf("handling message: %w", err)
-		}
-		return nil
-	})
+	return Handle[MediaGridActivation](q, handler)
 }
 
 type MediaGridActivationPublisher interface {
@@ -29,13 +24,36 @@ type MediaGridActivationPublisher interface {
 }
 
 func (q *QueueHandler) PublishMediaGridActivation(m MediaGridActivation, opts ...options.PublishOptions) error {
-	byt, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("marshaling message into json: %w", err)
-	}
-	err = q.Publish(byt, opts...)
-	if err != nil {
-		return fmt.Errorf("publishing to queue: %w", err)
+	return NewPublisher[MediaGridActivation](q).Publish(m, opts...)
+}
+
+// NewMediaGridActivationPublisher returns the QueueHandler as a MediaGridActivationPublisher, recording MediaGridActivation as a type it publishes.
+func NewMediaGridActivationPublisher(q *QueueHandler) MediaGridActivationPublisher {
+	NewPublisher[MediaGridActivation](q)
+	return q
+}
+
+// FakeMediaGridActivationPublisher is a MediaGridActivationPublisher that records published messages, for use in tests.
+type FakeMediaGridActivationPublisher struct {
+	mtx      sync.Mutex
+	messages []MediaGridActivation
+	// Err is returned by PublishMediaGridActivation when set, in which case the message is not recorded.
+	Err error
+}
+
+func (f *FakeMediaGridActivationPublisher) PublishMediaGridActivation(m MediaGridActivation, opts ...options.PublishOptions) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.Err != nil {
+		return f.Err
 	}
+	f.messages = append(f.messages, m)
 	return nil
 }
+
+// Published returns the messages that have been published.
+func (f *FakeMediaGridActivationPublisher) Published() []MediaGridActivation {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]MediaGridActivation(nil), f.messages...)
+}
@@ -2,121 +2,508 @@ package mem
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/apex/log"
+	"github.com/google/uuid"
+
+	"queue/internal/lease"
 )
 
 var (
-	defaultBackoff = time.Second
-	defaultBuffer  = 1000
+	defaultBuffer      = 1000
+	defaultVisibility  = 10 * time.Second
+	errIncorrectScheme = errors.New("incorrect scheme, should be mem")
+	memScheme          = "mem"
 
-	DefaultMemQueueMux = &MemQueueMux{pipe: make(map[string]chan MemQueueMessage)}
+	DefaultMemQueueMux = NewMemQueueMux()
 )
 
 func init() {
-	queue.Register("mem", DefaultMemQueueMux)
+	queue.Register(memScheme, DefaultMemQueueMux)
 }
 
-type MemQueueMessage struct {
-	data []byte
-	ctx  context.Context
+// MemQueueMux is an in-memory queue implementation emulating the semantics of a broker such as
+// SQS. Messages received by a handler are leased for the visibility timeout of the queue, they
+// are deleted once handled successfully, otherwise they are redelivered once the lease expires.
+// Messages that are not deleted after the maximum number of receives are moved to the dead
+// letter queue with the queue.ErrorReasonHeader set.
+//
+// URIs mirror the nsqd://host/topic/channel layout as mem://topic/channel. Messages published
+// to a topic are delivered to each of its channels, and QueueHandlers consuming the same channel
+// compete for its messages. Messages published while a topic has no channels are kept until the
+// first channel is created. mem://topic consumes the default channel of the topic, which is
+// created when a QueueHandler first starts consuming it. Channels with an #ephemeral fragment,
+// i.e. mem://topic/channel#ephemeral, are deleted with their messages once all the QueueHandlers
+// opened for them are closed.
+//
+// Channels are configured by the query parameters of the URI they were last opened with that
+// has query parameters, i.e. mem://topic/channel?visibility=10s&maxReceives=5&deadLetter=topic-dlq
+// where the dead letter queue is a topic. URIs without query parameters use the existing
+// configuration of the channel.
+type MemQueueMux struct {
+	mtx    sync.Mutex
+	clock  Clock
+	topics map[string]*memTopic
 }
 
-type MemQueueMux struct {
-	mtx  sync.Mutex
-	pipe map[string]chan MemQueueMessage
+// NewMemQueueMux returns a MemQueueMux using the RealClock.
+func NewMemQueueMux() *MemQueueMux {
+	return &MemQueueMux{
+		clock:  RealClock,
+		topics: make(map[string]*memTopic),
+	}
 }
 
-func (s *MemQueueMux) Queue(uri string) (*queue.QueueHandler, error) {
-	handler := queue.NewQueueHandler(uri, defaultBuffer)
-	err := s.pollForIncomingMessages(handler)
+// SetClock sets the Clock used for visibility timeouts and sent times. It should be called
+// before any queues are opened. It returns the MemQueueMux for chaining.
+func (s *MemQueueMux) SetClock(c Clock) *MemQueueMux {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.clock = c
+	return s
+}
+
+// queueConfig configures an in-memory queue.
+type queueConfig struct {
+	// The duration received messages are hidden from other consumers.
+	visibility time.Duration
+	// The number of times a message is received before it is dead lettered, zero never dead
+	// letters messages.
+	maxReceives int
+	// The topic dead lettered messages are published to, defaulting to the topic name with a
+	// -dlq suffix.
+	deadLetter string
+}
+
+func parseQueueConfig(u *url.URL) (queueConfig, error) {
+	cfg := queueConfig{visibility: defaultVisibility}
+	q := u.Query()
+	if v := q.Get("visibility"); v != "" {
+		visibility, err := time.ParseDuration(v)
+		if err != nil || visibility < 0 {
+			return cfg, fmt.Errorf("invalid visibility %q, should be a duration", v)
+		}
+		cfg.visibility = visibility
+	}
+	if v := q.Get("maxReceives"); v != "" {
+		maxReceives, err := strconv.Atoi(v)
+		if err != nil || maxReceives < 1 {
+			return cfg, fmt.Errorf("invalid maxReceives %q, should be a positive integer", v)
+		}
+		cfg.maxReceives = maxReceives
+		cfg.deadLetter = u.Host + "-dlq"
+	}
+	if v := q.Get("deadLetter"); v != "" {
+		if cfg.maxReceives == 0 {
+			return cfg, errors.New("deadLetter requires maxReceives")
+		}
+		cfg.deadLetter = v
+	}
+	return cfg, nil
+}
+
+// memTopic holds the channels of a topic. It is guarded by the MemQueueMux mutex.
+type memTopic struct {
+	// Messages published while the topic has no channels, moved to the first channel.
+	backlog  *memQueue
+	channels map[string]*memQueue
+	// The configuration of the channels, by channel name.
+	configs map[string]queueConfig
+}
+
+// memQueue holds the messages of a channel. It is guarded by the MemQueueMux mutex.
+type memQueue struct {
+	cfg queueConfig
+	// Whether the channel is deleted once the QueueHandlers opened for it are closed.
+	ephemeral bool
+	handlers  int
+	msgs      *lease.Queue[memMessage]
+}
+
+// memMessage is the content of a message, preserving the metadata it was published with.
+type memMessage struct {
+	correlationID string
+	headers       map[string]string
+	data          []byte
+	sent          time.Time
+}
+
+func newMemQueue(cfg queueConfig) *memQueue {
+	return &memQueue{
+		cfg:  cfg,
+		msgs: lease.New[memMessage](),
+	}
+}
+
+// topic returns the topic with the name, creating it if it does not exist. It must be called
+// with the mutex held.
+func (s *MemQueueMux) topic(name string) *memTopic {
+	t, ok := s.topics[name]
+	if !ok {
+		t = &memTopic{
+			backlog:  newMemQueue(queueConfig{visibility: defaultVisibility}),
+			channels: make(map[string]*memQueue),
+			configs:  make(map[string]queueConfig),
+		}
+		s.topics[name] = t
+	}
+	return t
+}
+
+// channel returns the channel of the topic, creating it if it does not exist. The first channel
+// of a topic receives the messages published before it was created. It must be called with the
+// mutex held.
+func (s *MemQueueMux) channel(topic, name string) *memQueue {
+	t := s.topic(topic)
+	q, ok := t.channels[name]
+	if ok {
+		return q
+	}
+	cfg, ok := t.configs[name]
+	if !ok {
+		cfg = queueConfig{visibility: defaultVisibility}
+	}
+	q = newMemQueue(cfg)
+	q.ephemeral = strings.HasSuffix(name, "#ephemeral")
+	if len(t.channels) == 0 {
+		if backlog := t.backlog.msgs.Take(); len(backlog) > 0 {
+			q.msgs.Add(backlog...)
+		}
+	}
+	t.channels[name] = q
+	return q
+}
+
+// publish delivers a copy of the message to each channel of the topic. It must be called with
+// the mutex held.
+func (s *MemQueueMux) publish(topic string, msg *lease.Message[memMessage]) {
+	t := s.topic(topic)
+	if len(t.channels) == 0 {
+		t.backlog.msgs.Add(msg)
+		return
+	}
+	for _, q := range t.channels {
+		m := *msg
+		q.msgs.Add(&m)
+	}
+}
+
+// lookup returns the channel for the URI without creating it, or the backlog of the topic for
+// the default channel before it is created. It returns nil if the channel does not exist. It
+// must be called with the mutex held.
+func (s *MemQueueMux) lookup(uri string) (*memQueue, error) {
+	topic, channel, err := parseURI(uri)
 	if err != nil {
 		return nil, err
 	}
-	err = s.pollForOutgoingMessages(handler)
+	t, ok := s.topics[topic]
+	if !ok {
+		return nil, nil
+	}
+	if q, ok := t.channels[channel]; ok {
+		return q, nil
+	}
+	if channel == "" && len(t.channels) == 0 {
+		return t.backlog, nil
+	}
+	return nil, nil
+}
+
+// parseURI returns the topic and channel of a mem URI.
+func parseURI(uri string) (string, string, error) {
+	u, err := url.Parse(uri)
 	if err != nil {
-		return nil, err
+		return "", "", err
 	}
-	return handler, nil
+	if u.Scheme != memScheme {
+		return "", "", errIncorrectScheme
+	}
+	channel := strings.TrimPrefix(u.Path, "/")
+	if strings.Contains(channel, "/") {
+		return "", "", fmt.Errorf("invalid mem uri %q, should be mem://topic/channel", uri)
+	}
+	if channel != "" && u.Fragment == "ephemeral" {
+		channel += "#ephemeral"
+	}
+	return u.Host, channel, nil
 }
 
-func (s *MemQueueMux) pollForIncomingMessages(handler *queue.QueueHandler) error {
-	u, err := url.Parse(handler.URI())
+func (s *MemQueueMux) Queue(uri string) (*queue.QueueHandler, error) {
+	topic, channel, err := parseURI(uri)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseQueueConfig(u)
+	if err != nil {
+		return nil, err
 	}
+	handler := queue.NewQueueHandler(uri, defaultBuffer)
 	s.mtx.Lock()
-	if _, exists := s.pipe[u.Host]; !exists {
-		s.pipe[u.Host] = make(chan MemQueueMessage, defaultBuffer)
+	t := s.topic(topic)
+	// Only URIs with query parameters configure the channel, so opening a plain URI, e.g. to
+	// publish, does not reset the configuration of its consumers.
+	if u.RawQuery != "" {
+		t.configs[channel] = cfg
+		if q, ok := t.channels[channel]; ok {
+			q.cfg = cfg
+		}
+	} else if existing, ok := t.configs[channel]; ok {
+		cfg = existing
+	}
+	handler.Visibility = cfg.visibility
+	// Named channels are created when they are opened, like nsq channels are created when a
+	// consumer connects.
+	if channel != "" {
+		s.channel(topic, channel).handlers++
+		go func() {
+			<-handler.Done
+			s.closeChannel(topic, channel)
+		}()
 	}
-	pipe := s.pipe[u.Host]
 	s.mtx.Unlock()
+	s.pollForIncomingMessages(handler, topic, channel)
+	s.pollForOutgoingMessages(handler, topic)
+	return handler, nil
+}
+
+// closeChannel records that a QueueHandler opened for the channel was closed, deleting the
+// channel if it is ephemeral and no QueueHandlers remain open.
+func (s *MemQueueMux) closeChannel(topic, channel string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	t := s.topic(topic)
+	q, ok := t.channels[channel]
+	if !ok {
+		return
+	}
+	q.handlers--
+	if q.ephemeral && q.handlers == 0 {
+		delete(t.channels, channel)
+		delete(t.configs, channel)
+	}
+}
+
+func (s *MemQueueMux) pollForIncomingMessages(handler *queue.QueueHandler, topic, channel string) {
 	go func() {
 		<-handler.Ready
-		log.WithField("uri", handler.URI()).Info("queue consumer starting")
-	LOOP:
+		handler.Logger().Info("queue consumer starting")
+		s.mtx.Lock()
+		q := s.channel(topic, channel)
+		s.mtx.Unlock()
 		for {
-			select {
-			case <-handler.Done:
-				log.WithField("uri", handler.URI()).Info("queue consumer shutting down")
-				break LOOP
-			case msg := <-pipe:
-				err := <-handler.Receive(msg.ctx, msg.data)
-				// The message should be deleted if there is no error, otherwise, if the handler
-				// has set the message delete value it should use that behaviour.
-				shouldDelete := err == nil
-				if shouldDeleteValue, isDeleteSet := options.GetMessageDeleteValue(msg.ctx); isDeleteSet {
-					shouldDelete = shouldDeleteValue
-				}
-				// Requeue the message unless it should be deleted.
-				if !shouldDelete {
-					go func() {
-						log.Warn("requeueing failed message in 10 seconds")
-						time.Sleep(10 * time.Second)
-						pipe <- msg
-					}()
-					continue
-				}
+			// Wait until the handler is permitted to consume another message.
+			if err := handler.Wait(); err != nil {
+				break
 			}
-
+			l, ok := s.receive(handler, q)
+			if !ok {
+				break
+			}
+			s.handle(handler, q, l)
 		}
+		handler.Logger().Info("queue consumer shutting down")
 	}()
-	return nil
 }
 
-func (s *MemQueueMux) pollForOutgoingMessages(handler *queue.QueueHandler) error {
-	u, err := url.Parse(handler.URI())
+// receive leases the next available message, waiting until one is available. It returns false
+// if the handler is closed while waiting.
+func (s *MemQueueMux) receive(handler *queue.QueueHandler, q *memQueue) (lease.Lease[memMessage], bool) {
+	for {
+		s.mtx.Lock()
+		now := s.clock.Now()
+		q.msgs.Expire(now)
+		for {
+			msg, ok := q.msgs.Next()
+			if !ok {
+				break
+			}
+			if q.cfg.maxReceives > 0 && msg.Receives >= q.cfg.maxReceives {
+				s.deadLetter(q, msg, fmt.Sprintf("message received %d times without being deleted", msg.Receives))
+				continue
+			}
+			l := q.msgs.Lease(msg, now, q.cfg.visibility)
+			s.mtx.Unlock()
+			return l, true
+		}
+		var expired <-chan time.Time
+		if next := q.msgs.NextExpiry(); !next.IsZero() {
+			expired = s.clock.After(next.Sub(now))
+		}
+		changed := q.msgs.Changed()
+		s.mtx.Unlock()
+		select {
+		case <-handler.Done:
+			return lease.Lease[memMessage]{}, false
+		case <-changed:
+		case <-expired:
+		}
+	}
+}
+
+func (s *MemQueueMux) handle(handler *queue.QueueHandler, q *memQueue, l lease.Lease[memMessage]) {
+	msg := l.Msg.Value
+	ctx := options.ContextWithPublishOptions(options.ContextWithMessageDelete(context.Background()), options.PublishOptions{
+		CorrelationID: &msg.correlationID,
+		Headers:       msg.headers,
+	})
+	ctx = options.ContextWithMessageID(ctx, l.Msg.ID)
+	ctx = options.ContextWithSentTime(ctx, msg.sent)
+	// Release messages received while the handler was closing.
+	select {
+	case <-handler.Done:
+		s.release(q, l)
+		return
+	default:
+	}
+	err := <-handler.Receive(ctx, msg.data)
+	// The message should be deleted if there is no error, otherwise, if the handler
+	// has set the message delete value it should use that behaviour.
+	shouldDelete := err == nil
+	if shouldDeleteValue, isDeleteSet := options.GetMessageDeleteValue(ctx); isDeleteSet {
+		shouldDelete = shouldDeleteValue
+	}
+	if shouldDelete {
+		s.delete(q, l)
+		return
+	}
+	reason := "message delete value set to false"
 	if err != nil {
-		return err
+		reason = err.Error()
+	}
+	// Failed messages are redelivered once their lease expires, unless they have been received
+	// the maximum number of times.
+	if s.fail(q, l, reason) {
+		handler.MessageLogger(ctx).WithField("reason", reason).Warn("message moved to dead letter queue")
+	}
+}
+
+// delete deletes a leased message, it returns false if the lease had expired.
+func (s *MemQueueMux) delete(q *memQueue, l lease.Lease[memMessage]) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return q.msgs.Delete(l)
+}
+
+// release makes a leased message available again without counting the receive.
+func (s *MemQueueMux) release(q *memQueue, l lease.Lease[memMessage]) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	q.msgs.Release(l)
+}
+
+// fail moves a leased message that failed to the dead letter queue if it has been received the
+// maximum number of times, returning whether it was dead lettered. Otherwise it is redelivered
+// once its lease expires.
+func (s *MemQueueMux) fail(q *memQueue, l lease.Lease[memMessage], reason string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if q.cfg.maxReceives == 0 || l.Receives < q.cfg.maxReceives || !q.msgs.Delete(l) {
+		return false
+	}
+	s.deadLetter(q, l.Msg, reason)
+	return true
+}
+
+// deadLetter publishes a message to the dead letter topic of the channel, recording the reason.
+// It must be called with the mutex held.
+func (s *MemQueueMux) deadLetter(q *memQueue, msg *lease.Message[memMessage], reason string) {
+	headers := make(map[string]string, len(msg.Value.headers)+1)
+	for k, v := range msg.Value.headers {
+		headers[k] = v
 	}
+	headers[queue.ErrorReasonHeader] = reason
+	value := msg.Value
+	value.headers = headers
+	s.publish(q.cfg.deadLetter, &lease.Message[memMessage]{ID: msg.ID, Value: value})
+}
+
+func (s *MemQueueMux) pollForOutgoingMessages(handler *queue.QueueHandler, topic string) {
 	go func() {
-		log.WithField("uri", handler.URI()).Info("queue publisher starting")
+		handler.Logger().Info("queue publisher starting")
+	LOOP:
 		for {
 			select {
 			case <-handler.Done:
-				log.WithField("uri", handler.URI()).Info("queue publisher shutting down")
-				break
+				handler.Logger().Info("queue publisher shutting down")
+				break LOOP
 			case outgoing := <-handler.Outgoing:
 				s.mtx.Lock()
-				if ch, ok := s.pipe[u.Host]; ok {
-					ch <- MemQueueMessage{
-						data: outgoing.Data,
-						ctx:  options.NewMessageContext(),
-					}
-				} else {
-					s.pipe[u.Host] = make(chan MemQueueMessage, defaultBuffer)
-					s.pipe[u.Host] <- MemQueueMessage{
-						data: outgoing.Data,
-						ctx:  options.NewMessageContext(),
-					}
-				}
+				s.publish(topic, s.newMemMessage(outgoing))
 				s.mtx.Unlock()
 				outgoing.Close()
 			}
 		}
 	}()
+}
+
+// newMemMessage returns a message preserving the correlation ID and headers of a published
+// message. It must be called with the mutex held.
+func (s *MemQueueMux) newMemMessage(outgoing queue.QueueMessage) *lease.Message[memMessage] {
+	return &lease.Message[memMessage]{
+		ID: uuid.NewString(),
+		Value: memMessage{
+			correlationID: options.CorrelationIDFromContext(outgoing.Context),
+			headers:       options.HeadersFromContext(outgoing.Context),
+			data:          outgoing.Data,
+			sent:          s.clock.Now(),
+		},
+	}
+}
+
+// Count returns the number of messages available in the channel, excluding messages in flight.
+func (s *MemQueueMux) Count(ctx context.Context, uri string) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	q, err := s.lookup(uri)
+	if q == nil || err != nil {
+		return 0, err
+	}
+	q.msgs.Expire(s.clock.Now())
+	return len(q.msgs.Ready()), nil
+}
+
+// Purge deletes the messages in the channel, including messages in flight.
+func (s *MemQueueMux) Purge(ctx context.Context, uri string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	q, err := s.lookup(uri)
+	if q == nil || err != nil {
+		return err
+	}
+	q.msgs.Purge()
 	return nil
 }
+
+// Peek returns up to max messages available in the channel without leasing them.
+func (s *MemQueueMux) Peek(ctx context.Context, uri string, max int) ([]queue.PeekedMessage, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	q, err := s.lookup(uri)
+	if q == nil || err != nil {
+		return nil, err
+	}
+	q.msgs.Expire(s.clock.Now())
+	var msgs []queue.PeekedMessage
+	for _, msg := range q.msgs.Ready() {
+		if len(msgs) == max {
+			break
+		}
+		msgs = append(msgs, queue.PeekedMessage{
+			ID:            msg.ID,
+			CorrelationID: msg.Value.correlationID,
+			Headers:       msg.Value.headers,
+			Data:          msg.Value.data,
+		})
+	}
+	return msgs, nil
+}
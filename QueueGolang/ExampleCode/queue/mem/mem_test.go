@@ -0,0 +1,371 @@
+package mem
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"queue"
+	"queue/options"
+	"queue/queuetest"
+)
+
+func TestMemQueueMux_Conformance(t *testing.T) {
+	queuetest.RunConformance(t, queuetest.Factory{
+		URI: func(name string) string {
+			return "mem://" + name + "?visibility=50ms"
+		},
+		Queue:  NewMemQueueMux().Queue,
+		Settle: 250 * time.Millisecond,
+	})
+}
+
+func TestParseQueueConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		want    queueConfig
+		wantErr bool
+	}{
+		{
+			"defaults",
+			"mem://orders",
+			queueConfig{visibility: 10 * time.Second},
+			false,
+		},
+		{
+			"max receives defaults the dead letter queue",
+			"mem://orders?visibility=1m&maxReceives=3",
+			queueConfig{visibility: time.Minute, maxReceives: 3, deadLetter: "orders-dlq"},
+			false,
+		},
+		{
+			"dead letter queue",
+			"mem://orders?maxReceives=3&deadLetter=failed",
+			queueConfig{visibility: 10 * time.Second, maxReceives: 3, deadLetter: "failed"},
+			false,
+		},
+		{
+			"dead letter queue requires max receives",
+			"mem://orders?deadLetter=failed",
+			queueConfig{},
+			true,
+		},
+		{
+			"invalid visibility",
+			"mem://orders?visibility=soon",
+			queueConfig{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseQueueConfig(u)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseQueueConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseQueueConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemQueueMux_VisibilityAndDeadLetter(t *testing.T) {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := NewFakeClock(start)
+	mux := NewMemQueueMux().SetClock(clock)
+	ctx := context.Background()
+	q, err := mux.Queue("mem://orders?visibility=30s&maxReceives=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Visibility != 30*time.Second {
+		t.Errorf("expected handler visibility of 30s, got %s", q.Visibility)
+	}
+	received := make(chan context.Context, 10)
+	q.AddHandler(func(ctx context.Context, data []byte) error {
+		received <- ctx
+		return errors.New("downstream unavailable")
+	})
+	err = q.Publish([]byte(`{"id":"1"}`), options.WithCorrelationID("order-1"), options.WithHeader("source", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Start()
+
+	first := <-received
+	if options.CorrelationIDFromContext(first) != "order-1" || options.HeaderFromContext(first, "source") != "test" {
+		t.Errorf("expected metadata to be preserved, got %v", options.HeadersFromContext(first))
+	}
+	if !options.SentTimeFromContext(first).Equal(start) {
+		t.Errorf("expected sent time from the clock, got %s", options.SentTimeFromContext(first))
+	}
+	// The failed message is in flight until its lease expires.
+	queuetest.Eventually(t, func() bool {
+		n, _ := mux.Count(ctx, "mem://orders")
+		return n == 0
+	})
+	select {
+	case <-received:
+		t.Fatal("expected message not to be redelivered before the visibility timeout")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.Advance(30 * time.Second)
+	second := <-received
+	if options.MessageIDFromContext(second) != options.MessageIDFromContext(first) {
+		t.Error("expected the same message to be redelivered")
+	}
+	// The second failure exceeds the maximum receives so the message is dead lettered.
+	queuetest.Eventually(t, func() bool {
+		n, _ := mux.Count(ctx, "mem://orders-dlq")
+		return n == 1
+	})
+	msgs, err := mux.Peek(ctx, "mem://orders-dlq", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := queue.PeekedMessage{
+		ID:            options.MessageIDFromContext(first),
+		CorrelationID: "order-1",
+		Headers: map[string]string{
+			"source":                "test",
+			queue.ErrorReasonHeader: "downstream unavailable",
+		},
+		Data: []byte(`{"id":"1"}`),
+	}
+	if len(msgs) != 1 || !reflect.DeepEqual(msgs[0], expected) {
+		t.Errorf("expected dead lettered message %+v, got %+v", expected, msgs)
+	}
+
+	clock.Advance(time.Minute)
+	select {
+	case <-received:
+		t.Fatal("expected dead lettered message not to be redelivered")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestMemQueueMux_PublisherAfterConsumer(t *testing.T) {
+	mux := NewMemQueueMux()
+	ctx := context.Background()
+	consumer, err := mux.Queue("mem://invoices?visibility=30s&maxReceives=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	consumer.AddHandler(func(ctx context.Context, data []byte) error {
+		return errors.New("downstream unavailable")
+	})
+	consumer.Start()
+
+	// Opening the queue without query parameters does not reset the consumer's configuration.
+	publisher, err := mux.Queue("mem://invoices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	if publisher.Visibility != 30*time.Second {
+		t.Errorf("expected the configured visibility of 30s, got %s", publisher.Visibility)
+	}
+	if err := publisher.Publish([]byte(`{"id":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	queuetest.Eventually(t, func() bool {
+		n, _ := mux.Count(ctx, "mem://invoices-dlq")
+		return n == 1
+	})
+}
+
+func TestMemQueueMux_PeekPurge(t *testing.T) {
+	mux := NewMemQueueMux()
+	ctx := context.Background()
+	q, err := mux.Queue("mem://peek")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, payload := range []string{"a", "b", "c"} {
+		if err := q.Publish([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, err := mux.Peek(ctx, "mem://peek", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || string(msgs[0].Data) != "a" || string(msgs[1].Data) != "b" {
+		t.Errorf("expected the first two messages, got %+v", msgs)
+	}
+	if n, _ := mux.Count(ctx, "mem://peek"); n != 3 {
+		t.Errorf("expected peeked messages to remain available, got count %d", n)
+	}
+	if err := mux.Purge(ctx, "mem://peek"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := mux.Count(ctx, "mem://peek"); n != 0 {
+		t.Errorf("expected purged queue to be empty, got count %d", n)
+	}
+}
+
+func TestParseURI(t *testing.T) {
+	tests := []struct {
+		name        string
+		uri         string
+		wantTopic   string
+		wantChannel string
+		wantErr     bool
+	}{
+		{"topic", "mem://orders", "orders", "", false},
+		{"channel", "mem://orders/billing?visibility=1m", "orders", "billing", false},
+		{"ephemeral channel", "mem://orders/audit#ephemeral", "orders", "audit#ephemeral", false},
+		{"nested channel", "mem://orders/billing/extra", "", "", true},
+		{"incorrect scheme", "nsqd://localhost/orders/billing", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic, channel, err := parseURI(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseURI() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if topic != tt.wantTopic || channel != tt.wantChannel {
+				t.Errorf("parseURI() = %q, %q, want %q, %q", topic, channel, tt.wantTopic, tt.wantChannel)
+			}
+		})
+	}
+}
+
+// collect starts the QueueHandler with a handler that sends each payload received.
+func collect(q *queue.QueueHandler) <-chan string {
+	received := make(chan string, 100)
+	q.AddHandler(func(ctx context.Context, data []byte) error {
+		received <- string(data)
+		return nil
+	})
+	q.Start()
+	return received
+}
+
+func TestMemQueueMux_FanOut(t *testing.T) {
+	mux := NewMemQueueMux()
+	open := func(uri string) *queue.QueueHandler {
+		q, err := mux.Queue(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(q.Close)
+		return q
+	}
+	// Consumers of the same channel compete, each channel receives every message.
+	billing := []<-chan string{collect(open("mem://orders/billing")), collect(open("mem://orders/billing"))}
+	shipping := collect(open("mem://orders/shipping"))
+	publisher := open("mem://orders")
+	const messages = 20
+	for i := 0; i < messages; i++ {
+		if err := publisher.Publish([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	billed := make(map[string]int)
+	for len(billed) < messages {
+		select {
+		case p := <-billing[0]:
+			billed[p]++
+		case p := <-billing[1]:
+			billed[p]++
+		case <-time.After(time.Second):
+			t.Fatalf("expected every message to be received on the billing channel, got %d", len(billed))
+		}
+	}
+	shipped := make(map[string]int)
+	for len(shipped) < messages {
+		select {
+		case p := <-shipping:
+			shipped[p]++
+		case <-time.After(time.Second):
+			t.Fatalf("expected every message to be received on the shipping channel, got %d", len(shipped))
+		}
+	}
+	select {
+	case p := <-billing[0]:
+		t.Errorf("expected each message to be received once per channel, got %q again", p)
+	case p := <-billing[1]:
+		t.Errorf("expected each message to be received once per channel, got %q again", p)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestMemQueueMux_Channels(t *testing.T) {
+	mux := NewMemQueueMux()
+	ctx := context.Background()
+	publisher, err := mux.Queue("mem://events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	if err := publisher.Publish([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	queuetest.Eventually(t, func() bool {
+		n, _ := mux.Count(ctx, "mem://events")
+		return n == 1
+	})
+
+	// The first channel receives the messages published before it was created.
+	durable, err := mux.Queue("mem://events/durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := mux.Count(ctx, "mem://events/durable"); n != 1 {
+		t.Errorf("expected the first channel to receive the backlog, got count %d", n)
+	}
+	ephemeral, err := mux.Queue("mem://events/audit#ephemeral")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	queuetest.Eventually(t, func() bool {
+		n, _ := mux.Count(ctx, "mem://events/audit#ephemeral")
+		return n == 1
+	})
+	if n, _ := mux.Count(ctx, "mem://events/durable"); n != 2 {
+		t.Errorf("expected the durable channel to have both messages, got count %d", n)
+	}
+
+	// Ephemeral channels are deleted once closed, durable channels retain their messages.
+	ephemeral.Close()
+	durable.Close()
+	queuetest.Eventually(t, func() bool {
+		mux.mtx.Lock()
+		defer mux.mtx.Unlock()
+		_, ok := mux.topics["events"].channels["audit#ephemeral"]
+		return !ok
+	})
+	if n, _ := mux.Count(ctx, "mem://events/audit#ephemeral"); n != 0 {
+		t.Errorf("expected the ephemeral channel to be deleted, got count %d", n)
+	}
+	if n, _ := mux.Count(ctx, "mem://events/durable"); n != 2 {
+		t.Errorf("expected the durable channel to retain its messages, got count %d", n)
+	}
+	msgs, err := mux.Peek(ctx, "mem://events/durable", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || string(msgs[0].Data) != "before" || string(msgs[1].Data) != "after" {
+		t.Errorf("expected the durable channel messages in order, got %+v", msgs)
+	}
+}
@@ -0,0 +1,123 @@
+package nsq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// defaultHTTPPort is the default port of the nsqd HTTP API, used to count and purge messages.
+// It can be overridden using the httpAddress query parameter, i.e. nsqd://host:4150/topic/channel?httpAddress=host:4151
+const defaultHTTPPort = "4151"
+
+var httpClient = http.DefaultClient
+
+type nsqdStats struct {
+	Topics []struct {
+		TopicName string `json:"topic_name"`
+		Depth     int    `json:"depth"`
+		Channels  []struct {
+			ChannelName string `json:"channel_name"`
+			Depth       int    `json:"depth"`
+		} `json:"channels"`
+	} `json:"topics"`
+}
+
+// Count returns the depth of the channel, or the topic for publish only queues.
+func (s *NSQQueueMux) Count(ctx context.Context, uri string) (int, error) {
+	addr, topic, channel, err := parseAdminURI(uri)
+	if err != nil {
+		return 0, err
+	}
+	q := url.Values{"format": {"json"}, "topic": {topic}}
+	if channel != "" {
+		q.Set("channel", channel)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/stats?"+q.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	var stats nsqdStats
+	err = doRequest(req, &stats)
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range stats.Topics {
+		if t.TopicName != topic {
+			continue
+		}
+		if channel == "" {
+			return t.Depth, nil
+		}
+		for _, c := range t.Channels {
+			if c.ChannelName == channel {
+				return c.Depth, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// Purge empties the channel, or the topic for publish only queues.
+func (s *NSQQueueMux) Purge(ctx context.Context, uri string) error {
+	addr, topic, channel, err := parseAdminURI(uri)
+	if err != nil {
+		return err
+	}
+	endpoint := "/topic/empty"
+	q := url.Values{"topic": {topic}}
+	if channel != "" {
+		endpoint = "/channel/empty"
+		q.Set("channel", channel)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	return doRequest(req, nil)
+}
+
+// parseAdminURI returns the nsqd HTTP address, topic and channel of a queue URI. The channel
+// is empty for publish only queues.
+func parseAdminURI(uri string) (addr, topic, channel string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", "", err
+	}
+	if u.Scheme != nsqdScheme {
+		return "", "", "", errIncorrectSchemeForAdmin
+	}
+	topic = strings.TrimPrefix(path.Dir(u.Path), "/")
+	channel = strings.TrimPrefix(path.Base(u.Path), "/")
+	if u.Fragment == "ephemeral" {
+		channel += "#ephemeral"
+	}
+	if topic == "" {
+		topic, channel = channel, ""
+	}
+	addr = u.Query().Get("httpAddress")
+	if addr == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultHTTPPort)
+	}
+	return addr, topic, channel, nil
+}
+
+func doRequest(req *http.Request, v interface{}) error {
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("nsqd %s returned %s", req.URL.Path, res.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,66 @@
+package nsq
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNSQQueueMux_Admin(t *testing.T) {
+	var emptied string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stats":
+			fmt.Fprint(w, `{"topics":[{"topic_name":"topic","depth":7,"channels":[{"channel_name":"channel","depth":4}]}]}`)
+		case "/channel/empty", "/topic/empty":
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			emptied = r.URL.Path + "?" + r.URL.RawQuery
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := newNSQQueueMux(false)
+	ctx := context.Background()
+
+	tests := []struct {
+		uri     string
+		depth   int
+		emptied string
+	}{
+		{uri: "nsqd://localhost:4150/topic/channel?httpAddress=" + u.Host, depth: 4, emptied: "/channel/empty?channel=channel&topic=topic"},
+		{uri: "nsqd://localhost:4150/topic?httpAddress=" + u.Host, depth: 7, emptied: "/topic/empty?topic=topic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			n, err := mux.Count(ctx, tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.depth {
+				t.Errorf("expected depth %d, got %d", tt.depth, n)
+			}
+			err = mux.Purge(ctx, tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if emptied != tt.emptied {
+				t.Errorf("expected %s, got %s", tt.emptied, emptied)
+			}
+		})
+	}
+
+	if _, err := newNSQQueueMux(true).Count(ctx, "nsqlookupd://localhost:4161/topic/channel"); err != errIncorrectSchemeForAdmin {
+		t.Errorf("expected errIncorrectSchemeForAdmin, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package nsq
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/url"
@@ -8,7 +9,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/apex/log"
 	nsq "github.com/nsqio/go-nsq"
 )
 
@@ -16,6 +16,8 @@ var (
 	defaultBuffer                   = 1000
 	errIncorrectScheme              = errors.New("incorrect scheme, should be nsqd or nsqlookupd")
 	errIncorrectSchemeForPublishing = errors.New("incorrect scheme, publishing requires nsqd")
+	errIncorrectSchemeForAdmin      = errors.New("incorrect scheme, counting and purging requires nsqd")
+	errRequeue                      = errors.New("message delete value set to false, requeueing")
 	nsqlookupdScheme                = "nsqlookupd"
 	nsqdScheme                      = "nsqd"
 )
@@ -27,7 +29,65 @@ func init() {
 
 type NSQMessage struct {
 	CorrelationID string
-	RawMessage    json.RawMessage
+	Headers       map[string]string `json:",omitempty"`
+	// RawMessage holds json payloads that are published as is, which earlier versions can decode.
+	RawMessage json.RawMessage `json:",omitempty"`
+	// Body holds other payloads byte for byte.
+	Body []byte `json:",omitempty"`
+}
+
+// encodeMessage returns the NSQ message body for an outgoing message.
+func encodeMessage(outgoing queue.QueueMessage) ([]byte, error) {
+	var msg NSQMessage
+	opts, ok := options.PublishOptionsFromContext(outgoing.Context)
+	if ok {
+		if opts.CorrelationID != nil && *opts.CorrelationID != "" {
+			msg.CorrelationID = *opts.CorrelationID
+		}
+		msg.Headers = opts.Headers
+	}
+	// Json payloads are published in RawMessage, so consumers running earlier versions can decode
+	// them while they are deployed. json.RawMessage compacts and escapes json when marshaled, which
+	// would invalidate signatures, so transformed payloads and payloads that are not json are
+	// published in the body.
+	if !transformed(msg.Headers) && json.Valid(outgoing.Data) {
+		msg.RawMessage = outgoing.Data
+	} else {
+		msg.Body = outgoing.Data
+	}
+	return json.Marshal(msg)
+}
+
+// transformed returns whether the headers describe a payload transformation, i.e. compression,
+// encryption, signing or a claim check.
+func transformed(headers map[string]string) bool {
+	for _, header := range queue.PayloadHeaders() {
+		if headers[header] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeMessage returns the message context and payload of an NSQ message body.
+func decodeMessage(body []byte) (context.Context, []byte, error) {
+	var m NSQMessage
+	err := json.Unmarshal(body, &m)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx := options.ContextWithPublishOptions(
+		options.NewMessageContext(),
+		options.Merge(
+			options.WithCorrelationID(m.CorrelationID),
+			options.WithHeaders(m.Headers),
+		),
+	)
+	data := []byte(m.RawMessage)
+	if m.Body != nil {
+		data = m.Body
+	}
+	return ctx, data, nil
 }
 
 type NSQQueueMux struct {
@@ -70,47 +130,67 @@ func (s *NSQQueueMux) pollForIncomingMessages(handler *queue.QueueHandler) error
 		topic = channel
 	}
 	if topic == channel {
-		log.
+		handler.Logger().
 			WithField("topic", topic).
 			Info("queue started in publish only mode")
 		return nil
 	}
-	consumer, err := nsq.NewConsumer(topic, channel, nsq.NewConfig())
+	config := nsq.NewConfig()
+	consumer, err := nsq.NewConsumer(topic, channel, config)
 	if err != nil {
 		return err
 	}
+	// Stop nsq sending messages while the handler is paused, without closing connections.
+	handler.OnStateChange(func(from, to queue.State) {
+		switch to {
+		case queue.StatePaused:
+			consumer.ChangeMaxInFlight(0)
+		case queue.StateRunning:
+			consumer.ChangeMaxInFlight(config.MaxInFlight)
+		}
+	})
 	go func() {
 		// Wait for the handler to be ready before beginning consumption.
 		<-handler.Ready
+		logger := handler.Logger().
+			WithField("topic", topic).
+			WithField("channel", channel)
 	LOOP:
 		for {
-			log.
-				WithField("topic", topic).
-				WithField("channel", channel).
-				Info("nsq queue consumer starting")
+			logger.Info("nsq queue consumer starting")
 			consumer.AddHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
-				var m NSQMessage
-				err := json.Unmarshal(message.Body, &m)
+				ctx, data, err := decodeMessage(message.Body)
 				if err != nil {
 					return err
 				}
-				ctx := options.ContextWithPublishOptions(
-					options.NewMessageContext(),
-					options.Merge(
-						options.WithCorrelationID(m.CorrelationID),
-					),
-				)
-
-				return <-handler.Receive(ctx, m.RawMessage)
+				ctx = options.ContextWithMessageID(ctx, string(message.ID[:]))
+				ctx = options.ContextWithSentTime(ctx, time.Unix(0, message.Timestamp))
+				// Wait until the handler is permitted to consume another message,
+				// nsq will not deliver further messages until this one is handled.
+				err = handler.Wait()
+				if err != nil {
+					return err
+				}
+				err = <-handler.Receive(ctx, data)
+				// The message should be finished if there is no error, otherwise, if the handler
+				// has set the message delete value it should use that behaviour.
+				shouldDelete := err == nil
+				if shouldDeleteValue, isDeleteSet := options.GetMessageDeleteValue(ctx); isDeleteSet {
+					shouldDelete = shouldDeleteValue
+				}
+				if !shouldDelete {
+					if err == nil {
+						err = errRequeue
+					}
+					return err
+				}
+				// nsq finishes the message once the handler returns without error.
+				return nil
 			}))
 			if s.useNSQLookupd {
 				err := consumer.ConnectToNSQLookupd(u.Host)
 				if err != nil {
-					log.
-						WithField("topic", topic).
-						WithField("channel", channel).
-						WithError(err).
-						Error("connecting to nsqlookupd")
+					logger.WithError(err).Error("connecting to nsqlookupd")
 					time.Sleep(10 * time.Second)
 					// If an error occurs it should be temporary, wait 10s and
 					// try again.
@@ -119,11 +199,7 @@ func (s *NSQQueueMux) pollForIncomingMessages(handler *queue.QueueHandler) error
 			} else {
 				err := consumer.ConnectToNSQD(u.Host)
 				if err != nil {
-					log.
-						WithField("topic", topic).
-						WithField("channel", channel).
-						WithError(err).
-						Error("connecting to nsqd")
+					logger.WithError(err).Error("connecting to nsqd")
 					time.Sleep(10 * time.Second)
 					// If an error occurs it should be temporary, wait 10s and
 					// try again.
@@ -133,16 +209,10 @@ func (s *NSQQueueMux) pollForIncomingMessages(handler *queue.QueueHandler) error
 			// Wait for the handler or consumer to signal shutdown.
 			select {
 			case <-consumer.StopChan:
-				log.
-					WithField("topic", topic).
-					WithField("channel", channel).
-					Warn("nsq consumer stopping")
+				logger.Warn("nsq consumer stopping")
 				break LOOP
 			case <-handler.Done:
-				log.
-					WithField("topic", topic).
-					WithField("channel", channel).
-					Warn("nsq handler stopping")
+				logger.Warn("nsq handler stopping")
 				break LOOP
 			}
 		}
@@ -157,7 +227,7 @@ func (s *NSQQueueMux) pollForOutgoingMessages(handler *queue.QueueHandler) error
 	}
 	if u.Scheme != nsqdScheme {
 		if u.Scheme == nsqlookupdScheme {
-			log.Warn("queue is in non publishing mode")
+			handler.Logger().Warn("queue is in non publishing mode")
 			return nil
 		}
 		return errIncorrectScheme
@@ -172,23 +242,16 @@ func (s *NSQQueueMux) pollForOutgoingMessages(handler *queue.QueueHandler) error
 		for {
 			select {
 			case <-handler.Done:
-				log.
+				handler.Logger().
 					WithField("topic", topic).
 					Info("nsq queue publisher shutting down")
 				break LOOP
 			case outgoing := <-handler.Outgoing:
-				var msg NSQMessage
-				opts, ok := options.PublishOptionsFromContext(outgoing.Context)
-				if ok {
-					if opts.CorrelationID != nil && *opts.CorrelationID != "" {
-						msg.CorrelationID = *opts.CorrelationID
-					}
-				}
-				msg.RawMessage = outgoing.Data
-				byt, err := json.Marshal(msg)
+				byt, err := encodeMessage(outgoing)
 				if err != nil {
-					log.
+					handler.MessageLogger(outgoing.Context).
 						WithField("topic", topic).
+						WithError(err).
 						Error("error marshaling json (nsq)")
 					outgoing.Err <- err
 					outgoing.Close()
@@ -196,8 +259,9 @@ func (s *NSQQueueMux) pollForOutgoingMessages(handler *queue.QueueHandler) error
 				}
 				err = producer.Publish(topic, byt)
 				if err != nil {
-					log.
+					handler.MessageLogger(outgoing.Context).
 						WithField("topic", topic).
+						WithError(err).
 						Error("error publishing to nsq")
 					outgoing.Err <- err
 					outgoing.Close()
@@ -9,8 +9,11 @@ import (
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/testcontainers/testcontainers-go"
+
+	"queue/queuetest"
 )
 
 type container struct {
@@ -82,3 +85,27 @@ func TestNSQQueueMux(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestNSQQueueMux_Conformance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	ctx := context.Background()
+
+	nsqC, err := setupNSQ(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nsqC.Terminate(ctx)
+
+	queuetest.RunConformance(t, queuetest.Factory{
+		URI: func(name string) string {
+			return fmt.Sprintf("nsqd://%s:%s/%s/conformance", nsqC.IP, nsqC.Port, name)
+		},
+		Queue: newNSQQueueMux(false).Queue,
+		// go-nsq requeues failed messages with a default delay of 90 seconds.
+		Timeout: 2 * time.Minute,
+		Settle:  5 * time.Second,
+	})
+}
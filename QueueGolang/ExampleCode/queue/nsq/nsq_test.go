@@ -0,0 +1,130 @@
+package nsq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"queue"
+	"queue/options"
+	"queue/signing"
+)
+
+func TestEncodeDecodeMessage(t *testing.T) {
+	payloads := map[string][]byte{
+		"pretty printed json": []byte("{\n  \"importJobId\": \"1\"\n}"),
+		"html characters":     []byte(`{"query":"a<b && b>c"}`),
+		"binary":              {0x1f, 0x8b, 0x00},
+	}
+	for _, signed := range []bool{false, true} {
+		for name, payload := range payloads {
+			t.Run(name, func(t *testing.T) {
+				received := make(chan []byte, 1)
+				q := queue.NewQueueHandler("nsqd://localhost:4150/topic/channel", 1).
+					AddHandler(func(ctx context.Context, data []byte) error {
+						received <- data
+						return nil
+					})
+				if signed {
+					q.SetSigner(signing.NewHMACSigner("key", []byte("secret"))).
+						SetVerifier(signing.NewKeys().AddHMACKey("key", []byte("secret")))
+				}
+				q.Start()
+				defer q.Close()
+				// Loop published messages back through the NSQ message encoding.
+				errs := make(chan error, 1)
+				go func() {
+					outgoing := <-q.Outgoing
+					defer outgoing.Close()
+					body, err := encodeMessage(outgoing)
+					if err != nil {
+						errs <- err
+						return
+					}
+					ctx, data, err := decodeMessage(body)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if options.CorrelationIDFromContext(ctx) != "order-1" {
+						t.Errorf("expected correlation ID order-1, got %s", options.CorrelationIDFromContext(ctx))
+					}
+					errs <- <-q.Receive(ctx, data)
+				}()
+				if err := q.Publish(payload, options.WithCorrelationID("order-1")); err != nil {
+					t.Fatal(err)
+				}
+				if err := <-errs; err != nil {
+					t.Fatalf("expected the message to be handled, got %v", err)
+				}
+				got := <-received
+				// Untransformed json payloads are compacted and escaped as they are published
+				// in RawMessage, other payloads are published byte for byte.
+				if !signed && json.Valid(payload) {
+					if !jsonEqual(t, got, payload) {
+						t.Errorf("expected json payload %s, got %s", payload, got)
+					}
+					return
+				}
+				if !bytes.Equal(got, payload) {
+					t.Errorf("expected payload %q byte for byte, got %q", payload, got)
+				}
+			})
+		}
+	}
+}
+
+// jsonEqual returns whether the json documents are equal once decoded.
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// previousNSQMessage is the NSQ message as decoded by earlier versions.
+type previousNSQMessage struct {
+	CorrelationID string
+	RawMessage    json.RawMessage
+}
+
+func TestEncodeMessage_PreviousVersion(t *testing.T) {
+	payload := []byte(`{"importJobId":"1","query":"a<b"}`)
+	ctx := options.ContextWithPublishOptions(context.Background(), options.Merge(
+		options.WithCorrelationID("order-1"),
+		options.WithHeader("source", "test"),
+	))
+	body, err := encodeMessage(queue.QueueMessage{Data: payload, Context: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Consumers running the previous version decode untransformed json payloads.
+	var m previousNSQMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.CorrelationID != "order-1" {
+		t.Errorf("expected correlation ID order-1, got %s", m.CorrelationID)
+	}
+	if !jsonEqual(t, m.RawMessage, payload) {
+		t.Errorf("expected the payload in RawMessage, got %s", m.RawMessage)
+	}
+}
+
+func TestDecodeMessage_RawMessage(t *testing.T) {
+	// Messages published by earlier versions hold json payloads in RawMessage.
+	_, data, err := decodeMessage([]byte(`{"CorrelationID":"order-1","RawMessage":{"importJobId":"1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"importJobId":"1"}` {
+		t.Errorf("expected the raw message payload, got %s", data)
+	}
+}
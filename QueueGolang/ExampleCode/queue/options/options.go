@@ -2,6 +2,7 @@ package options
 
 import (
 	"context"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/google/uuid"
@@ -9,6 +10,13 @@ import (
 
 type PublishOptions struct {
 	CorrelationID *string
+	// Headers are key value metadata carried alongside the message payload by the underlying queue.
+	Headers map[string]string
+	// Compression is the encoding used to compress the message payload, overriding the queue default.
+	// An empty encoding disables compression.
+	Compression *string
+	// Raw publishes the payload as is, without applying the payload transformations of the queue.
+	Raw bool
 }
 
 func WithCorrelationID(correlationID string) PublishOptions {
@@ -17,6 +25,38 @@ func WithCorrelationID(correlationID string) PublishOptions {
 	}
 }
 
+// WithHeader sets a header on the published message.
+func WithHeader(key, value string) PublishOptions {
+	return PublishOptions{
+		Headers: map[string]string{key: value},
+	}
+}
+
+// WithHeaders sets the headers on the published message.
+func WithHeaders(headers map[string]string) PublishOptions {
+	return PublishOptions{
+		Headers: headers,
+	}
+}
+
+// WithCompression compresses the published message using the provided encoding (see the
+// compression package), overriding the queue default. An empty encoding disables compression.
+func WithCompression(encoding string) PublishOptions {
+	return PublishOptions{
+		Compression: &encoding,
+	}
+}
+
+// WithRawPayload publishes the payload as is, without applying the compression, encryption,
+// signing or claim check configured on the queue. The headers describing the transformations
+// already applied to the payload must be published with it, e.g. when moving a message received
+// with QueueHandler.SetRawPayloads between queues.
+func WithRawPayload() PublishOptions {
+	return PublishOptions{
+		Raw: true,
+	}
+}
+
 func WithCorrelationIDFromContext(ctx context.Context) PublishOptions {
 	opts, _ := PublishOptionsFromContext(ctx)
 	return PublishOptions{
@@ -44,33 +84,84 @@ func CorrelationIDFromContext(ctx context.Context) string {
 	return aws.StringValue(opts.CorrelationID)
 }
 
+// HeadersFromContext returns the message headers carried by the context.
+func HeadersFromContext(ctx context.Context) map[string]string {
+	opts, _ := PublishOptionsFromContext(ctx)
+	return opts.Headers
+}
+
+// HeaderFromContext returns the value of a message header carried by the context, or an
+// empty string if it is not set.
+func HeaderFromContext(ctx context.Context, key string) string {
+	return HeadersFromContext(ctx)[key]
+}
+
 type deleteKey struct{}
 
 type deleteValue struct {
 	shouldDelete bool
+	isSet        bool
+}
+
+// ContextWithMessageDelete returns a copy of the parent context on which the message delete value
+// can be set by SetMessageDelete.
+func ContextWithMessageDelete(parent context.Context) context.Context {
+	return context.WithValue(parent, deleteKey{}, &deleteValue{})
 }
 
 // SetMessageDelete sets the message delete value on the message context. It will override any standard
 // message delete behaviour.
 func SetMessageDelete(parent context.Context, shouldDelete bool) {
-	val, isSet := parent.Value(deleteKey{}).(*deleteValue)
-	if isSet {
+	val, ok := parent.Value(deleteKey{}).(*deleteValue)
+	if ok {
 		val.shouldDelete = shouldDelete
+		val.isSet = true
 	}
 }
 
 // GetMessageDeleteValue returns the message delete value and whether it has been set.
 func GetMessageDeleteValue(ctx context.Context) (shouldDelete bool, isSet bool) {
-	val, isSet := ctx.Value(deleteKey{}).(*deleteValue)
-	if isSet {
-		return val.shouldDelete, isSet
+	val, ok := ctx.Value(deleteKey{}).(*deleteValue)
+	if ok {
+		return val.shouldDelete, val.isSet
 	}
 	return false, false
 }
 
-// NewMessageContext creates a new message context assigning a correlation ID.
+type messageIDKey struct{}
+
+// ContextWithMessageID returns a copy of the parent context carrying the ID assigned to the
+// message by the underlying queue.
+func ContextWithMessageID(parent context.Context, messageID string) context.Context {
+	return context.WithValue(parent, messageIDKey{}, messageID)
+}
+
+// MessageIDFromContext returns the ID assigned to the message by the underlying queue, or an
+// empty string if it has not been set.
+func MessageIDFromContext(ctx context.Context) string {
+	messageID, _ := ctx.Value(messageIDKey{}).(string)
+	return messageID
+}
+
+type sentTimeKey struct{}
+
+// ContextWithSentTime returns a copy of the parent context carrying the time the message was
+// sent to the underlying queue.
+func ContextWithSentTime(parent context.Context, sent time.Time) context.Context {
+	return context.WithValue(parent, sentTimeKey{}, sent)
+}
+
+// SentTimeFromContext returns the time the message was sent to the underlying queue, or the
+// zero time if it is not known.
+func SentTimeFromContext(ctx context.Context) time.Time {
+	sent, _ := ctx.Value(sentTimeKey{}).(time.Time)
+	return sent
+}
+
+// NewMessageContext creates a new message context assigning a correlation ID. The message delete
+// value can be set on the returned context.
 func NewMessageContext() context.Context {
-	return ContextWithPublishOptions(context.Background(), PublishOptions{
+	return ContextWithPublishOptions(ContextWithMessageDelete(context.Background()), PublishOptions{
 		CorrelationID: aws.String(uuid.NewString()),
 	})
 }
@@ -81,6 +172,18 @@ func Merge(opts ...PublishOptions) PublishOptions {
 		if opt.CorrelationID != nil {
 			p.CorrelationID = opt.CorrelationID
 		}
+		if opt.Compression != nil {
+			p.Compression = opt.Compression
+		}
+		if opt.Raw {
+			p.Raw = true
+		}
+		for k, v := range opt.Headers {
+			if p.Headers == nil {
+				p.Headers = make(map[string]string)
+			}
+			p.Headers[k] = v
+		}
 	}
 	return p
 }
@@ -23,3 +23,25 @@ func TestMerge(t *testing.T) {
 		t.Errorf("expected correlationID test, got %s", correlationID)
 	}
 }
+
+func TestHeaders(t *testing.T) {
+	ctx := ContextWithPublishOptions(NewMessageContext(), Merge(WithHeader("one", "1"), WithHeader("two", "2")))
+	ctx = ContextWithPublishOptions(ctx, WithHeader("two", "overridden"))
+	if got := HeaderFromContext(ctx, "one"); got != "1" {
+		t.Errorf("expected header one to be 1, got %s", got)
+	}
+	if got := HeaderFromContext(ctx, "two"); got != "overridden" {
+		t.Errorf("expected header two to be overridden, got %s", got)
+	}
+}
+
+func TestMessageDelete(t *testing.T) {
+	ctx := NewMessageContext()
+	if _, isSet := GetMessageDeleteValue(ctx); isSet {
+		t.Error("expected message delete value not to be set")
+	}
+	SetMessageDelete(ctx, true)
+	if shouldDelete, isSet := GetMessageDeleteValue(ctx); !shouldDelete || !isSet {
+		t.Errorf("expected message delete value to be set to true, got %v (set %v)", shouldDelete, isSet)
+	}
+}
@@ -0,0 +1,252 @@
+package queue
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"queue/claimcheck"
+	"queue/compression"
+	"queue/encryption"
+	"queue/options"
+	"queue/signing"
+)
+
+var messageVerificationFailure = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "queue_message_verification_failure_total",
+	Help: "The number of received messages rejected due to an invalid or missing signature.",
+}, []string{"uri"})
+
+// PayloadHeaders returns the headers describing the transformations applied to a payload when it
+// was published, i.e. compression, encryption, signing and claim checks. They are reversed before
+// handlers are called and applied again when a payload is published, so should not be copied
+// when a received message is published again.
+func PayloadHeaders() []string {
+	return []string{
+		claimcheck.Header,
+		claimcheck.DigestHeader,
+		compression.Header,
+		encryption.KeyIDHeader,
+		encryption.DataKeyHeader,
+		signing.KeyIDHeader,
+		signing.SignatureHeader,
+	}
+}
+
+// SetClaimCheck sets the Store used to offload payloads larger than the threshold (in bytes).
+// Offloaded payloads are replaced by a reference when published and rehydrated before the
+// handlers are called. They are not deleted once handled, as a message may be delivered to
+// several consumers, e.g. the channels of an nsq topic, so the Store should expire them, e.g.
+// with a bucket lifecycle rule, after the retention period of the queue. A threshold of zero or less uses claimcheck.DefaultThreshold. It returns the
+// QueueHandler for chaining.
+func (q *QueueHandler) SetClaimCheck(store claimcheck.Store, threshold int) *QueueHandler {
+	if threshold <= 0 {
+		threshold = claimcheck.DefaultThreshold
+	}
+	q.claimCheckStore = store
+	q.claimCheckThreshold = threshold
+	return q
+}
+
+// SetCompression sets the default encoding used to compress published payloads, which can be
+// overridden per message using options.WithCompression. Received payloads are decompressed
+// according to their content encoding header regardless of the default, allowing compressed and
+// uncompressed messages to coexist. It returns the QueueHandler for chaining.
+func (q *QueueHandler) SetCompression(encoding string) *QueueHandler {
+	q.compression = encoding
+	return q
+}
+
+// SetMaxDecompressedSize sets the maximum size of a received payload once decompressed, larger
+// payloads fail to be handled. It defaults to compression.DefaultMaxSize. It returns the
+// QueueHandler for chaining.
+func (q *QueueHandler) SetMaxDecompressedSize(maxSize int64) *QueueHandler {
+	q.maxDecompressedSize = maxSize
+	return q
+}
+
+// SetRawPayloads sets whether received payloads are passed to the handlers as received, without
+// reversing their claim check, signing, encryption or compression, leaving the headers describing
+// them in the message context. It is used to move messages between queues byte for byte, see
+// options.WithRawPayload. It returns the QueueHandler for chaining.
+func (q *QueueHandler) SetRawPayloads(raw bool) *QueueHandler {
+	q.rawPayloads = raw
+	return q
+}
+
+// SetEncryption sets the KeyProvider used to encrypt published payloads and decrypt received
+// payloads. Received payloads without encryption headers are passed to the handlers as is,
+// allowing encryption to be rolled out without draining queues. It returns the QueueHandler
+// for chaining.
+func (q *QueueHandler) SetEncryption(provider encryption.KeyProvider) *QueueHandler {
+	q.keyProvider = provider
+	return q
+}
+
+// SetSigner sets the Signer used to sign the payload, headers and correlation ID of published
+// messages. It returns the QueueHandler for chaining.
+func (q *QueueHandler) SetSigner(signer signing.Signer) *QueueHandler {
+	q.signer = signer
+	return q
+}
+
+// SetVerifier sets the Verifier used to verify the signature of received messages. Messages
+// that are unsigned or fail verification are rejected as permanent failures, they are deleted
+// from the underlying queue without being handled. It returns the QueueHandler for chaining.
+func (q *QueueHandler) SetVerifier(verifier signing.Verifier) *QueueHandler {
+	q.verifier = verifier
+	return q
+}
+
+// encodePayload applies the configured payload transformations to a message before it is
+// published. It returns the message context updated with any headers required to reverse them.
+func (q *QueueHandler) encodePayload(ctx context.Context, data []byte) (context.Context, []byte, error) {
+	opts, _ := options.PublishOptionsFromContext(ctx)
+	if opts.Raw {
+		return ctx, data, nil
+	}
+	encoding := q.compression
+	if opts.Compression != nil {
+		encoding = *opts.Compression
+	}
+	if encoding != "" {
+		var err error
+		data, err = compression.Compress(encoding, data)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("compressing payload: %w", err)
+		}
+		ctx = options.ContextWithPublishOptions(ctx, options.WithHeader(compression.Header, encoding))
+	}
+	if q.keyProvider != nil {
+		var headers map[string]string
+		var err error
+		data, headers, err = encryption.Encrypt(ctx, q.keyProvider, data)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("encrypting payload: %w", err)
+		}
+		ctx = options.ContextWithPublishOptions(ctx, options.WithHeaders(headers))
+	}
+	// Payloads are offloaded before they are signed, so the signature covers the claim check key
+	// and digest and is verified before the payload is retrieved.
+	if q.claimCheckStore != nil && len(data) > q.claimCheckThreshold {
+		key := uuid.NewString()
+		err := q.claimCheckStore.Put(ctx, key, data)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("storing claim check payload: %w", err)
+		}
+		ctx = options.ContextWithPublishOptions(ctx, options.Merge(
+			options.WithHeader(claimcheck.Header, key),
+			options.WithHeader(claimcheck.DigestHeader, claimcheck.Digest(data)),
+		))
+		data = []byte(key)
+	}
+	if q.signer != nil {
+		keyID, signature, err := q.signer.Sign(signing.Message(options.CorrelationIDFromContext(ctx), options.HeadersFromContext(ctx), data))
+		if err != nil {
+			q.discardPayload(ctx)
+			return ctx, nil, fmt.Errorf("signing message: %w", err)
+		}
+		ctx = options.ContextWithPublishOptions(ctx, options.Merge(
+			options.WithHeader(signing.KeyIDHeader, keyID),
+			options.WithHeader(signing.SignatureHeader, base64.StdEncoding.EncodeToString(signature)),
+		))
+	}
+	return ctx, data, nil
+}
+
+// decodePayload reverses the payload transformations applied by encodePayload using the headers
+// carried by the message context.
+func (q *QueueHandler) decodePayload(ctx context.Context, data []byte) (context.Context, []byte, error) {
+	if q.rawPayloads {
+		return ctx, data, nil
+	}
+	// Messages are verified before an offloaded payload is retrieved, so only the claim checks
+	// of verified messages are retrieved.
+	if q.verifier != nil {
+		err := q.verify(ctx, data)
+		if err != nil {
+			messageVerificationFailure.WithLabelValues(q.URI()).Inc()
+			// Unverifiable messages will never succeed so should not be retried.
+			options.SetMessageDelete(ctx, true)
+			return ctx, nil, fmt.Errorf("verifying message: %w", err)
+		}
+	}
+	if key := options.HeaderFromContext(ctx, claimcheck.Header); key != "" {
+		var err error
+		data, err = q.retrieveClaimCheck(ctx, key)
+		if err != nil {
+			return ctx, nil, err
+		}
+	}
+	if headers := options.HeadersFromContext(ctx); encryption.IsEncrypted(headers) {
+		if q.keyProvider == nil {
+			return ctx, nil, errors.New("no key provider to decrypt payload")
+		}
+		var err error
+		data, err = encryption.Decrypt(ctx, q.keyProvider, headers, data)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("decrypting payload: %w", err)
+		}
+	}
+	if encoding := options.HeaderFromContext(ctx, compression.Header); encoding != "" {
+		var err error
+		maxSize := q.maxDecompressedSize
+		if maxSize == 0 {
+			maxSize = compression.DefaultMaxSize
+		}
+		data, err = compression.DecompressLimit(encoding, data, maxSize)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("decompressing payload: %w", err)
+		}
+	}
+	return ctx, data, nil
+}
+
+// retrieveClaimCheck returns the offloaded payload with the key, checking it matches the digest
+// the message was published with.
+func (q *QueueHandler) retrieveClaimCheck(ctx context.Context, key string) ([]byte, error) {
+	if q.claimCheckStore == nil {
+		return nil, fmt.Errorf("no claim check store to retrieve payload %s", key)
+	}
+	data, err := q.claimCheckStore.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving claim check payload: %w", err)
+	}
+	if claimcheck.Digest(data) != options.HeaderFromContext(ctx, claimcheck.DigestHeader) {
+		return nil, fmt.Errorf("claim check payload %s does not match its digest", key)
+	}
+	return data, nil
+}
+
+// verify verifies the signature of a received message. Offloaded payloads are signed after they
+// are offloaded, so the signature covers the claim check key and the digest of the payload.
+func (q *QueueHandler) verify(ctx context.Context, data []byte) error {
+	headers := options.HeadersFromContext(ctx)
+	if headers[signing.SignatureHeader] == "" {
+		return signing.ErrUnsigned
+	}
+	signature, err := base64.StdEncoding.DecodeString(headers[signing.SignatureHeader])
+	if err != nil {
+		return signing.ErrInvalidSignature
+	}
+	return q.verifier.Verify(headers[signing.KeyIDHeader], signing.Message(options.CorrelationIDFromContext(ctx), headers, data), signature)
+}
+
+// discardPayload removes any state created by encodePayload for a message that failed to publish.
+func (q *QueueHandler) discardPayload(ctx context.Context) {
+	key := options.HeaderFromContext(ctx, claimcheck.Header)
+	// Raw payloads reference the claim check payload of the message they were received as.
+	opts, _ := options.PublishOptionsFromContext(ctx)
+	if key == "" || q.claimCheckStore == nil || opts.Raw {
+		return
+	}
+	err := q.claimCheckStore.Delete(ctx, key)
+	if err != nil {
+		q.MessageLogger(ctx).WithError(err).Warn("deleting claim check payload")
+	}
+}
@@ -0,0 +1,290 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"queue/claimcheck"
+	"queue/compression"
+	"queue/options"
+	"queue/signing"
+)
+
+// loopback delivers messages published on the QueueHandler back to it, as an underlying
+// queue implementation would.
+func loopback(q *QueueHandler) {
+	go func() {
+		for {
+			select {
+			case <-q.Done:
+				return
+			case outgoing := <-q.Outgoing:
+				ctx := options.ContextWithPublishOptions(context.Background(), options.PublishOptions{
+					CorrelationID: aws.String(options.CorrelationIDFromContext(outgoing.Context)),
+					Headers:       options.HeadersFromContext(outgoing.Context),
+				})
+				outgoing.Close()
+				<-q.Receive(ctx, outgoing.Data)
+			}
+		}
+	}()
+}
+
+func TestQueueHandler_ClaimCheck(t *testing.T) {
+	dir := t.TempDir()
+	store, err := claimcheck.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte, 2)
+	q := NewQueueHandler("test://claimcheck", 1).
+		SetClaimCheck(store, 8).
+		AddHandler(func(ctx context.Context, data []byte) error {
+			received <- data
+			return nil
+		})
+	q.Start()
+	loopback(q)
+	defer q.Close()
+
+	for _, payload := range [][]byte{[]byte("small"), []byte("larger than threshold")} {
+		if err := q.Publish(payload); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-received; !bytes.Equal(got, payload) {
+			t.Errorf("expected payload %s, got %s", payload, got)
+		}
+	}
+
+	// The offloaded payload is kept once handled, as other consumers of the message may still
+	// retrieve it.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected the claim check payload to be kept, found %d", len(entries))
+	}
+}
+
+func TestQueueHandler_ClaimCheckPublishFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []options.PublishOptions
+		// The number of payloads left in the store after the publish fails, the existing
+		// payload is always kept.
+		want int
+	}{
+		// The payload offloaded by the failed publish is deleted.
+		{"offloaded", nil, 1},
+		// A raw payload references the payload of the message it was received as.
+		{"raw", []options.PublishOptions{options.WithRawPayload(), options.WithHeader(claimcheck.Header, "existing")}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := claimcheck.NewFileStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Put(context.Background(), "existing", []byte("larger than threshold")); err != nil {
+				t.Fatal(err)
+			}
+			q := NewQueueHandler("test://claimcheck", 1).SetClaimCheck(store, 8)
+			defer q.Close()
+			go func() {
+				outgoing := <-q.Outgoing
+				outgoing.Err <- errors.New("unavailable")
+				outgoing.Close()
+			}()
+			if err := q.Publish([]byte("larger than threshold"), tt.opts...); err == nil {
+				t.Fatal("expected the publish to fail")
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.want {
+				t.Errorf("expected %d claim check payloads, found %d", tt.want, len(entries))
+			}
+		})
+	}
+}
+
+func TestQueueHandler_ClaimCheckMissingStore(t *testing.T) {
+	q := NewQueueHandler("test://claimcheck", 1).
+		AddHandler(func(ctx context.Context, data []byte) error {
+			return nil
+		})
+	ctx := options.ContextWithPublishOptions(context.Background(), options.WithHeader(claimcheck.Header, "key"))
+	if err := <-q.Receive(ctx, []byte("key")); err == nil {
+		t.Error("expected error receiving claim check without a store")
+	}
+
+	store, err := claimcheck.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.SetClaimCheck(store, 0)
+	if err := <-q.Receive(ctx, []byte("key")); !errors.Is(err, claimcheck.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestQueueHandler_Compression(t *testing.T) {
+	received := make(chan []byte, 1)
+	q := NewQueueHandler("test://compression", 1).
+		SetCompression(compression.Gzip).
+		AddHandler(func(ctx context.Context, data []byte) error {
+			received <- data
+			return nil
+		})
+	q.Start()
+	loopback(q)
+	defer q.Close()
+
+	payload := []byte(`{"measurement":"value"}`)
+	for _, opts := range [][]options.PublishOptions{
+		nil,
+		{options.WithCompression(compression.Zstd)},
+		{options.WithCompression("")},
+	} {
+		if err := q.Publish(payload, opts...); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-received; !bytes.Equal(got, payload) {
+			t.Errorf("expected payload %s, got %s", payload, got)
+		}
+	}
+}
+
+func TestQueueHandler_MaxDecompressedSize(t *testing.T) {
+	q := NewQueueHandler("test://decompression", 1).
+		SetMaxDecompressedSize(8).
+		AddHandler(func(ctx context.Context, data []byte) error {
+			return nil
+		})
+	q.Start()
+	defer q.Close()
+
+	compressed, err := compression.Compress(compression.Gzip, []byte(`{"measurement":"value"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := options.ContextWithPublishOptions(options.NewMessageContext(), options.WithHeader(compression.Header, compression.Gzip))
+	if err := <-q.Receive(ctx, compressed); !errors.Is(err, compression.ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestQueueHandler_Signing(t *testing.T) {
+	received := make(chan []byte, 1)
+	q := NewQueueHandler("test://signing", 1).
+		SetSigner(signing.NewHMACSigner("key", []byte("secret"))).
+		SetVerifier(signing.NewKeys().AddHMACKey("key", []byte("secret"))).
+		AddHandler(func(ctx context.Context, data []byte) error {
+			received <- data
+			return nil
+		})
+	q.Start()
+	loopback(q)
+	defer q.Close()
+
+	payload := []byte(`{"importJobId":"1"}`)
+	if err := q.Publish(payload, options.WithHeader("source", "test")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; !bytes.Equal(got, payload) {
+		t.Errorf("expected payload %s, got %s", payload, got)
+	}
+
+	// A forged, unsigned, message is rejected and marked for deletion.
+	ctx := options.NewMessageContext()
+	if err := <-q.Receive(ctx, payload); !errors.Is(err, signing.ErrUnsigned) {
+		t.Errorf("expected ErrUnsigned, got %v", err)
+	}
+	if shouldDelete, isSet := options.GetMessageDeleteValue(ctx); !shouldDelete || !isSet {
+		t.Error("expected unverifiable message to be marked for deletion")
+	}
+}
+
+// countingStore is a claimcheck.Store recording the number of payloads retrieved.
+type countingStore struct {
+	*claimcheck.FileStore
+	gets int32
+}
+
+func (c *countingStore) Get(ctx context.Context, key string) ([]byte, error) {
+	atomic.AddInt32(&c.gets, 1)
+	return c.FileStore.Get(ctx, key)
+}
+
+func TestQueueHandler_SigningClaimCheck(t *testing.T) {
+	fileStore, err := claimcheck.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countingStore{FileStore: fileStore}
+	q := NewQueueHandler("test://signing", 1).
+		SetClaimCheck(store, 8).
+		SetSigner(signing.NewHMACSigner("key", []byte("secret"))).
+		SetVerifier(signing.NewKeys().AddHMACKey("key", []byte("secret"))).
+		AddHandler(func(ctx context.Context, data []byte) error {
+			return nil
+		})
+	q.Start()
+	defer q.Close()
+
+	payload := []byte("larger than threshold")
+	published, data, err := q.encodePayload(options.NewMessageContext(), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// receive delivers the published message with the header changed.
+	receive := func(header, value string) error {
+		headers := map[string]string{header: value}
+		for k, v := range options.HeadersFromContext(published) {
+			if k != header {
+				headers[k] = v
+			}
+		}
+		ctx := options.ContextWithPublishOptions(context.Background(), options.Merge(
+			options.WithCorrelationID(options.CorrelationIDFromContext(published)),
+			options.WithHeaders(headers),
+		))
+		return <-q.Receive(ctx, data)
+	}
+
+	// Messages are verified before their claim check is retrieved.
+	if err := receive(claimcheck.Header, "other"); !errors.Is(err, signing.ErrInvalidSignature) {
+		t.Errorf("expected ErrInvalidSignature, got %v", err)
+	}
+	if err := receive(signing.SignatureHeader, ""); !errors.Is(err, signing.ErrUnsigned) {
+		t.Errorf("expected ErrUnsigned, got %v", err)
+	}
+	if gets := atomic.LoadInt32(&store.gets); gets != 0 {
+		t.Errorf("expected no claim checks to be retrieved for unverified messages, got %d", gets)
+	}
+
+	// The retrieved payload must match the signed digest.
+	key := options.HeaderFromContext(published, claimcheck.Header)
+	if err := receive("source", "test"); err == nil {
+		t.Error("expected a message with a changed header to fail verification")
+	}
+	if err := receive(claimcheck.Header, key); err != nil {
+		t.Errorf("expected the published message to be handled, got %v", err)
+	}
+	if err := store.Put(context.Background(), key, []byte("replaced payload")); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(claimcheck.Header, key); err == nil || !strings.Contains(err.Error(), "does not match its digest") {
+		t.Errorf("expected a replaced claim check payload to be rejected, got %v", err)
+	}
+}
@@ -4,14 +4,28 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/url"
+	"reflect"
+	"sync"
 	"time"
 
-	"github.com/apex/log"
+	"queue/claimcheck"
+	"queue/codec"
+	"queue/encryption"
+	"queue/schema"
+	"queue/signing"
 )
 
+// ErrorReasonHeader is the message header recording why a message was moved to a dead letter
+// queue. It is only set by the mem queue implementation, other queue implementations dead letter
+// messages using the broker, e.g. an SQS redrive policy, which cannot add headers.
+const ErrorReasonHeader = "error_reason"
+
 var (
-	errNoHandlers = errors.New("no handlers")
+	// ErrClosed is returned when the QueueHandler has been closed.
+	ErrClosed = errors.New("queue handler closed")
+	// ErrNoHandlers is returned when a message is received by a QueueHandler without handlers.
+	ErrNoHandlers = errors.New("no handlers")
+
 	queueRegistry = make(map[string]QueueMux)
 )
 
@@ -25,15 +39,16 @@ func Register(scheme string, queueMux QueueMux) {
 // Queue returns a QueueHandler for the provided URI or an error
 // if the URI is invalid / unsupported.
 func Queue(uri string) (*QueueHandler, error) {
-	u, err := url.Parse(uri)
+	mux, err := queueMux(uri)
 	if err != nil {
 		return nil, err
 	}
-	mux, ok := queueRegistry[u.Scheme]
-	if !ok {
-		return nil, fmt.Errorf("queue mux with scheme %s not found", u.Scheme)
+	q, err := mux.Queue(uri)
+	if err != nil {
+		return nil, err
 	}
-	return mux.Queue(uri)
+	addQueue(q)
+	return q, nil
 }
 
 // QueueMux is an interface to an underlying queue implementation.
@@ -46,12 +61,16 @@ type QueueMux interface {
 // NewQueueHandler returns a new QueueHandler for the provided URI with the
 // provided buffer size on the in and Outgoing channels.
 func NewQueueHandler(uri string, buffer int) *QueueHandler {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &QueueHandler{
+		ctx:      ctx,
+		cancel:   cancel,
 		uri:      uri,
 		in:       make(chan QueueMessage, buffer),
 		Outgoing: make(chan QueueMessage, buffer),
 		Done:     make(chan bool),
 		Ready:    make(chan bool, 1),
+		logger:   uriLogger(uri),
 	}
 }
 
@@ -79,6 +98,9 @@ func (q QueueMessage) Close() {
 // with the underlying queue implementation. QueueHandler supports
 // buffering of incoming and outgoing messages via channels.
 type QueueHandler struct {
+	// ctx is cancelled when the queue handler is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
 	// The uri of the underlying message queue, where the uri scheme identifies the queue type (i.e. SQS etc.).
 	uri string
 	// Incoming message from the underlying queue are buffered using this channel. Consumers receive on this
@@ -95,6 +117,47 @@ type QueueHandler struct {
 	handlers []func(ctx context.Context, data []byte) error
 	// Message Visibility Period
 	Visibility time.Duration
+	// The logger used by the queue handler and the underlying queue implementation, guarded by
+	// loggerMtx as queue implementations log from their own goroutines.
+	loggerMtx sync.RWMutex
+	logger    Logger
+	// Limits the rate at which messages are consumed from the underlying queue.
+	rateLimiter *RateLimiter
+	// Stops messages being consumed from the underlying queue when handlers fail at a sustained rate.
+	circuitBreaker *CircuitBreaker
+	// Guards the consumption state of the queue handler.
+	stateMtx sync.Mutex
+	// Whether Start has been called.
+	started bool
+	// Non-nil while consumption is paused, closed on resume.
+	resumed chan struct{}
+	// Funcs called when the consumption state changes.
+	stateListeners []func(from, to State)
+	// Store used to offload payloads larger than the claim check threshold.
+	claimCheckStore     claimcheck.Store
+	claimCheckThreshold int
+	// Default encoding used to compress published payloads, and the maximum size of received
+	// payloads once decompressed.
+	compression         string
+	maxDecompressedSize int64
+	// Whether received payloads are passed to the handlers without being decoded.
+	rawPayloads bool
+	// Provides the keys used to encrypt and decrypt payloads.
+	keyProvider encryption.KeyProvider
+	// Signs published messages and verifies the signature of received messages.
+	signer   signing.Signer
+	verifier signing.Verifier
+	// Default codec used to marshal published messages and per message type overrides.
+	codec         codec.Codec
+	messageCodecs map[reflect.Type]codec.Codec
+	// Validates published and received messages against the JSON Schema of their type.
+	validator *schema.Validator
+	// Guards the message types handled and published using the typed APIs.
+	typesMtx       sync.Mutex
+	handledTypes   []reflect.Type
+	publishedTypes []reflect.Type
+	// Observes the messages received and published, e.g. to record them.
+	tap Tap
 }
 
 // URI returns the queues URI.
@@ -102,12 +165,36 @@ func (q *QueueHandler) URI() string {
 	return q.uri
 }
 
+// Logger returns the queue's Logger, enriched with the queue URI.
+func (q *QueueHandler) Logger() Logger {
+	q.loggerMtx.RLock()
+	defer q.loggerMtx.RUnlock()
+	return q.logger.WithField(LogFieldURI, q.uri)
+}
+
+// SetLogger sets the Logger used by the queue handler and the underlying queue implementation.
+// Lines logged by the queue implementation before the call use the Logger of the QueueMux, see
+// SetMuxLogger. It returns the QueueHandler for chaining.
+func (q *QueueHandler) SetLogger(l Logger) *QueueHandler {
+	q.loggerMtx.Lock()
+	defer q.loggerMtx.Unlock()
+	q.logger = l
+	return q
+}
+
 // Receive is called by queue implementations to queue a message on the in channel for handling by the queue handlers.
 // It returns a chan Error that is used by the handlers to propagate any errors during processing.
 func (q *QueueHandler) Receive(ctx context.Context, data []byte) chan error {
 	if len(q.handlers) == 0 {
 		errCh := make(chan error, 1)
-		errCh <- errNoHandlers
+		errCh <- ErrNoHandlers
+		return errCh
+	}
+	ctx, data, err := q.decodePayload(ctx, data)
+	if err != nil {
+		q.MessageLogger(ctx).WithError(err).Error("decoding message payload")
+		errCh := make(chan error, 1)
+		errCh <- err
 		return errCh
 	}
 	msg := QueueMessage{
@@ -121,9 +208,60 @@ func (q *QueueHandler) Receive(ctx context.Context, data []byte) chan error {
 
 // Close closes the Done channel indicating that the queue should shutdown.
 func (q *QueueHandler) Close() {
+	removeQueue(q)
+	q.setState(q.cancel)
 	close(q.Done)
 }
 
+// closedErr returns ErrClosed if the QueueHandler has been closed.
+func (q *QueueHandler) closedErr() error {
+	if q.ctx.Err() != nil {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Wait is called by queue implementations before consuming a message from the underlying
+// queue. It blocks until the QueueHandler is permitted to consume another message, i.e. while
+// it is paused, the circuit breaker is open or the rate limit is exceeded, and returns ErrClosed
+// if the QueueHandler is closed while waiting.
+func (q *QueueHandler) Wait() error {
+	if err := q.waitUntilResumed(q.ctx); err != nil {
+		return q.waitErr(err)
+	}
+	if q.circuitBreaker != nil {
+		if err := q.circuitBreaker.Wait(q.ctx); err != nil {
+			return q.waitErr(err)
+		}
+	}
+	if q.rateLimiter != nil {
+		if err := q.rateLimiter.Wait(q.ctx); err != nil {
+			return q.waitErr(err)
+		}
+	}
+	return q.closedErr()
+}
+
+// Blocked returns whether Wait would block until consumption is resumed, i.e. while the
+// QueueHandler is paused or the circuit breaker is open. Queue implementations receiving
+// messages in batches use it to release the rest of a batch rather than holding it while
+// waiting.
+func (q *QueueHandler) Blocked() bool {
+	if q.State() == StatePaused {
+		return true
+	}
+	return q.circuitBreaker != nil && q.circuitBreaker.State() == CircuitOpen
+}
+
+// waitErr returns ErrClosed if waiting failed due to the QueueHandler being closed, otherwise
+// the provided error.
+func (q *QueueHandler) waitErr(err error) error {
+	if closedErr := q.closedErr(); closedErr != nil {
+		return closedErr
+	}
+	return err
+}
+
 // AddHandler adds a handler func to the slice of handlers. It returns the QueueHandler for chaining.
 func (q *QueueHandler) AddHandler(handler func(ctx context.Context, data []byte) error) *QueueHandler {
 	q.handlers = append(q.handlers, handler)
@@ -133,19 +271,29 @@ func (q *QueueHandler) AddHandler(handler func(ctx context.Context, data []byte)
 // Publish sends a message to the Outgoing channel to queue the message for publishing by the
 // underlying queue implementation.
 func (q *QueueHandler) Publish(data []byte, opts ...options.PublishOptions) error {
+	msgCtx := options.ContextWithPublishOptions(options.NewMessageContext(), options.Merge(opts...))
+	ctx, encoded, err := q.encodePayload(msgCtx, data)
+	if err != nil {
+		metrics.MessagePublishError.WithLabelValues(q.URI()).Inc()
+		return err
+	}
 	errCh := make(chan error, 1)
 	m := QueueMessage{
-		Data:    data,
+		Data:    encoded,
 		Err:     errCh,
-		Context: options.ContextWithPublishOptions(options.NewMessageContext(), options.Merge(opts...)),
+		Context: ctx,
 	}
 	q.Outgoing <- m
-	err := <-errCh
+	err = <-errCh
 	if err != nil {
+		q.discardPayload(ctx)
 		metrics.MessagePublishError.WithLabelValues(q.URI()).Inc()
 		return err
 	}
 	metrics.MessagePublishSuccess.WithLabelValues(q.URI()).Inc()
+	if q.tap != nil {
+		q.tap.Published(msgCtx, q.URI(), data)
+	}
 	return nil
 }
 
@@ -153,39 +301,84 @@ func (q *QueueHandler) Publish(data []byte, opts ...options.PublishOptions) erro
 // after the setup of handlers to begin consuming messages. It does not need to be called if the queue
 // is only being used as a producer (i.e. for publishing).
 func (q *QueueHandler) Start() {
+	q.setState(func() {
+		q.started = true
+	})
 	q.Ready <- true
 	go func() {
+	LOOP:
 		for {
 			select {
 			case msg := <-q.in:
-				for i, handler := range q.handlers {
-					tStart := time.Now()
-					err := handler(msg.Context, msg.Data)
+				q.callHandlers(msg.Context, msg.Data, func(err error) {
 					if err != nil {
-						metrics.MessageProcessedError.WithLabelValues(q.URI(), fmt.Sprint(i)).Inc()
-						log.WithField("uri", q.uri).WithError(err).Error("handling message")
 						msg.Err <- err
 					} else {
 						close(msg.Err)
-						metrics.MessageProcessedSuccess.WithLabelValues(q.URI(), fmt.Sprint(i)).Inc()
 					}
-					metrics.MessageProcessTime.WithLabelValues(q.URI()).Observe(float64(time.Since(tStart).Milliseconds()))
-				}
+				})
 			case <-q.Done:
-				log.WithField("uri", q.uri).Info("queue handler shutting down")
-				break
+				q.Logger().Info("queue handler shutting down")
+				break LOOP
 			}
 		}
 	}()
 }
 
-//go:generate gen -src code.avct.cloud/attention-measurement-platform/internal/queue/template -replace MessageType=DeduplicationMessage -exclude QueueHandler,MessageType
+// Handle decodes the payload and calls the handlers synchronously, bypassing the underlying
+// queue, and returns the last handler error. It is used to deliver messages directly to the
+// handlers, e.g. in tests, and does not require Start to be called.
+func (q *QueueHandler) Handle(ctx context.Context, data []byte) error {
+	if len(q.handlers) == 0 {
+		return ErrNoHandlers
+	}
+	ctx, data, err := q.decodePayload(ctx, data)
+	if err != nil {
+		q.MessageLogger(ctx).WithError(err).Error("decoding message payload")
+		return err
+	}
+	return q.callHandlers(ctx, data, nil)
+}
+
+// callHandlers calls the handlers with a message, passing the outcome of each handler to the
+// result func if it is not nil, and returns the last handler error.
+func (q *QueueHandler) callHandlers(msgCtx context.Context, data []byte, result func(err error)) error {
+	logger := q.MessageLogger(msgCtx)
+	ctx := ContextWithLogger(msgCtx, logger)
+	if q.tap != nil {
+		q.tap.Received(ctx, q.URI(), data)
+	}
+	var msgErr error
+	for i, handler := range q.handlers {
+		tStart := time.Now()
+		err := handler(ctx, data)
+		if err != nil {
+			metrics.MessageProcessedError.WithLabelValues(q.URI(), fmt.Sprint(i)).Inc()
+			logger.WithError(err).Error("handling message")
+			msgErr = err
+		} else {
+			metrics.MessageProcessedSuccess.WithLabelValues(q.URI(), fmt.Sprint(i)).Inc()
+		}
+		if result != nil {
+			result(err)
+		}
+		metrics.MessageProcessTime.WithLabelValues(q.URI()).Observe(float64(time.Since(tStart).Milliseconds()))
+	}
+	if q.circuitBreaker != nil {
+		q.circuitBreaker.Record(msgErr)
+	}
+	return msgErr
+}
+
+//go:generate go run ./cmd/queuegen
+
+//queue:message
 type DeduplicationMessage struct {
 	InputURI string `json:"inputUri"`
 	Account  account.Account
 }
 
-//go:generate gen -src code.avct.cloud/attention-measurement-platform/internal/queue/template -replace MessageType=EmailMessage -exclude QueueHandler,MessageType
+//queue:message
 type EmailMessage struct {
 	ID   string `json:"id"`
 	Url  string `json:"url"`
@@ -202,10 +395,10 @@ type ImportJobDetails struct {
 	JobType     string
 }
 
-//go:generate gen -src code.avct.cloud/attention-measurement-platform/internal/queue/template -replace MessageType=Measurement -exclude QueueHandler,MessageType
+//queue:message
 type Measurement = events.Measurement
 
-//go:generate gen -src code.avct.cloud/attention-measurement-platform/internal/queue/template -replace MessageType=LumenScriptJobMessage -exclude QueueHandler,MessageType
+//queue:message
 type LumenScriptJobMessage struct {
 	ScriptURI        string
 	ModelURI         string
@@ -214,7 +407,7 @@ type LumenScriptJobMessage struct {
 	ImportJob        api.ImportJob
 }
 
-//go:generate gen -src code.avct.cloud/attention-measurement-platform/internal/queue/template -replace MessageType=BigQueryUploadMessage -exclude QueueHandler,MessageType
+//queue:message
 type BigQueryUploadMessage struct {
 	InputURI           string
 	DestinationDataset string
@@ -222,19 +415,19 @@ type BigQueryUploadMessage struct {
 	ImportJob          api.ImportJob
 }
 
-//go:generate gen -src code.avct.cloud/attention-measurement-platform/internal/queue/template -replace MessageType=DV360ImportMessage -exclude QueueHandler,MessageType
+//queue:message
 type DV360ImportMessage struct {
 	InputURI  string
 	ImportJob api.ImportJob
 }
 
-//go:generate gen -src code.avct.cloud/attention-measurement-platform/internal/queue/template -replace MessageType=ImportJobRunMessage -exclude QueueHandler,MessageType
+//queue:message
 type ImportJobRunMessage struct {
 	ImportJobID  string
 	ImportJobRun importjob.ImportJobRun
 }
 
-//go:generate gen -src code.avct.cloud/attention-measurement-platform/internal/queue/template -replace MessageType=MediaGridActivation -exclude QueueHandler,MessageType
+//queue:message
 type MediaGridActivation struct {
 	Activation activation.Activation
 }
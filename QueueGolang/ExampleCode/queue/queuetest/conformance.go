@@ -0,0 +1,307 @@
+package queuetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"queue"
+	"queue/options"
+)
+
+// DefaultConformanceTimeout is the default time the conformance suite waits for a message to be
+// received or redelivered.
+const DefaultConformanceTimeout = 5 * time.Second
+
+// Factory opens the queues tested by the conformance suite.
+type Factory struct {
+	// URI returns the URI of an empty queue for the name, which is unique to each test and made
+	// up of lowercase letters, digits and hyphens. QueueHandlers opened with the same URI must
+	// consume the same messages.
+	URI func(name string) string
+	// Queue opens a QueueHandler for the URI. It defaults to queue.Queue.
+	Queue func(uri string) (*queue.QueueHandler, error)
+	// Timeout is the time to wait for a message to be received, including a message that
+	// failed to be redelivered. It defaults to DefaultConformanceTimeout.
+	Timeout time.Duration
+	// Settle is the time to wait to verify that a message is not redelivered, which should be
+	// longer than the backend takes to redeliver a failed message. It defaults to a fifth of
+	// the Timeout.
+	Settle time.Duration
+}
+
+var conformanceQueues int64
+
+// RunConformance runs the conformance suite that every QueueMux should pass against the queues
+// opened by the factory. It verifies publish and receive round trips, correlation ID and header
+// propagation, redelivery of failed messages, message delete overrides, shutdown and concurrent
+// publishers and consumers.
+func RunConformance(t *testing.T, f Factory) {
+	if f.Queue == nil {
+		f.Queue = queue.Queue
+	}
+	if f.Timeout <= 0 {
+		f.Timeout = DefaultConformanceTimeout
+	}
+	if f.Settle <= 0 {
+		f.Settle = f.Timeout / 5
+	}
+	c := conformance{f}
+	t.Run("RoundTrip", c.roundTrip)
+	t.Run("CorrelationID", c.correlationID)
+	t.Run("RedeliveryOnError", c.redeliveryOnError)
+	t.Run("DeleteOverride", c.deleteOverride)
+	t.Run("RetainOverride", c.retainOverride)
+	t.Run("Shutdown", c.shutdown)
+	t.Run("Concurrency", c.concurrency)
+}
+
+type conformance struct {
+	Factory
+}
+
+// delivery is a message received by a handler.
+type delivery struct {
+	data          []byte
+	correlationID string
+	messageID     string
+	headers       map[string]string
+}
+
+// uri returns the URI of a new queue.
+func (c conformance) uri() string {
+	return c.URI(fmt.Sprintf("conformance-%d", atomic.AddInt64(&conformanceQueues, 1)))
+}
+
+// open opens a QueueHandler that is closed when the test completes.
+func (c conformance) open(t *testing.T, uri string) *queue.QueueHandler {
+	t.Helper()
+	q, err := c.Queue(uri)
+	if err != nil {
+		t.Fatalf("opening %s: %s", uri, err)
+	}
+	t.Cleanup(q.Close)
+	return q
+}
+
+// consume starts the QueueHandler with a handler that records each delivery and returns the
+// outcome of the provided func.
+func consume(q *queue.QueueHandler, fn func(ctx context.Context, n int) error) <-chan delivery {
+	deliveries := make(chan delivery, 1000)
+	var mtx sync.Mutex
+	n := 0
+	q.AddHandler(func(ctx context.Context, data []byte) error {
+		mtx.Lock()
+		n++
+		attempt := n
+		mtx.Unlock()
+		deliveries <- delivery{
+			data:          append([]byte(nil), data...),
+			correlationID: options.CorrelationIDFromContext(ctx),
+			messageID:     options.MessageIDFromContext(ctx),
+			headers:       options.HeadersFromContext(ctx),
+		}
+		if fn == nil {
+			return nil
+		}
+		return fn(ctx, attempt)
+	})
+	q.Start()
+	return deliveries
+}
+
+func (c conformance) receive(t *testing.T, deliveries <-chan delivery) delivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(c.Timeout):
+		t.Fatalf("expected a message to be received within %s", c.Timeout)
+		return delivery{}
+	}
+}
+
+func (c conformance) expectNoDelivery(t *testing.T, deliveries <-chan delivery) {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		t.Errorf("expected no further messages to be received, got %q", d.data)
+	case <-time.After(c.Settle):
+	}
+}
+
+func (c conformance) roundTrip(t *testing.T) {
+	q := c.open(t, c.uri())
+	deliveries := consume(q, nil)
+	payloads := [][]byte{
+		[]byte(`{"id":"1","to":"to@example.com"}`),
+		[]byte("plain text"),
+		{0x00, 0xff, 0xfe, 0x01},
+	}
+	for _, payload := range payloads {
+		err := q.Publish(payload, options.WithHeader("source", "conformance"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := make(map[string]bool)
+	for range payloads {
+		d := c.receive(t, deliveries)
+		received[string(d.data)] = true
+		if d.headers["source"] != "conformance" {
+			t.Errorf("expected headers to be propagated, got %v", d.headers)
+		}
+		if d.messageID == "" {
+			t.Error("expected received message to have a message ID")
+		}
+	}
+	for _, payload := range payloads {
+		if !received[string(payload)] {
+			t.Errorf("expected payload %q to be received unchanged", payload)
+		}
+	}
+}
+
+func (c conformance) correlationID(t *testing.T) {
+	q := c.open(t, c.uri())
+	deliveries := consume(q, nil)
+	err := q.Publish([]byte(`{}`), options.WithCorrelationID("conformance-correlation-id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := c.receive(t, deliveries); d.correlationID != "conformance-correlation-id" {
+		t.Errorf("expected correlation ID to be propagated, got %q", d.correlationID)
+	}
+
+	err = q.Publish([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := c.receive(t, deliveries); d.correlationID == "" {
+		t.Error("expected a correlation ID to be assigned when publishing")
+	}
+}
+
+func (c conformance) redeliveryOnError(t *testing.T) {
+	q := c.open(t, c.uri())
+	deliveries := consume(q, func(ctx context.Context, attempt int) error {
+		if attempt == 1 {
+			return errors.New("conformance failure")
+		}
+		return nil
+	})
+	err := q.Publish([]byte(`{"attempt":true}`), options.WithCorrelationID("redelivered"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := c.receive(t, deliveries)
+	second := c.receive(t, deliveries)
+	if !bytes.Equal(first.data, second.data) || second.correlationID != "redelivered" {
+		t.Errorf("expected the failed message to be redelivered unchanged, got %q (%s)", second.data, second.correlationID)
+	}
+	// The message is deleted once it is handled successfully.
+	c.expectNoDelivery(t, deliveries)
+}
+
+func (c conformance) deleteOverride(t *testing.T) {
+	q := c.open(t, c.uri())
+	deliveries := consume(q, func(ctx context.Context, attempt int) error {
+		options.SetMessageDelete(ctx, true)
+		return errors.New("conformance failure")
+	})
+	err := q.Publish([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.receive(t, deliveries)
+	// Failed messages are deleted when the handler sets the message delete value.
+	c.expectNoDelivery(t, deliveries)
+}
+
+func (c conformance) retainOverride(t *testing.T) {
+	q := c.open(t, c.uri())
+	deliveries := consume(q, func(ctx context.Context, attempt int) error {
+		if attempt == 1 {
+			options.SetMessageDelete(ctx, false)
+		}
+		return nil
+	})
+	err := q.Publish([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.receive(t, deliveries)
+	// Successful messages are retained, and redelivered, when the handler sets the message
+	// delete value, the override applies to a single delivery.
+	c.receive(t, deliveries)
+	c.expectNoDelivery(t, deliveries)
+}
+
+func (c conformance) shutdown(t *testing.T) {
+	uri := c.uri()
+	consumer, err := c.Queue(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedDeliveries := consume(consumer, nil)
+	consumer.Close()
+
+	publisher := c.open(t, uri)
+	err = publisher.Publish([]byte(`{"after":"close"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-closedDeliveries:
+		t.Errorf("expected a closed queue not to receive messages, got %q", d.data)
+	case <-time.After(c.Settle):
+	}
+	// Messages published after a consumer is closed remain available to other consumers.
+	if d := c.receive(t, consume(c.open(t, uri), nil)); string(d.data) != `{"after":"close"}` {
+		t.Errorf("expected message to be received by another consumer, got %q", d.data)
+	}
+}
+
+func (c conformance) concurrency(t *testing.T) {
+	const publishers, messages = 4, 25
+	uri := c.uri()
+	deliveries := make(chan delivery, publishers*messages*2)
+	for i := 0; i < 2; i++ {
+		consumer := consume(c.open(t, uri), nil)
+		go func() {
+			for d := range consumer {
+				deliveries <- d
+			}
+		}()
+	}
+	publisher := c.open(t, uri)
+	var wg sync.WaitGroup
+	errs := make(chan error, publishers*messages)
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for m := 0; m < messages; m++ {
+				err := publisher.Publish([]byte(fmt.Sprintf(`{"publisher":%d,"message":%d}`, p, m)))
+				if err != nil {
+					errs <- err
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	received := make(map[string]bool)
+	for len(received) < publishers*messages {
+		d := c.receive(t, deliveries)
+		received[string(d.data)] = true
+	}
+}
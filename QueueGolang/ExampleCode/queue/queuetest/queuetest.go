@@ -0,0 +1,199 @@
+// Package queuetest provides an isolated, synchronous QueueHandler and assertions for testing
+// code that publishes and handles messages, without sleeping or sharing state with other tests.
+package queuetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"queue"
+	"queue/options"
+)
+
+// Message is a message published to a Queue.
+type Message struct {
+	// ID is the sequence number of the message, starting at 1.
+	ID            string
+	CorrelationID string
+	Headers       map[string]string
+	// Data is the payload as published to the underlying queue, i.e. after it is compressed,
+	// encrypted or signed if configured.
+	Data []byte
+	// Delivered is whether the message was delivered to handlers.
+	Delivered bool
+	// Err is the error returned by the handlers when the message was delivered.
+	Err error
+}
+
+// Queue is an isolated QueueHandler whose published messages are recorded and delivered
+// synchronously to its handlers, in the order they are published. Publish returns once the
+// message, and any messages published by the handlers, have been handled. Failed messages are
+// not redelivered, their errors are recorded. Handlers are added to the embedded QueueHandler
+// as usual and Start does not need to be called.
+type Queue struct {
+	*queue.QueueHandler
+
+	mtx        sync.Mutex
+	messages   []Message
+	pending    []int
+	delivering bool
+}
+
+// New returns a Queue that is closed when the test completes. The URI is only used to
+// identify the queue, e.g. in logs, and defaults to queuetest://<test name>.
+func New(t testing.TB, uri ...string) *Queue {
+	t.Helper()
+	u := "queuetest://" + t.Name()
+	if len(uri) > 0 {
+		u = uri[0]
+	}
+	q := &Queue{QueueHandler: queue.NewQueueHandler(u, 1)}
+	go q.publisher()
+	t.Cleanup(q.Close)
+	return q
+}
+
+// publisher records the messages published to the queue and delivers them to the handlers.
+// Messages published by handlers while another message is being delivered are delivered after
+// it, to keep the ordering deterministic and avoid blocking the handlers.
+func (q *Queue) publisher() {
+	for {
+		select {
+		case <-q.Done:
+			return
+		case outgoing := <-q.Outgoing:
+			q.mtx.Lock()
+			q.messages = append(q.messages, Message{
+				ID:            strconv.Itoa(len(q.messages) + 1),
+				CorrelationID: options.CorrelationIDFromContext(outgoing.Context),
+				Headers:       options.HeadersFromContext(outgoing.Context),
+				Data:          outgoing.Data,
+			})
+			q.pending = append(q.pending, len(q.messages)-1)
+			if q.delivering {
+				q.mtx.Unlock()
+				outgoing.Close()
+				continue
+			}
+			q.delivering = true
+			q.mtx.Unlock()
+			go func() {
+				q.deliverPending()
+				outgoing.Close()
+			}()
+		}
+	}
+}
+
+// deliverPending delivers the pending messages until there are none left.
+func (q *Queue) deliverPending() {
+	for {
+		q.mtx.Lock()
+		if len(q.pending) == 0 {
+			q.delivering = false
+			q.mtx.Unlock()
+			return
+		}
+		i := q.pending[0]
+		q.pending = q.pending[1:]
+		msg := q.messages[i]
+		q.mtx.Unlock()
+
+		err := q.handle(msg)
+		q.mtx.Lock()
+		if !errors.Is(err, queue.ErrNoHandlers) {
+			q.messages[i].Delivered = true
+			q.messages[i].Err = err
+		}
+		q.mtx.Unlock()
+	}
+}
+
+func (q *Queue) handle(msg Message) error {
+	ctx := options.ContextWithPublishOptions(options.ContextWithMessageDelete(context.Background()), options.Merge(
+		options.WithCorrelationID(msg.CorrelationID),
+		options.WithHeaders(msg.Headers),
+	))
+	ctx = options.ContextWithMessageID(ctx, msg.ID)
+	ctx = options.ContextWithSentTime(ctx, time.Now())
+	return q.Handle(ctx, msg.Data)
+}
+
+// Published returns the messages published to the queue, in order.
+func (q *Queue) Published() []Message {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return append([]Message(nil), q.messages...)
+}
+
+// Deliver marshals the message with the queue's codec and delivers it synchronously to the
+// handlers, returning their error. It does not record the message as published.
+func (q *Queue) Deliver(m interface{}, opts ...options.PublishOptions) error {
+	data, headers, err := q.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshaling message: %w", err)
+	}
+	return q.DeliverRaw(data, append([]options.PublishOptions{headers}, opts...)...)
+}
+
+// DeliverRaw delivers the payload synchronously to the handlers, returning their error. It does
+// not record the message as published.
+func (q *Queue) DeliverRaw(data []byte, opts ...options.PublishOptions) error {
+	ctx := options.ContextWithPublishOptions(options.NewMessageContext(), options.Merge(opts...))
+	ctx = options.ContextWithSentTime(ctx, time.Now())
+	return q.Handle(ctx, data)
+}
+
+// ExpectPublished decodes the messages published to the queue into T, failing the test if none
+// were published or any cannot be decoded. If expected messages are provided the test fails
+// unless the published messages are equal to them, in order.
+func ExpectPublished[T any](t testing.TB, q *Queue, expected ...T) []T {
+	t.Helper()
+	msgs := q.Published()
+	if len(msgs) == 0 {
+		t.Fatalf("expected messages to be published to %s", q.URI())
+		return nil
+	}
+	published := make([]T, 0, len(msgs))
+	for _, msg := range msgs {
+		var m T
+		ctx := options.ContextWithPublishOptions(context.Background(), options.WithHeaders(msg.Headers))
+		err := q.Unmarshal(ctx, msg.Data, &m)
+		if err != nil {
+			t.Fatalf("decoding message %s published to %s: %s", msg.ID, q.URI(), err)
+			return nil
+		}
+		published = append(published, m)
+	}
+	if len(expected) > 0 && !reflect.DeepEqual(published, expected) {
+		t.Errorf("expected published messages %+v, got %+v", expected, published)
+	}
+	return published
+}
+
+// ExpectNothingPublished fails the test if any messages were published to the queue.
+func ExpectNothingPublished(t testing.TB, q *Queue) {
+	t.Helper()
+	if msgs := q.Published(); len(msgs) > 0 {
+		t.Errorf("expected no messages to be published to %s, got %d", q.URI(), len(msgs))
+	}
+}
+
+// Eventually fails the test unless the condition is met within a second, for asserting on queue
+// implementations that deliver messages asynchronously.
+func Eventually(t testing.TB, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
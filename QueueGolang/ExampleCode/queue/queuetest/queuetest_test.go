@@ -0,0 +1,85 @@
+package queuetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"queue"
+)
+
+func TestQueue_Publish(t *testing.T) {
+	q := New(t)
+	var handled []string
+	queue.Handle(q.QueueHandler, func(ctx context.Context, m queue.EmailMessage) error {
+		handled = append(handled, m.To)
+		// Messages published by handlers are delivered after the current message.
+		if m.To == "first" {
+			return q.PublishEmailMessage(queue.EmailMessage{To: "third"})
+		}
+		return nil
+	})
+	for _, to := range []string{"first", "second"} {
+		err := q.PublishEmailMessage(queue.EmailMessage{To: to})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := []string{"first", "third", "second"}; !reflect.DeepEqual(handled, expected) {
+		t.Errorf("expected messages to be handled in order %v, got %v", expected, handled)
+	}
+	ExpectPublished(t, q,
+		queue.EmailMessage{To: "first"},
+		queue.EmailMessage{To: "third"},
+		queue.EmailMessage{To: "second"},
+	)
+	for _, msg := range q.Published() {
+		if !msg.Delivered || msg.Err != nil {
+			t.Errorf("expected message %s to be delivered, got %+v", msg.ID, msg)
+		}
+	}
+}
+
+func TestQueue_PublishWithoutHandlers(t *testing.T) {
+	q := New(t, "queuetest://publisher")
+	ExpectNothingPublished(t, q)
+	err := q.Publish([]byte(`{"to":"to@example.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := q.Published()
+	if len(msgs) != 1 || msgs[0].Delivered || msgs[0].CorrelationID == "" {
+		t.Errorf("expected an undelivered message with a correlation ID, got %+v", msgs)
+	}
+	published := ExpectPublished[queue.EmailMessage](t, q)
+	if published[0].To != "to@example.com" {
+		t.Errorf("expected published message to be decoded, got %+v", published)
+	}
+}
+
+func TestQueue_Deliver(t *testing.T) {
+	q := New(t)
+	errInvalid := errors.New("invalid recipient")
+	q.AddEmailMessageHandler(func(ctx context.Context, m queue.EmailMessage) error {
+		if m.To == "" {
+			return errInvalid
+		}
+		return nil
+	})
+	if err := q.Deliver(queue.EmailMessage{To: "to@example.com"}); err != nil {
+		t.Errorf("expected message to be handled, got %v", err)
+	}
+	if err := q.Deliver(queue.EmailMessage{}); !errors.Is(err, errInvalid) {
+		t.Errorf("expected handler error, got %v", err)
+	}
+	ExpectNothingPublished(t, q)
+
+	err := q.PublishEmailMessage(queue.EmailMessage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs := q.Published(); !errors.Is(msgs[0].Err, errInvalid) {
+		t.Errorf("expected handler error to be recorded, got %+v", msgs[0])
+	}
+}
@@ -0,0 +1,92 @@
+package queue
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is a token bucket rate limit on the consumption of messages.
+type RateLimit struct {
+	// PerSecond is the rate at which tokens are added to the bucket. A value of zero or
+	// less disables the rate limit.
+	PerSecond float64
+	// Burst is the maximum number of tokens in the bucket. It defaults to 1.
+	Burst int
+}
+
+// RateLimitFunc returns the RateLimit to apply. It is called each time a token is
+// requested allowing the limit to be driven dynamically, e.g. from the rate limit
+// headers of a third party API response.
+type RateLimitFunc func() RateLimit
+
+// RateLimiter limits the rate at which messages are consumed using a token bucket.
+type RateLimiter struct {
+	mtx     sync.Mutex
+	limiter *rate.Limiter
+	fn      RateLimitFunc
+}
+
+// NewRateLimiter returns a RateLimiter with a fixed RateLimit.
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	r := &RateLimiter{limiter: rate.NewLimiter(rate.Inf, 1)}
+	r.SetRateLimit(limit)
+	return r
+}
+
+// NewDynamicRateLimiter returns a RateLimiter with a RateLimit that is obtained by
+// calling the provided func each time a token is requested.
+func NewDynamicRateLimiter(fn RateLimitFunc) *RateLimiter {
+	r := NewRateLimiter(fn())
+	r.fn = fn
+	return r
+}
+
+// SetRateLimit updates the RateLimit. Tokens already in the bucket are retained.
+func (r *RateLimiter) SetRateLimit(limit RateLimit) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	perSecond := rate.Inf
+	if limit.PerSecond > 0 {
+		perSecond = rate.Limit(limit.PerSecond)
+	}
+	burst := limit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	if r.limiter.Limit() != perSecond {
+		r.limiter.SetLimit(perSecond)
+	}
+	if r.limiter.Burst() != burst {
+		r.limiter.SetBurst(burst)
+	}
+}
+
+// Wait blocks until a token is available or the context is done.
+func (r *RateLimiter) Wait(ctx context.Context) error {
+	if r.fn != nil {
+		r.SetRateLimit(r.fn())
+	}
+	return r.limiter.Wait(ctx)
+}
+
+// Handler wraps the provided handler such that it is rate limited independently of
+// any other handlers on the QueueHandler. As handlers are called sequentially a
+// rate limited handler also slows the polling of the underlying queue.
+func (r *RateLimiter) Handler(handler func(ctx context.Context, data []byte) error) func(ctx context.Context, data []byte) error {
+	return func(ctx context.Context, data []byte) error {
+		err := r.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		return handler(ctx, data)
+	}
+}
+
+// SetRateLimiter sets the RateLimiter used to limit the rate at which the underlying queue
+// implementation consumes messages. It returns the QueueHandler for chaining.
+func (q *QueueHandler) SetRateLimiter(r *RateLimiter) *QueueHandler {
+	q.rateLimiter = r
+	return q
+}
@@ -0,0 +1,45 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQueueHandler_Wait(t *testing.T) {
+	q := NewQueueHandler("test://ratelimit", 1).
+		SetRateLimiter(NewRateLimiter(RateLimit{PerSecond: 20, Burst: 1}))
+	tStart := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := q.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(tStart); elapsed < 90*time.Millisecond {
+		t.Errorf("expected rate limited waits to take at least 100ms, took %s", elapsed)
+	}
+	q.Close()
+	if err := q.Wait(); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestNewDynamicRateLimiter(t *testing.T) {
+	limit := RateLimit{PerSecond: 1, Burst: 1}
+	r := NewDynamicRateLimiter(func() RateLimit {
+		return limit
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := r.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Wait(ctx); err == nil {
+		t.Fatal("expected second wait to exceed the context deadline")
+	}
+	limit = RateLimit{}
+	if err := r.Wait(context.Background()); err != nil {
+		t.Errorf("expected wait to succeed once the limit was removed, got %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package redrive
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+
+	"queue"
+	"queue/options"
+)
+
+// DefaultIdleTimeout is the default duration without receiving new messages after which a
+// redrive is considered complete.
+const DefaultIdleTimeout = 10 * time.Second
+
+// Filter selects the messages to redrive. Messages must match every criteria that is set.
+type Filter struct {
+	// ErrorReason matches the queue.ErrorReasonHeader of the message, which is only set on
+	// messages dead lettered by mem queues.
+	ErrorReason *regexp.Regexp
+	// After and Before match the time the message was sent to the source queue. Messages
+	// whose sent time is unknown do not match.
+	After  time.Time
+	Before time.Time
+	// CorrelationIDs matches any of the correlation IDs.
+	CorrelationIDs []string
+}
+
+// Match returns whether the message context matches the filter.
+func (f Filter) Match(ctx context.Context) bool {
+	if f.ErrorReason != nil && !f.ErrorReason.MatchString(options.HeaderFromContext(ctx, queue.ErrorReasonHeader)) {
+		return false
+	}
+	if !f.After.IsZero() || !f.Before.IsZero() {
+		sent := options.SentTimeFromContext(ctx)
+		if sent.IsZero() {
+			return false
+		}
+		if !f.After.IsZero() && sent.Before(f.After) {
+			return false
+		}
+		if !f.Before.IsZero() && !sent.Before(f.Before) {
+			return false
+		}
+	}
+	if len(f.CorrelationIDs) > 0 {
+		correlationID := options.CorrelationIDFromContext(ctx)
+		for _, id := range f.CorrelationIDs {
+			if id == correlationID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// TransformFunc transforms the payload of a message before it is published to the destination.
+type TransformFunc func(ctx context.Context, data []byte) ([]byte, error)
+
+// Options configures a redrive.
+type Options struct {
+	Filter Filter
+	// RateLimit limits the rate at which messages are consumed from the source queue.
+	RateLimit queue.RateLimit
+	// DryRun reports the messages that match the filter without moving them.
+	DryRun bool
+	// Transform, if set, transforms the payloads of the messages that are moved.
+	Transform TransformFunc
+	// PassThrough moves messages byte for byte, with all of their headers, rather than
+	// publishing their decoded payloads using the payload transformations of the destination.
+	// Signed, encrypted and claim checked messages remain verifiable and decodable by the
+	// consumers of the destination without the source or destination being configured with
+	// their keys or store. It cannot be used with Transform.
+	PassThrough bool
+	// Max is the maximum number of messages to move, zero moves all matching messages.
+	Max int
+	// IdleTimeout is the duration without receiving new messages after which the redrive
+	// completes, it defaults to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// OnMessage, if set, is called with the outcome of each message received.
+	OnMessage func(Result)
+}
+
+// Action is the outcome of redriving a message.
+type Action string
+
+const (
+	// ActionMoved indicates the message was published to the destination and deleted from
+	// the source.
+	ActionMoved Action = "moved"
+	// ActionMatched indicates the message matched the filter during a dry run.
+	ActionMatched Action = "matched"
+	// ActionSkipped indicates the message did not match the filter, or the maximum number
+	// of messages had been moved, and was left on the source.
+	ActionSkipped Action = "skipped"
+	// ActionFailed indicates transforming or publishing the message failed and it was left
+	// on the source.
+	ActionFailed Action = "failed"
+)
+
+// Result is the outcome of redriving a message.
+type Result struct {
+	ID            string
+	CorrelationID string
+	Action        Action
+	Err           error
+}
+
+// Report summarises a redrive.
+type Report struct {
+	Received int
+	Moved    int
+	Matched  int
+	Skipped  int
+	Failed   int
+}
+
+// Redrive moves messages from the source queue URI to the destination queue URI, see Run.
+func Redrive(ctx context.Context, source, destination string, opts Options) (Report, error) {
+	src, err := queue.Queue(source)
+	if err != nil {
+		return Report{}, err
+	}
+	defer src.Close()
+	dst, err := queue.Queue(destination)
+	if err != nil {
+		return Report{}, err
+	}
+	defer dst.Close()
+	return Run(ctx, src, dst, opts)
+}
+
+// Run consumes messages from the source QueueHandler, which must not have been started, and
+// publishes those matching the filter to the destination QueueHandler, preserving their
+// correlation ID and headers, and their payload byte for byte when PassThrough is set. Moved
+// messages are deleted from the source, other messages are left on the source. It returns once
+// the context is done, the maximum number of messages have been moved or no new messages have
+// been received for the idle timeout. The source is paused on return.
+func Run(ctx context.Context, src, dst *queue.QueueHandler, opts Options) (Report, error) {
+	if opts.PassThrough && opts.Transform != nil {
+		return Report{}, errors.New("transform cannot be used with pass through")
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	if opts.PassThrough {
+		src.SetRawPayloads(true)
+	}
+	if opts.RateLimit.PerSecond > 0 {
+		src.SetRateLimiter(queue.NewRateLimiter(opts.RateLimit))
+	}
+	r := &redriver{
+		dst:      dst,
+		opts:     opts,
+		seen:     make(map[string]bool),
+		activity: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	src.AddHandler(r.handle)
+	src.Start()
+	defer src.Pause()
+
+	timer := time.NewTimer(opts.IdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return r.result(), ctx.Err()
+		case <-r.done:
+			return r.result(), nil
+		case <-timer.C:
+			return r.result(), nil
+		case <-r.activity:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(opts.IdleTimeout)
+		}
+	}
+}
+
+type redriver struct {
+	dst  *queue.QueueHandler
+	opts Options
+
+	mtx      sync.Mutex
+	report   Report
+	seen     map[string]bool
+	activity chan struct{}
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func (r *redriver) result() Report {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.report
+}
+
+func (r *redriver) handle(ctx context.Context, data []byte) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	result := Result{
+		ID:            options.MessageIDFromContext(ctx),
+		CorrelationID: options.CorrelationIDFromContext(ctx),
+	}
+	// Messages left on the source may be received again, they are not new activity.
+	if result.ID != "" && r.seen[result.ID] {
+		options.SetMessageDelete(ctx, false)
+		return nil
+	}
+	r.seen[result.ID] = true
+	r.report.Received++
+	select {
+	case r.activity <- struct{}{}:
+	default:
+	}
+
+	result.Action, result.Err = r.redrive(ctx, data)
+	switch result.Action {
+	case ActionMoved:
+		r.report.Moved++
+		if r.opts.Max > 0 && r.report.Moved >= r.opts.Max {
+			r.doneOnce.Do(func() { close(r.done) })
+		}
+	case ActionMatched:
+		r.report.Matched++
+	case ActionSkipped:
+		r.report.Skipped++
+	case ActionFailed:
+		r.report.Failed++
+	}
+	if result.Action != ActionMoved {
+		options.SetMessageDelete(ctx, false)
+	}
+	if r.opts.OnMessage != nil {
+		r.opts.OnMessage(result)
+	}
+	return nil
+}
+
+func (r *redriver) redrive(ctx context.Context, data []byte) (Action, error) {
+	if !r.opts.Filter.Match(ctx) || (r.opts.Max > 0 && r.report.Moved >= r.opts.Max) {
+		return ActionSkipped, nil
+	}
+	if r.opts.DryRun {
+		return ActionMatched, nil
+	}
+	var err error
+	if r.opts.Transform != nil {
+		data, err = r.opts.Transform(ctx, data)
+		if err != nil {
+			return ActionFailed, err
+		}
+	}
+	opts := publishOptions(ctx)
+	if r.opts.PassThrough {
+		opts = passThroughOptions(ctx)
+	}
+	err = r.dst.Publish(data, opts)
+	if err != nil {
+		return ActionFailed, err
+	}
+	return ActionMoved, nil
+}
+
+// publishOptions returns the options preserving the correlation ID and headers of a received
+// message, other than those describing the transformations applied to its payload which are
+// applied again by the destination.
+func publishOptions(ctx context.Context) options.PublishOptions {
+	headers := make(map[string]string)
+	for k, v := range options.HeadersFromContext(ctx) {
+		headers[k] = v
+	}
+	for _, k := range queue.PayloadHeaders() {
+		delete(headers, k)
+	}
+	opts := options.WithHeaders(headers)
+	if correlationID := options.CorrelationIDFromContext(ctx); correlationID != "" {
+		opts.CorrelationID = &correlationID
+	}
+	return opts
+}
+
+// passThroughOptions returns the options publishing a received message as is, preserving its
+// correlation ID and all of its headers.
+func passThroughOptions(ctx context.Context) options.PublishOptions {
+	opts := options.Merge(options.WithHeaders(options.HeadersFromContext(ctx)), options.WithRawPayload())
+	if correlationID := options.CorrelationIDFromContext(ctx); correlationID != "" {
+		opts.CorrelationID = &correlationID
+	}
+	return opts
+}
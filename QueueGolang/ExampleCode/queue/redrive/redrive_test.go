@@ -0,0 +1,325 @@
+package redrive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"queue"
+	"queue/compression"
+	_ "queue/mem"
+	"queue/options"
+	"queue/signing"
+)
+
+func TestFilter_Match(t *testing.T) {
+	sent := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	ctx := options.ContextWithPublishOptions(context.Background(), options.Merge(
+		options.WithCorrelationID("abc"),
+		options.WithHeader(queue.ErrorReasonHeader, "handler timeout"),
+	))
+	withSent := options.ContextWithSentTime(ctx, sent)
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		filter Filter
+		match  bool
+	}{
+		{name: "empty", ctx: ctx, match: true},
+		{name: "error reason", ctx: ctx, filter: Filter{ErrorReason: regexp.MustCompile("timeout")}, match: true},
+		{name: "other error reason", ctx: ctx, filter: Filter{ErrorReason: regexp.MustCompile("^invalid")}},
+		{name: "after", ctx: withSent, filter: Filter{After: sent}, match: true},
+		{name: "before", ctx: withSent, filter: Filter{Before: sent.Add(time.Second)}, match: true},
+		{name: "not before", ctx: withSent, filter: Filter{Before: sent}},
+		{name: "not after", ctx: withSent, filter: Filter{After: sent.Add(time.Second)}},
+		{name: "unknown sent time", ctx: ctx, filter: Filter{After: sent}},
+		{name: "correlation id", ctx: ctx, filter: Filter{CorrelationIDs: []string{"xyz", "abc"}}, match: true},
+		{name: "other correlation id", ctx: ctx, filter: Filter{CorrelationIDs: []string{"xyz"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if match := tt.filter.Match(tt.ctx); match != tt.match {
+				t.Errorf("expected match %t, got %t", tt.match, match)
+			}
+		})
+	}
+}
+
+// received collects the messages received from a queue.
+type received struct {
+	mtx      sync.Mutex
+	headers  []map[string]string
+	payloads []string
+}
+
+func (r *received) handle(ctx context.Context, data []byte) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.headers = append(r.headers, options.HeadersFromContext(ctx))
+	r.payloads = append(r.payloads, string(data))
+	return nil
+}
+
+func (r *received) wait(t *testing.T, n int) ([]string, []map[string]string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mtx.Lock()
+		if len(r.payloads) >= n {
+			payloads := append([]string(nil), r.payloads...)
+			headers := append([]map[string]string(nil), r.headers...)
+			r.mtx.Unlock()
+			sort.Strings(payloads)
+			return payloads, headers
+		}
+		r.mtx.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d messages to be received", n)
+	return nil, nil
+}
+
+func publishDeadLetters(t *testing.T, q *queue.QueueHandler, reasons map[string]string) {
+	t.Helper()
+	for payload, reason := range reasons {
+		err := q.Publish([]byte(payload), options.WithHeaders(map[string]string{
+			queue.ErrorReasonHeader: reason,
+			"source":                "test",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	src, err := queue.Queue("mem://redrive-run-dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := queue.Queue("mem://redrive-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	dst.SetCompression(compression.Gzip)
+	publishDeadLetters(t, src, map[string]string{
+		"a": "handler timeout",
+		"b": "invalid message",
+		"c": "handler timeout",
+	})
+
+	var mtx sync.Mutex
+	var results []Result
+	report, err := Run(context.Background(), src, dst, Options{
+		Filter:      Filter{ErrorReason: regexp.MustCompile("timeout")},
+		IdleTimeout: 200 * time.Millisecond,
+		Transform: func(ctx context.Context, data []byte) ([]byte, error) {
+			return bytes.ToUpper(data), nil
+		},
+		OnMessage: func(r Result) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			results = append(results, r)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Report{Received: 3, Moved: 2, Skipped: 1}); report != expected {
+		t.Errorf("expected report %+v, got %+v", expected, report)
+	}
+	if len(results) != 3 {
+		t.Errorf("expected 3 results, got %d", len(results))
+	}
+
+	r := &received{}
+	dst.AddHandler(r.handle)
+	dst.Start()
+	payloads, headers := r.wait(t, 2)
+	if !reflect.DeepEqual(payloads, []string{"A", "C"}) {
+		t.Errorf("expected transformed payloads, got %v", payloads)
+	}
+	for _, h := range headers {
+		if h["source"] != "test" || h[queue.ErrorReasonHeader] != "handler timeout" {
+			t.Errorf("expected headers to be preserved, got %v", h)
+		}
+		if h[compression.Header] != compression.Gzip {
+			t.Errorf("expected payload to be compressed by the destination, got %v", h)
+		}
+	}
+}
+
+func TestRun_PassThrough(t *testing.T) {
+	producer, err := queue.Queue("mem://redrive-pass-through-dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close()
+	producer.SetSigner(signing.NewHMACSigner("key", []byte("secret"))).SetCompression(compression.Gzip)
+	if err := producer.Publish([]byte(`{"id":"1"}`), options.WithCorrelationID("order-1")); err != nil {
+		t.Fatal(err)
+	}
+	src, err := queue.Queue("mem://redrive-pass-through-dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := queue.Queue("mem://redrive-pass-through")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	// The destination would sign a decoded payload with its own key, which consumers reject.
+	dst.SetSigner(signing.NewHMACSigner("other", []byte("other")))
+
+	report, err := Run(context.Background(), src, dst, Options{PassThrough: true, IdleTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Report{Received: 1, Moved: 1}); report != expected {
+		t.Errorf("expected report %+v, got %+v", expected, report)
+	}
+
+	consumer, err := queue.Queue("mem://redrive-pass-through")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	consumer.SetVerifier(signing.NewKeys().AddHMACKey("key", []byte("secret")))
+	r := &received{}
+	consumer.AddHandler(r.handle)
+	consumer.Start()
+	payloads, _ := r.wait(t, 1)
+	if !reflect.DeepEqual(payloads, []string{`{"id":"1"}`}) {
+		t.Errorf("expected the original payload to be verified, got %v", payloads)
+	}
+}
+
+func TestRun_PassThroughTransform(t *testing.T) {
+	_, err := Run(context.Background(), queue.NewQueueHandler("mem://src", 1), queue.NewQueueHandler("mem://dst", 1), Options{
+		PassThrough: true,
+		Transform: func(ctx context.Context, data []byte) ([]byte, error) {
+			return data, nil
+		},
+	})
+	if err == nil {
+		t.Error("expected transform to be rejected with pass through")
+	}
+}
+
+func TestRun_DryRun(t *testing.T) {
+	src, err := queue.Queue("mem://redrive-dry-run-dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := queue.Queue("mem://redrive-dry-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	publishDeadLetters(t, src, map[string]string{"a": "handler timeout"})
+
+	report, err := Run(context.Background(), src, dst, Options{
+		DryRun:      true,
+		IdleTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Report{Received: 1, Matched: 1}); report != expected {
+		t.Errorf("expected report %+v, got %+v", expected, report)
+	}
+	n, err := queue.Count(context.Background(), dst.URI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected no messages to be moved, got %d", n)
+	}
+}
+
+func TestRun_Max(t *testing.T) {
+	src, err := queue.Queue("mem://redrive-max-dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := queue.Queue("mem://redrive-max")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	publishDeadLetters(t, src, map[string]string{"a": "", "b": "", "c": ""})
+
+	report, err := Run(context.Background(), src, dst, Options{
+		Max:         1,
+		IdleTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Moved != 1 {
+		t.Errorf("expected 1 message to be moved, got %+v", report)
+	}
+}
+
+func TestRun_TransformError(t *testing.T) {
+	src, err := queue.Queue("mem://redrive-transform-dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := queue.Queue("mem://redrive-transform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	publishDeadLetters(t, src, map[string]string{"a": ""})
+
+	errTransform := errors.New("transform failed")
+	var result Result
+	report, err := Run(context.Background(), src, dst, Options{
+		IdleTimeout: 200 * time.Millisecond,
+		Transform: func(ctx context.Context, data []byte) ([]byte, error) {
+			return nil, errTransform
+		},
+		OnMessage: func(r Result) {
+			result = r
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (Report{Received: 1, Failed: 1}); report != expected {
+		t.Errorf("expected report %+v, got %+v", expected, report)
+	}
+	if result.Action != ActionFailed || !errors.Is(result.Err, errTransform) {
+		t.Errorf("expected failed result, got %+v", result)
+	}
+}
+
+func TestPublishOptions(t *testing.T) {
+	ctx := options.ContextWithPublishOptions(context.Background(), options.Merge(
+		options.WithCorrelationID("abc"),
+		options.WithHeaders(map[string]string{
+			queue.ErrorReasonHeader: "handler timeout",
+			compression.Header:      compression.Gzip,
+		}),
+	))
+	opts := publishOptions(ctx)
+	if opts.CorrelationID == nil || *opts.CorrelationID != "abc" {
+		t.Errorf("expected correlation ID to be preserved, got %v", opts.CorrelationID)
+	}
+	if expected := map[string]string{queue.ErrorReasonHeader: "handler timeout"}; !reflect.DeepEqual(opts.Headers, expected) {
+		t.Errorf("expected headers %v, got %v", expected, opts.Headers)
+	}
+}
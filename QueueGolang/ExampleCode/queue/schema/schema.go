@@ -0,0 +1,182 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/invopop/jsonschema"
+	validator "github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// reflector generates schemas that permit additional properties so consumers validating
+// against an older schema accept messages from producers that have added fields.
+var reflector = jsonschema.Reflector{
+	AllowAdditionalProperties: true,
+	ExpandedStruct:            true,
+}
+
+// Generate returns the JSON Schema of the wire format of a message type. Fields are required
+// unless their json tag includes omitempty.
+func Generate(t reflect.Type) ([]byte, error) {
+	return json.MarshalIndent(reflector.ReflectFromType(t), "", "  ")
+}
+
+// GenerateInline returns the JSON Schema of the wire format of a message type without
+// references to definitions or schema identifiers, so it can be embedded in other documents.
+func GenerateInline(t reflect.Type) ([]byte, error) {
+	r := reflector
+	r.Anonymous = true
+	r.DoNotReference = true
+	s := r.ReflectFromType(t)
+	s.Version = ""
+	return json.Marshal(s)
+}
+
+// FieldError describes a field of a message that does not conform to its schema.
+type FieldError struct {
+	// Field is the JSON pointer to the field, e.g. /importJob/id, or empty for the message.
+	Field   string
+	Message string
+}
+
+// ValidationError is returned when a message does not conform to its schema.
+type ValidationError struct {
+	Type   string
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		field := f.Field
+		if field == "" {
+			field = "/"
+		}
+		fields[i] = fmt.Sprintf("%s: %s", field, f.Message)
+	}
+	return fmt.Sprintf("invalid %s: %s", e.Type, strings.Join(fields, ", "))
+}
+
+// Validator validates messages against the JSON Schemas of their types. Schemas are generated
+// and compiled on first use. It is safe for concurrent use.
+type Validator struct {
+	mtx     sync.Mutex
+	schemas map[reflect.Type]*validator.Schema
+}
+
+// NewValidator returns a new Validator.
+func NewValidator() *Validator {
+	return &Validator{
+		schemas: make(map[reflect.Type]*validator.Schema),
+	}
+}
+
+// Validate validates a message against the schema of the message type t. The message may be
+// a value of type t or its decoded wire format, i.e. a map[string]interface{}. It returns a
+// *ValidationError, with the fields sorted by path, if the message does not conform.
+func (v *Validator) Validate(t reflect.Type, m interface{}) error {
+	s, err := v.schema(t)
+	if err != nil {
+		return err
+	}
+	doc, err := normalize(m)
+	if err != nil {
+		return fmt.Errorf("encoding %s for validation: %w", t, err)
+	}
+	err = s.Validate(doc)
+	var ve *validator.ValidationError
+	if errors.As(err, &ve) {
+		verr := &ValidationError{Type: t.String()}
+		for _, cause := range leaves(ve) {
+			verr.Fields = append(verr.Fields, FieldError{
+				Field:   cause.InstanceLocation,
+				Message: cause.Message,
+			})
+		}
+		sort.Slice(verr.Fields, func(i, j int) bool {
+			if verr.Fields[i].Field != verr.Fields[j].Field {
+				return verr.Fields[i].Field < verr.Fields[j].Field
+			}
+			return verr.Fields[i].Message < verr.Fields[j].Message
+		})
+		return verr
+	}
+	return err
+}
+
+func (v *Validator) schema(t reflect.Type) (*validator.Schema, error) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if s, ok := v.schemas[t]; ok {
+		return s, nil
+	}
+	doc, err := Generate(t)
+	if err != nil {
+		return nil, fmt.Errorf("generating schema for %s: %w", t, err)
+	}
+	url := t.String() + ".json"
+	c := validator.NewCompiler()
+	err = c.AddResource(url, bytes.NewReader(doc))
+	if err != nil {
+		return nil, fmt.Errorf("compiling schema for %s: %w", t, err)
+	}
+	s, err := c.Compile(url)
+	if err != nil {
+		return nil, fmt.Errorf("compiling schema for %s: %w", t, err)
+	}
+	v.schemas[t] = s
+	return s, nil
+}
+
+// normalize converts a message into the representation produced by decoding its JSON.
+func normalize(m interface{}) (interface{}, error) {
+	data, err := json.Marshal(stringKeys(m))
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	err = dec.Decode(&doc)
+	return doc, err
+}
+
+// stringKeys converts maps with interface{} keys, as decoded by some codecs, into maps with
+// string keys so they can be encoded as JSON.
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = stringKeys(val)
+		}
+		return m
+	case map[string]interface{}:
+		for k, val := range v {
+			v[k] = stringKeys(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = stringKeys(val)
+		}
+	}
+	return v
+}
+
+// leaves returns the validation errors without causes, which describe the individual fields.
+func leaves(ve *validator.ValidationError) []*validator.ValidationError {
+	if len(ve.Causes) == 0 {
+		return []*validator.ValidationError{ve}
+	}
+	var errs []*validator.ValidationError
+	for _, cause := range ve.Causes {
+		errs = append(errs, leaves(cause)...)
+	}
+	return errs
+}
@@ -0,0 +1,119 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type importJob struct {
+	ID    string `json:"id"`
+	Retry int    `json:"retry,omitempty"`
+}
+
+type message struct {
+	InputURI  string    `json:"inputUri"`
+	ImportJob importJob `json:"importJob"`
+}
+
+func TestGenerate(t *testing.T) {
+	doc, err := Generate(reflect.TypeOf(message{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s struct {
+		Type       string
+		Required   []string
+		Properties map[string]interface{}
+	}
+	err = json.Unmarshal(doc, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Type != "object" {
+		t.Errorf("expected object schema, got %s", s.Type)
+	}
+	if !reflect.DeepEqual(s.Required, []string{"inputUri", "importJob"}) {
+		t.Errorf("expected required fields, got %v", s.Required)
+	}
+}
+
+func TestValidator(t *testing.T) {
+	v := NewValidator()
+	typ := reflect.TypeOf(message{})
+	tests := []struct {
+		name   string
+		msg    interface{}
+		fields []FieldError
+	}{
+		{
+			name: "struct",
+			msg:  message{InputURI: "gs://bucket/file"},
+		},
+		{
+			name: "wire format with additional properties",
+			msg: map[string]interface{}{
+				"inputUri":  "gs://bucket/file",
+				"importJob": map[string]interface{}{"id": "1", "owner": "a"},
+			},
+		},
+		{
+			name: "interface keys",
+			msg: map[interface{}]interface{}{
+				"inputUri":  "gs://bucket/file",
+				"importJob": map[interface{}]interface{}{"id": "1"},
+			},
+		},
+		{
+			name: "invalid fields",
+			msg: map[string]interface{}{
+				"importJob": map[string]interface{}{"id": 1, "retry": "no"},
+			},
+			fields: []FieldError{
+				{Field: "", Message: "missing properties: 'inputUri'"},
+				{Field: "/importJob/id", Message: "expected string, but got number"},
+				{Field: "/importJob/retry", Message: "expected integer, but got string"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Validate(typ, tt.msg)
+			if tt.fields == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected ValidationError, got %v", err)
+			}
+			if !reflect.DeepEqual(verr.Fields, tt.fields) {
+				t.Errorf("expected field errors %+v, got %+v", tt.fields, verr.Fields)
+			}
+		})
+	}
+}
+
+func TestGenerateInline(t *testing.T) {
+	doc, err := GenerateInline(reflect.TypeOf(message{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s map[string]interface{}
+	err = json.Unmarshal(doc, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"$schema", "$id", "$defs", "$ref"} {
+		if _, ok := s[key]; ok {
+			t.Errorf("expected inline schema without %s", key)
+		}
+	}
+	importJob := s["properties"].(map[string]interface{})["importJob"].(map[string]interface{})
+	if importJob["type"] != "object" {
+		t.Errorf("expected nested schema to be inlined, got %v", importJob)
+	}
+}
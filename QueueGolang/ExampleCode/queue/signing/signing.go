@@ -0,0 +1,152 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Message headers carrying the signature of a message.
+const (
+	SignatureHeader = "signature"
+	KeyIDHeader     = "signature_key_id"
+)
+
+var (
+	// ErrUnknownKey is returned when verifying a signature made by an unknown key.
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrInvalidSignature is returned when a signature does not match the message.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrUnsigned is returned when verifying a message without a signature.
+	ErrUnsigned = errors.New("message is not signed")
+)
+
+// Signer signs messages.
+type Signer interface {
+	// Sign returns the ID of the signing key and the signature of the message.
+	Sign(message []byte) (keyID string, signature []byte, err error)
+}
+
+// Verifier verifies message signatures.
+type Verifier interface {
+	// Verify verifies the signature of the message was made by the key with the provided ID.
+	Verify(keyID string, message, signature []byte) error
+}
+
+// Message returns the bytes that are signed for a message, made up of its correlation ID, headers
+// and payload. Signature headers are not signed.
+func Message(correlationID string, headers map[string]string, payload []byte) []byte {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		if k == SignatureHeader || k == KeyIDHeader {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	// Length prefixes prevent ambiguity between the fields.
+	b := appendField(nil, []byte(correlationID))
+	for _, k := range keys {
+		b = appendField(b, []byte(k))
+		b = appendField(b, []byte(headers[k]))
+	}
+	return appendField(b, payload)
+}
+
+func appendField(b, field []byte) []byte {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(field)))
+	b = append(b, l[:]...)
+	return append(b, field...)
+}
+
+type hmacSigner struct {
+	keyID  string
+	secret []byte
+}
+
+// NewHMACSigner returns a Signer that signs messages with HMAC-SHA256.
+func NewHMACSigner(keyID string, secret []byte) Signer {
+	return hmacSigner{keyID, secret}
+}
+
+func (h hmacSigner) Sign(message []byte) (string, []byte, error) {
+	return h.keyID, hmacSum(h.secret, message), nil
+}
+
+type ed25519Signer struct {
+	keyID string
+	key   ed25519.PrivateKey
+}
+
+// NewEd25519Signer returns a Signer that signs messages with Ed25519.
+func NewEd25519Signer(keyID string, key ed25519.PrivateKey) Signer {
+	return ed25519Signer{keyID, key}
+}
+
+func (e ed25519Signer) Sign(message []byte) (string, []byte, error) {
+	return e.keyID, ed25519.Sign(e.key, message), nil
+}
+
+func hmacSum(secret, message []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// Keys is a Verifier accepting signatures from multiple keys, allowing signing keys to be
+// rotated without rejecting messages in flight.
+type Keys struct {
+	mtx  sync.RWMutex
+	keys map[string]func(message, signature []byte) bool
+}
+
+// NewKeys returns an empty set of verification Keys.
+func NewKeys() *Keys {
+	return &Keys{keys: make(map[string]func(message, signature []byte) bool)}
+}
+
+// AddHMACKey accepts HMAC-SHA256 signatures made with the secret.
+func (k *Keys) AddHMACKey(keyID string, secret []byte) *Keys {
+	return k.add(keyID, func(message, signature []byte) bool {
+		return hmac.Equal(hmacSum(secret, message), signature)
+	})
+}
+
+// AddEd25519Key accepts Ed25519 signatures made by the public key's private key.
+func (k *Keys) AddEd25519Key(keyID string, key ed25519.PublicKey) *Keys {
+	return k.add(keyID, func(message, signature []byte) bool {
+		return ed25519.Verify(key, message, signature)
+	})
+}
+
+// RemoveKey stops accepting signatures made by the key with the provided ID.
+func (k *Keys) RemoveKey(keyID string) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	delete(k.keys, keyID)
+}
+
+func (k *Keys) add(keyID string, verify func(message, signature []byte) bool) *Keys {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	k.keys[keyID] = verify
+	return k
+}
+
+func (k *Keys) Verify(keyID string, message, signature []byte) error {
+	k.mtx.RLock()
+	verify, ok := k.keys[keyID]
+	k.mtx.RUnlock()
+	if !ok {
+		return ErrUnknownKey
+	}
+	if !verify(message, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+func TestSignVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := NewKeys().
+		AddHMACKey("hmac", []byte("secret")).
+		AddEd25519Key("ed25519", public)
+	headers := map[string]string{"content_encoding": "gzip"}
+	payload := []byte(`{"importJobId":"1"}`)
+
+	for _, signer := range []Signer{NewHMACSigner("hmac", []byte("secret")), NewEd25519Signer("ed25519", private)} {
+		keyID, signature, err := signer.Sign(Message("order-1", headers, payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keys.Verify(keyID, Message("order-1", headers, payload), signature); err != nil {
+			t.Errorf("%s: expected signature to verify, got %v", keyID, err)
+		}
+		tampered := map[string]string{"content_encoding": "zstd"}
+		if err := keys.Verify(keyID, Message("order-1", tampered, payload), signature); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: expected tampered headers to fail verification, got %v", keyID, err)
+		}
+		if err := keys.Verify(keyID, Message("order-2", headers, payload), signature); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: expected tampered correlation ID to fail verification, got %v", keyID, err)
+		}
+	}
+
+	keyID, signature, _ := NewHMACSigner("unknown", []byte("secret")).Sign(Message("order-1", headers, payload))
+	if err := keys.Verify(keyID, Message("order-1", headers, payload), signature); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package sqs
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+
+	"queue"
+)
+
+// Count returns the approximate number of messages available in the queue.
+func (s *SQSQueueMux) Count(ctx context.Context, uri string) (int, error) {
+	svc, queueURL, err := getQueueURL(uri)
+	if err != nil {
+		return 0, err
+	}
+	res, err := svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       queueURL,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(aws.StringValue(res.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]))
+}
+
+// Purge deletes all the messages in the queue. SQS permits one purge per queue every 60 seconds.
+func (s *SQSQueueMux) Purge(ctx context.Context, uri string) error {
+	svc, queueURL, err := getQueueURL(uri)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PurgeQueue(&sqs.PurgeQueueInput{
+		QueueUrl: queueURL,
+	})
+	return err
+}
+
+// Peek receives up to max messages with a visibility timeout of zero, so they remain available
+// to consumers. Peeked messages count towards the receive count of the redrive policy.
+func (s *SQSQueueMux) Peek(ctx context.Context, uri string, max int) ([]queue.PeekedMessage, error) {
+	svc, queueURL, err := getQueueURL(uri)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var msgs []queue.PeekedMessage
+	for len(msgs) < max {
+		batch := int64(max - len(msgs))
+		if batch > defaultMaxMessages {
+			batch = defaultMaxMessages
+		}
+		res, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:            queueURL,
+			MaxNumberOfMessages: aws.Int64(batch),
+			VisibilityTimeout:   aws.Int64(0),
+			MessageAttributeNames: []*string{
+				aws.String("All"),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		added := 0
+		for _, msg := range res.Messages {
+			id := aws.StringValue(msg.MessageId)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			body, err := messageBody(msg)
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, queue.PeekedMessage{
+				ID:            id,
+				CorrelationID: safelyGetCorrelationID(msg),
+				Headers:       headersFromAttributes(msg),
+				Data:          body,
+			})
+			added++
+		}
+		// Messages are immediately visible again so the same messages may be received,
+		// stop once no new messages are returned.
+		if added == 0 {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+func getQueueURL(uri string) (sqsiface.SQSAPI, *string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme != sqsScheme {
+		return nil, nil, errIncorrectScheme
+	}
+	svc := GetSQS()
+	res, err := svc.GetQueueUrl(&sqs.GetQueueUrlInput{
+		QueueName: aws.String(u.Hostname()),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return svc, res.QueueUrl, nil
+}
@@ -0,0 +1,118 @@
+package sqs
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/google/uuid"
+
+	"queue/queuetest"
+)
+
+// FakeSQS is an in-memory SQS supporting the calls made by the SQSQueueMux. Received messages
+// are hidden for the visibility timeout and redelivered unless they are deleted.
+type FakeSQS struct {
+	sqsiface.SQSAPI
+	visibility time.Duration
+
+	mtx    sync.Mutex
+	queues map[string][]*fakeMessage
+}
+
+type fakeMessage struct {
+	msg       sqs.Message
+	visibleAt time.Time
+}
+
+func newFakeSQS(visibility time.Duration) *FakeSQS {
+	return &FakeSQS{visibility: visibility, queues: make(map[string][]*fakeMessage)}
+}
+
+func (f *FakeSQS) GetQueueUrl(i *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{
+		QueueUrl: aws.String("https://sqs.fake/" + aws.StringValue(i.QueueName)),
+	}, nil
+}
+
+func (f *FakeSQS) GetQueueAttributes(i *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return &sqs.GetQueueAttributesOutput{
+		Attributes: map[string]*string{
+			sqs.QueueAttributeNameVisibilityTimeout:           aws.String(strconv.Itoa(int(f.visibility / time.Second))),
+			sqs.QueueAttributeNameApproximateNumberOfMessages: aws.String(strconv.Itoa(len(f.queues[aws.StringValue(i.QueueUrl)]))),
+		},
+	}, nil
+}
+
+func (f *FakeSQS) SendMessage(i *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	id := uuid.NewString()
+	url := aws.StringValue(i.QueueUrl)
+	f.queues[url] = append(f.queues[url], &fakeMessage{msg: sqs.Message{
+		MessageId:         aws.String(id),
+		Body:              i.MessageBody,
+		MessageAttributes: i.MessageAttributes,
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameSentTimestamp: aws.String(strconv.FormatInt(time.Now().UnixMilli(), 10)),
+		},
+	}})
+	return &sqs.SendMessageOutput{MessageId: aws.String(id)}, nil
+}
+
+func (f *FakeSQS) ReceiveMessage(i *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	visibility := f.visibility
+	if i.VisibilityTimeout != nil {
+		visibility = time.Duration(*i.VisibilityTimeout) * time.Second
+	}
+	now := time.Now()
+	out := &sqs.ReceiveMessageOutput{}
+	for _, m := range f.queues[aws.StringValue(i.QueueUrl)] {
+		if int64(len(out.Messages)) == aws.Int64Value(i.MaxNumberOfMessages) {
+			break
+		}
+		if m.visibleAt.After(now) {
+			continue
+		}
+		m.visibleAt = now.Add(visibility)
+		// Each receive issues a new receipt handle, only the latest can delete the message.
+		m.msg.ReceiptHandle = aws.String(uuid.NewString())
+		msg := m.msg
+		out.Messages = append(out.Messages, &msg)
+	}
+	return out, nil
+}
+
+func (f *FakeSQS) DeleteMessage(i *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	url := aws.StringValue(i.QueueUrl)
+	for n, m := range f.queues[url] {
+		if aws.StringValue(m.msg.ReceiptHandle) == aws.StringValue(i.ReceiptHandle) {
+			f.queues[url] = append(f.queues[url][:n], f.queues[url][n+1:]...)
+			break
+		}
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func TestSQSQueueMux_Conformance(t *testing.T) {
+	fake := newFakeSQS(100 * time.Millisecond)
+	GetSQS = func() sqsiface.SQSAPI { return fake }
+	defer func() { GetSQS = getSQS }()
+	queuetest.RunConformance(t, queuetest.Factory{
+		URI: func(name string) string {
+			return "sqs://" + name + "?waitTime=0&maxBackoff=20ms"
+		},
+		Queue:  newSQSQueueMux().Queue,
+		Settle: 400 * time.Millisecond,
+	})
+}
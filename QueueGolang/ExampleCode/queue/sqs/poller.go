@@ -0,0 +1,298 @@
+package sqs
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"queue"
+	"queue/options"
+)
+
+var (
+	defaultMaxBackoff   = 30 * time.Second
+	defaultWaitTime     = int64(20)
+	defaultMaxMessages  = int64(10)
+	defaultMaxReceivers = 1
+
+	apiCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "queue_sqs_api_calls_total",
+		Help: "The number of calls made to the SQS API.",
+	}, []string{"uri", "operation", "result"})
+)
+
+// pollerConfig configures the adaptive polling of an SQS queue. It is read from the query
+// parameters of the queue URI, i.e. sqs://name?receivers=4&maxMessages=10&waitTime=20&maxBackoff=30s
+type pollerConfig struct {
+	// The maximum number of concurrent receivers.
+	maxReceivers int
+	// The maximum number of messages requested per ReceiveMessage call (1-10).
+	maxMessages int64
+	// The long poll duration in seconds (0-20).
+	waitTime int64
+	// The maximum backoff between ReceiveMessage calls when the queue is erroring, or idle
+	// without long polling.
+	maxBackoff time.Duration
+}
+
+func parsePollerConfig(u *url.URL) (pollerConfig, error) {
+	cfg := pollerConfig{
+		maxReceivers: defaultMaxReceivers,
+		maxMessages:  defaultMaxMessages,
+		waitTime:     defaultWaitTime,
+		maxBackoff:   defaultMaxBackoff,
+	}
+	q := u.Query()
+	if v := q.Get("receivers"); v != "" {
+		receivers, err := strconv.Atoi(v)
+		if err != nil || receivers < 1 {
+			return cfg, fmt.Errorf("invalid receivers %q, should be a positive integer", v)
+		}
+		cfg.maxReceivers = receivers
+	}
+	if v := q.Get("maxMessages"); v != "" {
+		maxMessages, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxMessages < 1 || maxMessages > 10 {
+			return cfg, fmt.Errorf("invalid maxMessages %q, should be between 1 and 10", v)
+		}
+		cfg.maxMessages = maxMessages
+	}
+	if v := q.Get("waitTime"); v != "" {
+		waitTime, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || waitTime < 0 || waitTime > 20 {
+			return cfg, fmt.Errorf("invalid waitTime %q, should be between 0 and 20", v)
+		}
+		cfg.waitTime = waitTime
+	}
+	if v := q.Get("maxBackoff"); v != "" {
+		maxBackoff, err := time.ParseDuration(v)
+		if err != nil || maxBackoff < 0 {
+			return cfg, fmt.Errorf("invalid maxBackoff %q, should be a duration", v)
+		}
+		cfg.maxBackoff = maxBackoff
+	}
+	return cfg, nil
+}
+
+// poller adaptively polls an SQS queue. The number of messages requested per call grows while
+// receives return full batches and shrinks as they empty, the delay between calls grows
+// exponentially while the queue is erroring, or idle when long polling is disabled, and additional receivers are started
+// (up to the configured maximum) while a queue is hot.
+type poller struct {
+	handler  *queue.QueueHandler
+	svc      sqsiface.SQSAPI
+	queueURL *string
+	cfg      pollerConfig
+
+	mtx       sync.Mutex
+	receivers int
+	wg        sync.WaitGroup
+}
+
+func newPoller(handler *queue.QueueHandler, svc sqsiface.SQSAPI, queueURL *string, cfg pollerConfig) *poller {
+	return &poller{
+		handler:  handler,
+		svc:      svc,
+		queueURL: queueURL,
+		cfg:      cfg,
+	}
+}
+
+// run starts the primary receiver and blocks until all receivers have stopped.
+func (p *poller) run() {
+	p.startReceiver(true)
+	p.wg.Wait()
+}
+
+// startReceiver starts a receiver unless the maximum number of receivers are running. The
+// primary receiver runs until shutdown, others stop once the queue is no longer hot.
+func (p *poller) startReceiver(primary bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.receivers >= p.cfg.maxReceivers {
+		return
+	}
+	p.receivers++
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.receive(primary)
+		p.mtx.Lock()
+		p.receivers--
+		p.mtx.Unlock()
+	}()
+}
+
+func (p *poller) receive(primary bool) {
+	batch := int64(1)
+	var backoff time.Duration
+	for {
+		if backoff > 0 && !p.sleep(backoff) {
+			return
+		}
+		// Wait until the handler is permitted to consume another message.
+		if err := p.handler.Wait(); err != nil {
+			return
+		}
+		msgs, err := p.svc.ReceiveMessage(&sqs.ReceiveMessageInput{
+			MaxNumberOfMessages: aws.Int64(batch),
+			WaitTimeSeconds:     aws.Int64(p.cfg.waitTime),
+			QueueUrl:            p.queueURL,
+			MessageAttributeNames: []*string{
+				aws.String("All"),
+			},
+			AttributeNames: []*string{
+				aws.String(sqs.MessageSystemAttributeNameSentTimestamp),
+			},
+		})
+		if err != nil {
+			apiCalls.WithLabelValues(p.handler.URI(), "ReceiveMessage", "error").Inc()
+			p.handler.Logger().WithError(err).Warn("error receiving message from queue")
+			backoff = p.nextBackoff(backoff)
+			continue
+		}
+		if len(msgs.Messages) == 0 {
+			apiCalls.WithLabelValues(p.handler.URI(), "ReceiveMessage", "empty").Inc()
+			if !primary {
+				return
+			}
+			batch = 1
+			// A long poll already waited for messages, backing off on top of it would only
+			// delay messages published once the queue is idle.
+			if p.cfg.waitTime > 0 {
+				backoff = 0
+				continue
+			}
+			backoff = p.nextBackoff(backoff)
+			continue
+		}
+		apiCalls.WithLabelValues(p.handler.URI(), "ReceiveMessage", "success").Inc()
+		backoff = 0
+		for i, msg := range msgs.Messages {
+			// The first message was permitted before receiving, subsequent messages
+			// in the batch must also be permitted. Messages are released rather than held
+			// past their visibility timeout while consumption is paused or the circuit
+			// breaker is open, the next receive waits until it resumes.
+			if i > 0 {
+				if p.handler.Blocked() {
+					p.release(msgs.Messages[i:])
+					break
+				}
+				if err := p.handler.Wait(); err != nil {
+					return
+				}
+			}
+			p.handle(msg)
+		}
+		if int64(len(msgs.Messages)) < batch {
+			if batch /= 2; batch < 1 {
+				batch = 1
+			}
+			continue
+		}
+		if batch < p.cfg.maxMessages {
+			if batch *= 2; batch > p.cfg.maxMessages {
+				batch = p.cfg.maxMessages
+			}
+			continue
+		}
+		// Full batches at the maximum size indicate a hot queue.
+		p.startReceiver(false)
+	}
+}
+
+func (p *poller) handle(msg *sqs.Message) {
+	ctx := options.ContextWithPublishOptions(options.NewMessageContext(), options.Merge(
+		options.WithCorrelationID(safelyGetCorrelationID(msg)),
+		options.WithHeaders(headersFromAttributes(msg)),
+	))
+	ctx = options.ContextWithMessageID(ctx, aws.StringValue(msg.MessageId))
+	if sent, ok := sentTime(msg); ok {
+		ctx = options.ContextWithSentTime(ctx, sent)
+	}
+	body, err := messageBody(msg)
+	if err != nil {
+		p.handler.MessageLogger(ctx).WithError(err).Error("decoding message body")
+		return
+	}
+	err = <-p.handler.Receive(ctx, body)
+	// The message should be deleted if there is no error, otherwise, if the handler
+	// has set the message delete value it should use that behaviour.
+	shouldDelete := err == nil
+	if shouldDeleteValue, isDeleteSet := options.GetMessageDeleteValue(ctx); isDeleteSet {
+		shouldDelete = shouldDeleteValue
+	}
+	// If shouldDelete is true delete the message from sqs.
+	if shouldDelete {
+		_, err = p.svc.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      p.queueURL,
+			ReceiptHandle: msg.ReceiptHandle,
+		})
+		if err != nil {
+			apiCalls.WithLabelValues(p.handler.URI(), "DeleteMessage", "error").Inc()
+			p.handler.MessageLogger(ctx).WithError(err).Error("deleting processed message")
+			return
+		}
+		apiCalls.WithLabelValues(p.handler.URI(), "DeleteMessage", "success").Inc()
+	}
+}
+
+// release makes the received messages visible again so they are redelivered, to this or another
+// consumer, without waiting for their visibility timeout to expire.
+func (p *poller) release(msgs []*sqs.Message) {
+	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, 0, len(msgs))
+	for i, msg := range msgs {
+		entries = append(entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			ReceiptHandle:     msg.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(0),
+		})
+	}
+	out, err := p.svc.ChangeMessageVisibilityBatch(&sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: p.queueURL,
+		Entries:  entries,
+	})
+	if err != nil {
+		apiCalls.WithLabelValues(p.handler.URI(), "ChangeMessageVisibilityBatch", "error").Inc()
+		p.handler.Logger().WithError(err).Warn("error releasing messages, they are redelivered once their visibility timeout expires")
+		return
+	}
+	apiCalls.WithLabelValues(p.handler.URI(), "ChangeMessageVisibilityBatch", "success").Inc()
+	for _, failed := range out.Failed {
+		p.handler.Logger().
+			WithField("code", aws.StringValue(failed.Code)).
+			Warn("error releasing message, it is redelivered once its visibility timeout expires")
+	}
+}
+
+// nextBackoff doubles the backoff, starting from the default backoff, up to the maximum.
+func (p *poller) nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff == 0 {
+		backoff = defaultBackoff
+	}
+	if backoff > p.cfg.maxBackoff {
+		backoff = p.cfg.maxBackoff
+	}
+	return backoff
+}
+
+// sleep sleeps for the provided duration, it returns false if the handler is closed.
+func (p *poller) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-p.handler.Done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -1,13 +1,15 @@
 package sqs
 
 import (
-	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/url"
 	"strconv"
 	"time"
+	"unicode/utf8"
 
-	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
@@ -23,8 +25,25 @@ var (
 	GetSQS = getSQS
 
 	correlationIDAttributeKey = "correlation_id"
+	bodyEncodingAttributeKey  = "body_encoding"
+	bodyEncodingBase64        = "base64"
+	metadataAttributeKey      = "queue_metadata"
+	// SQS accepts at most 10 message attributes per message.
+	maxMessageAttributes = 10
+
+	// internalHeaders are the headers set by the QueueHandler, which are sent in the metadata
+	// attribute rather than as message attributes of their own.
+	internalHeaders = append(queue.PayloadHeaders(), codec.Header, queue.SchemaVersionHeader)
 )
 
+// metadata is the queue-internal metadata of a message, sent as a single JSON encoded message
+// attribute so that it only counts once towards the message attribute limit.
+type metadata struct {
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	BodyEncoding  string            `json:"body_encoding,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+}
+
 func init() {
 	queue.Register(sqsScheme, newSQSQueueMux())
 }
@@ -69,12 +88,12 @@ func getVisibility(handler *queue.QueueHandler) (time.Duration, error) {
 	})
 
 	if err != nil {
-		log.WithError(err).Error("failed to get queue url")
+		handler.Logger().WithError(err).Error("failed to get queue url")
 	}
 	a := "All"
 	attributes, err := svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{QueueUrl: res.QueueUrl, AttributeNames: []*string{&a}})
 	if err != nil {
-		log.WithError(err).Error("")
+		handler.Logger().WithError(err).Error("failed to get queue attributes")
 	}
 	visibility, err := strconv.Atoi(*attributes.Attributes["VisibilityTimeout"]) // This is the time in seconds
 	if err != nil {
@@ -92,6 +111,10 @@ func pollForIncomingMessages(handler *queue.QueueHandler) error {
 	if u.Scheme != sqsScheme {
 		return errIncorrectScheme
 	}
+	cfg, err := parsePollerConfig(u)
+	if err != nil {
+		return err
+	}
 	svc := GetSQS()
 	res, err := svc.GetQueueUrl(&sqs.GetQueueUrlInput{
 		QueueName: aws.String(u.Hostname()),
@@ -102,54 +125,9 @@ func pollForIncomingMessages(handler *queue.QueueHandler) error {
 	go func() {
 		// Wait for the handler to be ready before beginning consumption.
 		<-handler.Ready
-		log.WithField("uri", handler.URI()).Info("queue consumer starting")
-		for {
-			select {
-			case <-handler.Done:
-				log.WithField("uri", handler.URI()).Info("queue consumer shutting down")
-				break
-			default:
-			}
-			msgs, err := svc.ReceiveMessage(&sqs.ReceiveMessageInput{
-				WaitTimeSeconds: aws.Int64(10),
-				QueueUrl:        res.QueueUrl,
-				MessageAttributeNames: []*string{
-					aws.String(correlationIDAttributeKey),
-				},
-			})
-
-			if err != nil {
-				log.WithField("uri", handler.URI()).WithError(err).Warn("error receiving message from queue")
-				time.Sleep(defaultBackoff)
-				continue
-			}
-			for _, msg := range msgs.Messages {
-				ctx := options.ContextWithPublishOptions(context.Background(), options.Merge(
-					options.WithCorrelationID(safelyGetCorrelationID(msg)),
-				))
-				err := <-handler.Receive(ctx, []byte(aws.StringValue(msg.Body)))
-				if err != nil {
-					continue
-				}
-				// The message should be deleted if there is no error, otherwise, if the handler
-				// has set the message delete value it should use that behaviour.
-				shouldDelete := err == nil
-				if shouldDeleteValue, isDeleteSet := options.GetMessageDeleteValue(ctx); isDeleteSet {
-					shouldDelete = shouldDeleteValue
-				}
-				// If shouldDelete is true delete the message from sqs.
-				if shouldDelete {
-					_, err = svc.DeleteMessage(&sqs.DeleteMessageInput{
-						QueueUrl:      res.QueueUrl,
-						ReceiptHandle: msg.ReceiptHandle,
-					})
-					if err != nil {
-						log.WithField("uri", handler.URI()).WithError(err).Error("deleting processed message")
-						continue
-					}
-				}
-			}
-		}
+		handler.Logger().Info("queue consumer starting")
+		newPoller(handler, svc, res.QueueUrl, cfg).run()
+		handler.Logger().Info("queue consumer shutting down")
 	}()
 	return nil
 }
@@ -174,27 +152,36 @@ func pollForOutgoingMessages(handler *queue.QueueHandler) error {
 		for {
 			select {
 			case <-handler.Done:
-				log.WithField("uri", handler.URI()).Info("queue publisher shutting down")
+				handler.Logger().Info("queue publisher shutting down")
 				break LOOP
 			case outgoing := <-handler.Outgoing:
-				messageAttributes := make(map[string]*sqs.MessageAttributeValue)
-				opts, ok := options.PublishOptionsFromContext(outgoing.Context)
-				if ok {
-					messageAttributes[correlationIDAttributeKey] = &sqs.MessageAttributeValue{
-						StringValue: opts.CorrelationID,
-						DataType:    aws.String("String"),
-					}
+				// SQS only accepts text message bodies, binary payloads (i.e. compressed or
+				// encrypted) are base64 encoded.
+				body := string(outgoing.Data)
+				encoding := ""
+				if !isValidMessageBody(outgoing.Data) {
+					body = base64.StdEncoding.EncodeToString(outgoing.Data)
+					encoding = bodyEncodingBase64
+				}
+				opts, _ := options.PublishOptionsFromContext(outgoing.Context)
+				messageAttributes, err := newMessageAttributes(opts, encoding)
+				if err != nil {
+					outgoing.Err <- err
+					outgoing.Close()
+					continue
 				}
 				_, err = svc.SendMessage(&sqs.SendMessageInput{
-					MessageBody:       aws.String(string(outgoing.Data)),
+					MessageBody:       aws.String(body),
 					MessageAttributes: messageAttributes,
 					QueueUrl:          res.QueueUrl,
 				})
 				if err != nil {
+					apiCalls.WithLabelValues(handler.URI(), "SendMessage", "error").Inc()
 					outgoing.Err <- err
 					outgoing.Close()
 					continue
 				}
+				apiCalls.WithLabelValues(handler.URI(), "SendMessage", "success").Inc()
 				outgoing.Close()
 			}
 		}
@@ -202,14 +189,134 @@ func pollForOutgoingMessages(handler *queue.QueueHandler) error {
 	return nil
 }
 
+// newMessageAttributes returns the message attributes of a message, the queue-internal metadata
+// is sent as one attribute and the other headers as an attribute each. It returns an error if
+// the message has more headers than SQS accepts message attributes.
+func newMessageAttributes(opts options.PublishOptions, bodyEncoding string) (map[string]*sqs.MessageAttributeValue, error) {
+	md := metadata{CorrelationID: aws.StringValue(opts.CorrelationID), BodyEncoding: bodyEncoding}
+	messageAttributes := make(map[string]*sqs.MessageAttributeValue)
+	for k, v := range opts.Headers {
+		if isInternalHeader(k) {
+			if md.Headers == nil {
+				md.Headers = make(map[string]string)
+			}
+			md.Headers[k] = v
+			continue
+		}
+		messageAttributes[k] = &sqs.MessageAttributeValue{
+			StringValue: aws.String(v),
+			DataType:    aws.String("String"),
+		}
+	}
+	if md.CorrelationID != "" || md.BodyEncoding != "" || md.Headers != nil {
+		data, err := json.Marshal(md)
+		if err != nil {
+			return nil, err
+		}
+		messageAttributes[metadataAttributeKey] = &sqs.MessageAttributeValue{
+			StringValue: aws.String(string(data)),
+			DataType:    aws.String("String"),
+		}
+	}
+	if len(messageAttributes) > maxMessageAttributes {
+		return nil, fmt.Errorf("message has %d message attributes, including the queue metadata, SQS accepts at most %d", len(messageAttributes), maxMessageAttributes)
+	}
+	return messageAttributes, nil
+}
+
+func isInternalHeader(k string) bool {
+	for _, h := range internalHeaders {
+		if k == h {
+			return true
+		}
+	}
+	return false
+}
+
+// messageMetadata returns the queue-internal metadata of a received message. Messages sent
+// before the metadata attribute was introduced have the correlation ID and body encoding as
+// message attributes of their own.
+func messageMetadata(msg *sqs.Message) metadata {
+	var md metadata
+	if attr, ok := msg.MessageAttributes[metadataAttributeKey]; ok {
+		if err := json.Unmarshal([]byte(aws.StringValue(attr.StringValue)), &md); err == nil {
+			return md
+		}
+	}
+	if attr, ok := msg.MessageAttributes[correlationIDAttributeKey]; ok {
+		md.CorrelationID = aws.StringValue(attr.StringValue)
+	}
+	if attr, ok := msg.MessageAttributes[bodyEncodingAttributeKey]; ok {
+		md.BodyEncoding = aws.StringValue(attr.StringValue)
+	}
+	return md
+}
+
 func getSQS() sqsiface.SQSAPI {
 	sess := session.New(aws.NewConfig())
 	return sqs.New(sess)
 }
 
 func safelyGetCorrelationID(msg *sqs.Message) string {
-	if attr, ok := msg.MessageAttributes[correlationIDAttributeKey]; ok {
-		return aws.StringValue(attr.StringValue)
+	return messageMetadata(msg).CorrelationID
+}
+
+// sentTime returns the time the message was sent from its SentTimestamp attribute, which is
+// in milliseconds since the epoch.
+func sentTime(msg *sqs.Message) (time.Time, bool) {
+	ms, err := strconv.ParseInt(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+// headersFromAttributes returns the message attributes, other than the correlation ID, and the
+// headers in the queue metadata as headers.
+func headersFromAttributes(msg *sqs.Message) map[string]string {
+	var headers map[string]string
+	for k, v := range messageMetadata(msg).Headers {
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[k] = v
+	}
+	for k, attr := range msg.MessageAttributes {
+		if k == correlationIDAttributeKey || k == bodyEncodingAttributeKey || k == metadataAttributeKey || attr.StringValue == nil {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[k] = *attr.StringValue
+	}
+	return headers
+}
+
+// messageBody returns the message body, decoding it if it was base64 encoded when sent.
+func messageBody(msg *sqs.Message) ([]byte, error) {
+	body := aws.StringValue(msg.Body)
+	if messageMetadata(msg).BodyEncoding == bodyEncodingBase64 {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
+
+// isValidMessageBody returns whether the data only contains characters permitted in an SQS
+// message body.
+func isValidMessageBody(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		switch {
+		case r == 0x9 || r == 0xA || r == 0xD:
+		case r >= 0x20 && r <= 0xD7FF:
+		case r >= 0xE000 && r <= 0xFFFD:
+		case r >= 0x10000 && r <= 0x10FFFF:
+		default:
+			return false
+		}
 	}
-	return ""
+	return true
 }
@@ -2,17 +2,30 @@ package sqs
 
 import (
 	"context"
+	"errors"
+	"net/url"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+
+	"queue"
+	"queue/codec"
+	"queue/compression"
+	"queue/options"
+	"queue/signing"
 )
 
+// TestSQS records the calls made to it, they are guarded by the mutex as messages are received
+// and deleted by the poller goroutines.
 type TestSQS struct {
 	sqsiface.SQSAPI
+	mtx                      sync.Mutex
 	queueUrl                 string
 	queueUrlCalledWith       *sqs.GetQueueUrlInput
 	receiveMessageCalledWith *sqs.ReceiveMessageInput
@@ -22,6 +35,8 @@ type TestSQS struct {
 }
 
 func (t *TestSQS) GetQueueAttributes(i *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
 	t.queueVisbilityCalledWith = i
 
 	v := "30"
@@ -32,6 +47,8 @@ func (t *TestSQS) GetQueueAttributes(i *sqs.GetQueueAttributesInput) (*sqs.GetQu
 }
 
 func (t *TestSQS) GetQueueUrl(i *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
 	t.queueUrlCalledWith = i
 	return &sqs.GetQueueUrlOutput{
 		QueueUrl: aws.String(t.queueUrl),
@@ -39,6 +56,8 @@ func (t *TestSQS) GetQueueUrl(i *sqs.GetQueueUrlInput) (*sqs.GetQueueUrlOutput,
 }
 
 func (t *TestSQS) ReceiveMessage(i *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
 	t.receiveMessageCalledWith = i
 	return &sqs.ReceiveMessageOutput{
 		Messages: []*sqs.Message{
@@ -50,6 +69,8 @@ func (t *TestSQS) ReceiveMessage(i *sqs.ReceiveMessageInput) (*sqs.ReceiveMessag
 }
 
 func (t *TestSQS) DeleteMessage(i *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
 	t.deleteMessageCalledWith = i
 	return &sqs.DeleteMessageOutput{}, nil
 }
@@ -61,21 +82,21 @@ func TestSQSQueueMux_Queue(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
-		sqs     TestSQS
+		sqs     *TestSQS
 		expect  func(sqs *TestSQS)
 		wantErr bool
 	}{
 		{
 			"invalid scheme should error",
 			args{"foo://"},
-			TestSQS{},
+			&TestSQS{},
 			nil,
 			true,
 		},
 		{
 			"correct scheme should create queue",
 			args{"sqs://someuri"},
-			TestSQS{queueUrl: "someurl", receiptHandle: "somehandle"},
+			&TestSQS{queueUrl: "someurl", receiptHandle: "somehandle"},
 			func(sqs *TestSQS) {
 				if !reflect.DeepEqual(*sqs.queueUrlCalledWith.QueueName, "someuri") {
 					t.Errorf("expected someuri got %s", *sqs.queueUrlCalledWith.QueueName)
@@ -93,7 +114,7 @@ func TestSQSQueueMux_Queue(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			GetSQS = func() sqsiface.SQSAPI {
-				return &tt.sqs
+				return tt.sqs
 			}
 			s := &SQSQueueMux{}
 			handler, err := s.Queue(tt.args.uri)
@@ -111,7 +132,9 @@ func TestSQSQueueMux_Queue(t *testing.T) {
 				// Short sleep to wait for queue polling to occur.
 				time.Sleep(100 * time.Millisecond)
 				if tt.expect != nil {
-					tt.expect(&tt.sqs)
+					tt.sqs.mtx.Lock()
+					tt.expect(tt.sqs)
+					tt.sqs.mtx.Unlock()
 				}
 				// Close the handler and shutdown queues.
 				handler.Close()
@@ -119,3 +142,351 @@ func TestSQSQueueMux_Queue(t *testing.T) {
 		})
 	}
 }
+
+func TestParsePollerConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		want    pollerConfig
+		wantErr bool
+	}{
+		{
+			"defaults",
+			"sqs://someuri",
+			pollerConfig{maxReceivers: 1, maxMessages: 10, waitTime: 20, maxBackoff: 30 * time.Second},
+			false,
+		},
+		{
+			"query parameters override defaults",
+			"sqs://someuri?receivers=4&maxMessages=5&waitTime=0&maxBackoff=5s",
+			pollerConfig{maxReceivers: 4, maxMessages: 5, waitTime: 0, maxBackoff: 5 * time.Second},
+			false,
+		},
+		{
+			"max messages above the sqs limit should error",
+			"sqs://someuri?maxMessages=11",
+			pollerConfig{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parsePollerConfig(u)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parsePollerConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePollerConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// BatchSQS returns as many messages as requested, recording the batch sizes requested.
+type BatchSQS struct {
+	sqsiface.SQSAPI
+	mtx     sync.Mutex
+	batches []int64
+}
+
+func (b *BatchSQS) ReceiveMessage(i *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.batches = append(b.batches, *i.MaxNumberOfMessages)
+	out := &sqs.ReceiveMessageOutput{}
+	for n := int64(0); n < *i.MaxNumberOfMessages; n++ {
+		out.Messages = append(out.Messages, &sqs.Message{ReceiptHandle: aws.String("handle")})
+	}
+	return out, nil
+}
+
+func (b *BatchSQS) DeleteMessage(i *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func TestPoller_AdaptiveBatchSize(t *testing.T) {
+	svc := &BatchSQS{}
+	handler := queue.NewQueueHandler("sqs://someuri", 1).
+		AddHandler(func(ctx context.Context, d []byte) error {
+			return nil
+		})
+	handler.Start()
+	cfg := pollerConfig{maxReceivers: 1, maxMessages: 10, waitTime: 20, maxBackoff: time.Second}
+	go newPoller(handler, svc, aws.String("someurl"), cfg).run()
+	time.Sleep(50 * time.Millisecond)
+	handler.Close()
+
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	expected := []int64{1, 2, 4, 8, 10, 10}
+	if len(svc.batches) < len(expected) || !reflect.DeepEqual(svc.batches[:len(expected)], expected) {
+		t.Errorf("expected batch sizes to start %v, got %v", expected, svc.batches)
+	}
+}
+
+// EmptySQS returns no messages, recording the number of receives.
+type EmptySQS struct {
+	sqsiface.SQSAPI
+	mtx      sync.Mutex
+	receives int
+}
+
+func (e *EmptySQS) ReceiveMessage(i *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.receives++
+	return &sqs.ReceiveMessageOutput{}, nil
+}
+
+func TestPoller_IdleBackoff(t *testing.T) {
+	tests := []struct {
+		name         string
+		waitTime     int64
+		wantReceives func(int) bool
+	}{
+		// The long poll waits for messages so empty receives are retried immediately.
+		{"long polling", 20, func(n int) bool { return n > 1 }},
+		// Without long polling empty receives back off.
+		{"short polling", 0, func(n int) bool { return n == 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &EmptySQS{}
+			handler := queue.NewQueueHandler("sqs://someuri", 1).
+				AddHandler(func(ctx context.Context, d []byte) error {
+					return nil
+				})
+			handler.Start()
+			cfg := pollerConfig{maxReceivers: 1, maxMessages: 10, waitTime: tt.waitTime, maxBackoff: time.Minute}
+			go newPoller(handler, svc, aws.String("someurl"), cfg).run()
+			time.Sleep(50 * time.Millisecond)
+			handler.Close()
+
+			svc.mtx.Lock()
+			defer svc.mtx.Unlock()
+			if !tt.wantReceives(svc.receives) {
+				t.Errorf("unexpected number of receives %d", svc.receives)
+			}
+		})
+	}
+}
+
+// ReleaseSQS returns a batch of messages once, recording the messages deleted and released.
+type ReleaseSQS struct {
+	sqsiface.SQSAPI
+	mtx      sync.Mutex
+	received bool
+	deleted  []string
+	released []string
+}
+
+func (r *ReleaseSQS) ReceiveMessage(i *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	out := &sqs.ReceiveMessageOutput{}
+	if !r.received {
+		r.received = true
+		for _, handle := range []string{"1", "2", "3"} {
+			out.Messages = append(out.Messages, &sqs.Message{ReceiptHandle: aws.String(handle)})
+		}
+	}
+	return out, nil
+}
+
+func (r *ReleaseSQS) DeleteMessage(i *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.deleted = append(r.deleted, aws.StringValue(i.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (r *ReleaseSQS) ChangeMessageVisibilityBatch(i *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, entry := range i.Entries {
+		if aws.Int64Value(entry.VisibilityTimeout) != 0 {
+			return nil, errors.New("expected visibility timeout of 0")
+		}
+		r.released = append(r.released, aws.StringValue(entry.ReceiptHandle))
+	}
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
+func TestPoller_ReleaseWhilePaused(t *testing.T) {
+	svc := &ReleaseSQS{}
+	handler := queue.NewQueueHandler("sqs://someuri", 1)
+	// Pausing while the first message of the batch is handled releases the rest of the batch.
+	handler.AddHandler(func(ctx context.Context, d []byte) error {
+		handler.Pause()
+		return nil
+	})
+	handler.Start()
+	cfg := pollerConfig{maxReceivers: 1, maxMessages: 10, waitTime: 20, maxBackoff: time.Second}
+	go newPoller(handler, svc, aws.String("someurl"), cfg).run()
+	time.Sleep(50 * time.Millisecond)
+	handler.Close()
+
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	if !reflect.DeepEqual(svc.deleted, []string{"1"}) {
+		t.Errorf("expected only the first message to be handled, got %v", svc.deleted)
+	}
+	if !reflect.DeepEqual(svc.released, []string{"2", "3"}) {
+		t.Errorf("expected the rest of the batch to be released, got %v", svc.released)
+	}
+}
+
+type AdminSQS struct {
+	TestSQS
+	messages   []*sqs.Message
+	purgedWith *sqs.PurgeQueueInput
+}
+
+func (a *AdminSQS) GetQueueAttributes(i *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	return &sqs.GetQueueAttributesOutput{
+		Attributes: map[string]*string{
+			sqs.QueueAttributeNameApproximateNumberOfMessages: aws.String("3"),
+		},
+	}, nil
+}
+
+// ReceiveMessage returns the messages from the start of the queue, as they are immediately
+// visible again when peeked.
+func (a *AdminSQS) ReceiveMessage(i *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	if aws.Int64Value(i.VisibilityTimeout) != 0 {
+		return nil, errors.New("expected visibility timeout of 0")
+	}
+	n := int(aws.Int64Value(i.MaxNumberOfMessages))
+	if n > len(a.messages) {
+		n = len(a.messages)
+	}
+	return &sqs.ReceiveMessageOutput{Messages: a.messages[:n]}, nil
+}
+
+func (a *AdminSQS) PurgeQueue(i *sqs.PurgeQueueInput) (*sqs.PurgeQueueOutput, error) {
+	a.purgedWith = i
+	return &sqs.PurgeQueueOutput{}, nil
+}
+
+func TestSQSQueueMux_Admin(t *testing.T) {
+	fake := &AdminSQS{TestSQS: TestSQS{queueUrl: "https://sqs/queue"}}
+	for _, id := range []string{"1", "2", "3"} {
+		fake.messages = append(fake.messages, &sqs.Message{
+			MessageId: aws.String(id),
+			Body:      aws.String(`{"id":"` + id + `"}`),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				correlationIDAttributeKey: {StringValue: aws.String("correlation-" + id)},
+				"source":                  {StringValue: aws.String("test")},
+			},
+		})
+	}
+	GetSQS = func() sqsiface.SQSAPI { return fake }
+	defer func() { GetSQS = getSQS }()
+	mux := newSQSQueueMux()
+	ctx := context.Background()
+
+	n, err := mux.Count(ctx, "sqs://queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected count of 3, got %d", n)
+	}
+
+	msgs, err := mux.Peek(ctx, "sqs://queue", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 peeked messages, got %d", len(msgs))
+	}
+	expected := queue.PeekedMessage{
+		ID:            "2",
+		CorrelationID: "correlation-2",
+		Headers:       map[string]string{"source": "test"},
+		Data:          []byte(`{"id":"2"}`),
+	}
+	if !reflect.DeepEqual(msgs[1], expected) {
+		t.Errorf("expected %+v, got %+v", expected, msgs[1])
+	}
+
+	err = mux.Purge(ctx, "sqs://queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(fake.purgedWith.QueueUrl) != "https://sqs/queue" {
+		t.Errorf("expected queue to be purged, got %v", fake.purgedWith)
+	}
+}
+
+func TestNewMessageAttributes(t *testing.T) {
+	userHeaders := func(n int) map[string]string {
+		headers := make(map[string]string)
+		for i := 0; i < n; i++ {
+			headers["header-"+strconv.Itoa(i)] = "value"
+		}
+		return headers
+	}
+	tests := []struct {
+		name       string
+		opts       options.PublishOptions
+		attributes int
+		wantErr    bool
+	}{
+		{
+			name: "internal headers are packed into the metadata",
+			opts: options.PublishOptions{
+				CorrelationID: aws.String("correlation"),
+				Headers: map[string]string{
+					"source":                  "test",
+					codec.Header:              codec.ContentTypeJSON,
+					queue.SchemaVersionHeader: "2",
+					signing.KeyIDHeader:       "key",
+					signing.SignatureHeader:   "signature",
+					compression.Header:        compression.Gzip,
+				},
+			},
+			attributes: 2,
+		},
+		{
+			name:       "attribute limit",
+			opts:       options.PublishOptions{CorrelationID: aws.String("correlation"), Headers: userHeaders(9)},
+			attributes: 10,
+		},
+		{
+			name:    "too many attributes",
+			opts:    options.PublishOptions{CorrelationID: aws.String("correlation"), Headers: userHeaders(10)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attributes, err := newMessageAttributes(tt.opts, bodyEncodingBase64)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newMessageAttributes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(attributes) != tt.attributes {
+				t.Errorf("expected %d message attributes, got %d", tt.attributes, len(attributes))
+			}
+			// The received message has the published correlation ID, headers and encoding.
+			msg := &sqs.Message{MessageAttributes: attributes}
+			if id := safelyGetCorrelationID(msg); id != "correlation" {
+				t.Errorf("expected correlation ID correlation, got %s", id)
+			}
+			if headers := headersFromAttributes(msg); !reflect.DeepEqual(headers, tt.opts.Headers) {
+				t.Errorf("expected headers %v, got %v", tt.opts.Headers, headers)
+			}
+			if md := messageMetadata(msg); md.BodyEncoding != bodyEncodingBase64 {
+				t.Errorf("expected body encoding %s, got %s", bodyEncodingBase64, md.BodyEncoding)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package queue
+
+import "context"
+
+// State is the consumption state of a QueueHandler.
+type State int
+
+const (
+	// StateIdle indicates the QueueHandler has not been started.
+	StateIdle State = iota
+	// StateRunning indicates the QueueHandler is consuming messages.
+	StateRunning
+	// StatePaused indicates consumption has been paused, connections to the underlying queue
+	// remain open and publishing is unaffected.
+	StatePaused
+	// StateClosed indicates the QueueHandler has been closed.
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateRunning:
+		return "running"
+	case StatePaused:
+		return "paused"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// State returns the consumption state of the QueueHandler.
+func (q *QueueHandler) State() State {
+	q.stateMtx.Lock()
+	defer q.stateMtx.Unlock()
+	return q.state()
+}
+
+// state returns the consumption state. It must be called with the state mutex held.
+func (q *QueueHandler) state() State {
+	switch {
+	case q.ctx.Err() != nil:
+		return StateClosed
+	case q.resumed != nil:
+		return StatePaused
+	case q.started:
+		return StateRunning
+	}
+	return StateIdle
+}
+
+// Pause stops the underlying queue implementation consuming messages without closing its
+// connections. Messages already being handled are unaffected. It may be called before Start
+// in which case consumption begins paused.
+func (q *QueueHandler) Pause() {
+	q.setState(func() {
+		if q.resumed == nil {
+			q.resumed = make(chan struct{})
+		}
+	})
+}
+
+// Resume resumes the consumption of messages after a call to Pause.
+func (q *QueueHandler) Resume() {
+	q.setState(func() {
+		if q.resumed != nil {
+			close(q.resumed)
+			q.resumed = nil
+		}
+	})
+}
+
+// OnStateChange registers a func that is called whenever the consumption state of the
+// QueueHandler changes. It is used by queue implementations to pause and resume consumption
+// of the underlying queue, e.g. by stopping message flow from a broker.
+func (q *QueueHandler) OnStateChange(fn func(from, to State)) {
+	q.stateMtx.Lock()
+	defer q.stateMtx.Unlock()
+	q.stateListeners = append(q.stateListeners, fn)
+}
+
+// setState applies the provided change to the state with the state mutex held and notifies
+// any listeners if the state changed.
+func (q *QueueHandler) setState(change func()) {
+	q.stateMtx.Lock()
+	from := q.state()
+	change()
+	to := q.state()
+	listeners := q.stateListeners
+	q.stateMtx.Unlock()
+	if from == to {
+		return
+	}
+	q.Logger().
+		WithField("from", from.String()).
+		WithField("to", to.String()).
+		Info("queue handler state changed")
+	for _, fn := range listeners {
+		fn(from, to)
+	}
+}
+
+// waitUntilResumed blocks while the QueueHandler is paused.
+func (q *QueueHandler) waitUntilResumed(ctx context.Context) error {
+	for {
+		q.stateMtx.Lock()
+		resumed := q.resumed
+		q.stateMtx.Unlock()
+		if resumed == nil {
+			return nil
+		}
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
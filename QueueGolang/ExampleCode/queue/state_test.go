@@ -0,0 +1,47 @@
+package queue
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueueHandler_PauseResume(t *testing.T) {
+	var transitions []State
+	q := NewQueueHandler("test://state", 1).
+		AddHandler(func(ctx context.Context, data []byte) error {
+			return nil
+		})
+	q.OnStateChange(func(from, to State) {
+		transitions = append(transitions, to)
+	})
+	if q.State() != StateIdle {
+		t.Fatalf("expected idle, got %s", q.State())
+	}
+	q.Start()
+	q.Pause()
+	if q.State() != StatePaused {
+		t.Fatalf("expected paused, got %s", q.State())
+	}
+
+	waited := make(chan error)
+	go func() {
+		waited <- q.Wait()
+	}()
+	select {
+	case <-waited:
+		t.Fatal("expected wait to block while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+	q.Resume()
+	if err := <-waited; err != nil {
+		t.Fatal(err)
+	}
+
+	q.Close()
+	expected := []State{StateRunning, StatePaused, StateRunning, StateClosed}
+	if !reflect.DeepEqual(transitions, expected) {
+		t.Errorf("expected transitions %v, got %v", expected, transitions)
+	}
+}
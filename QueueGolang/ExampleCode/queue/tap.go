@@ -0,0 +1,20 @@
+package queue
+
+import "context"
+
+// Tap observes the messages received and published by a QueueHandler, e.g. to record them. The
+// payloads are observed before they are encoded for publishing and after they are decoded when
+// received. Implementations must be safe for concurrent use and should not block.
+type Tap interface {
+	// Received is called with each message received before it is handled.
+	Received(ctx context.Context, uri string, data []byte)
+	// Published is called with each message that is successfully published.
+	Published(ctx context.Context, uri string, data []byte)
+}
+
+// SetTap sets the Tap that observes the messages received and published by the QueueHandler.
+// It should be called before Start. It returns the QueueHandler for chaining.
+func (q *QueueHandler) SetTap(t Tap) *QueueHandler {
+	q.tap = t
+	return q
+}
@@ -0,0 +1,278 @@
+// Package tap records the messages received and published by QueueHandlers to rotating JSONL
+// files and replays recordings into queues or handlers, e.g. to reproduce a production bug with
+// the exact messages a handler saw.
+package tap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"queue"
+	"queue/options"
+)
+
+const (
+	// DefaultMaxBytes is the default size of a recording file after which a new file is started.
+	DefaultMaxBytes = 64 << 20
+	// DefaultBufferSize is the default number of messages buffered to be written.
+	DefaultBufferSize = 1024
+)
+
+// Direction is whether a message was received or published.
+type Direction string
+
+const (
+	Received  Direction = "received"
+	Published Direction = "published"
+)
+
+// Record is a recorded message. Payloads are recorded decoded, i.e. decompressed, decrypted and
+// rehydrated from claim checks, and are base64 encoded in the JSONL files. Recordings are
+// therefore plaintext, even for encrypted queues, and are only readable by their owner.
+type Record struct {
+	Direction Direction `json:"direction"`
+	// Time is when the message was received or published.
+	Time time.Time `json:"time"`
+	// SentTime is when a received message was sent to the underlying queue, if known.
+	SentTime      *time.Time        `json:"sent_time,omitempty"`
+	URI           string            `json:"uri"`
+	MessageID     string            `json:"message_id,omitempty"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Payload       []byte            `json:"payload"`
+}
+
+// RecorderOptions configures a Recorder.
+type RecorderOptions struct {
+	// Dir is the directory the recording files are written to, it is created, only accessible
+	// by its owner, if it does not exist.
+	Dir string
+	// Prefix is the prefix of the recording file names, it defaults to "tap".
+	Prefix string
+	// Directions are the directions of the messages to record, nil records both received and
+	// published messages.
+	Directions []Direction
+	// MaxBytes is the size of a recording file after which a new file is started, it defaults
+	// to DefaultMaxBytes.
+	MaxBytes int64
+	// MaxFiles is the number of recording files to keep, the oldest files are removed when a
+	// new file is started. Zero keeps all files.
+	MaxFiles int
+	// BufferSize is the number of messages buffered to be written, messages recorded while the
+	// buffer is full are dropped. It defaults to DefaultBufferSize.
+	BufferSize int
+}
+
+// Recorder is a queue.Tap that writes messages to rotating JSONL files. Set it on the
+// QueueHandlers to record using SetTap. Messages are written by a background goroutine so
+// handlers do not wait on file I/O, Close flushes the buffered messages.
+type Recorder struct {
+	opts RecorderOptions
+	now  func() time.Time
+
+	mtx     sync.RWMutex
+	closed  bool
+	entries chan entry
+	done    chan struct{}
+
+	// The current file is only accessed by the writing goroutine.
+	file *os.File
+	size int64
+}
+
+// entry is a recorded message waiting to be written.
+type entry struct {
+	line   []byte
+	time   time.Time
+	logger queue.Logger
+}
+
+var _ queue.Tap = (*Recorder)(nil)
+
+// NewRecorder returns a Recorder writing to the configured directory.
+func NewRecorder(opts RecorderOptions) (*Recorder, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = "tap"
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+	err := os.MkdirAll(opts.Dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		opts:    opts,
+		now:     time.Now,
+		entries: make(chan entry, opts.BufferSize),
+		done:    make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// Received records a received message.
+func (r *Recorder) Received(ctx context.Context, uri string, data []byte) {
+	r.record(ctx, Received, uri, data)
+}
+
+// Published records a published message.
+func (r *Recorder) Published(ctx context.Context, uri string, data []byte) {
+	r.record(ctx, Published, uri, data)
+}
+
+func (r *Recorder) record(ctx context.Context, direction Direction, uri string, data []byte) {
+	if !includes(r.opts.Directions, direction) {
+		return
+	}
+	rec := Record{
+		Direction:     direction,
+		Time:          r.now().UTC(),
+		URI:           uri,
+		MessageID:     options.MessageIDFromContext(ctx),
+		CorrelationID: options.CorrelationIDFromContext(ctx),
+		Headers:       options.HeadersFromContext(ctx),
+		Payload:       data,
+	}
+	if sent := options.SentTimeFromContext(ctx); !sent.IsZero() {
+		sent = sent.UTC()
+		rec.SentTime = &sent
+	}
+	logger := queue.LoggerFromContext(ctx)
+	// The payload is marshaled before returning as the caller may reuse it.
+	line, err := json.Marshal(rec)
+	if err != nil {
+		logger.WithError(err).Error("recording message")
+		return
+	}
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.entries <- entry{line: append(line, '\n'), time: rec.Time, logger: logger}:
+	default:
+		logger.Warn("recording buffer full, dropping message")
+	}
+}
+
+// run writes the recorded messages until the Recorder is closed.
+func (r *Recorder) run() {
+	defer close(r.done)
+	for e := range r.entries {
+		err := r.write(e)
+		if err != nil {
+			e.logger.WithError(err).Error("recording message")
+		}
+	}
+}
+
+// includes returns whether the direction is one of the directions, nil includes all directions.
+func includes(directions []Direction, direction Direction) bool {
+	if directions == nil {
+		return true
+	}
+	for _, d := range directions {
+		if d == direction {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Recorder) write(e entry) error {
+	if r.file == nil || (r.size > 0 && r.size+int64(len(e.line)) > r.opts.MaxBytes) {
+		err := r.rotate(e.time)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := r.file.Write(e.line)
+	r.size += int64(n)
+	return err
+}
+
+// rotate closes the current file, if any, and starts a new one named by the time of its first
+// record, removing the oldest files beyond MaxFiles.
+func (r *Recorder) rotate(t time.Time) error {
+	if r.file != nil {
+		err := r.file.Close()
+		r.file = nil
+		if err != nil {
+			return err
+		}
+	}
+	name := fmt.Sprintf("%s-%s.jsonl", r.opts.Prefix, t.Format("20060102T150405.000000000Z"))
+	f, err := os.OpenFile(filepath.Join(r.opts.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	r.file = f
+	r.size = 0
+	if r.opts.MaxFiles <= 0 {
+		return nil
+	}
+	files, err := Files(r.opts.Dir, r.opts.Prefix)
+	if err != nil {
+		return err
+	}
+	for len(files) > r.opts.MaxFiles {
+		err = os.Remove(files[0])
+		if err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// Close writes the buffered messages and closes the current recording file. Messages recorded
+// after Close are dropped.
+func (r *Recorder) Close() error {
+	r.mtx.Lock()
+	if r.closed {
+		r.mtx.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.entries)
+	r.mtx.Unlock()
+	<-r.done
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// Files returns the recording files in the directory with the prefix, oldest first.
+func Files(dir, prefix string) ([]string, error) {
+	if prefix == "" {
+		prefix = "tap"
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), prefix+"-") && strings.HasSuffix(e.Name(), ".jsonl") {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	// The timestamps in the file names sort chronologically.
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,173 @@
+package tap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"queue"
+	"queue/options"
+)
+
+// maxLineSize is the maximum size of a line in a recording file.
+const maxLineSize = 64 << 20
+
+// Load reads the records from the recording files, ordered by time.
+func Load(paths ...string) ([]Record, error) {
+	var records []Record
+	for _, path := range paths {
+		recs, err := loadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, recs...)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
+
+func loadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		err = json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		records = append(records, rec)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return records, nil
+}
+
+// Target replays a record.
+type Target func(ctx context.Context, rec Record) error
+
+// Publisher returns a Target publishing the payloads of records to the QueueHandler, preserving
+// their correlation IDs and headers.
+func Publisher(q *queue.QueueHandler) Target {
+	return func(ctx context.Context, rec Record) error {
+		return q.Publish(rec.Payload, publishOptions(rec))
+	}
+}
+
+// Receiver returns a Target delivering records directly to the handlers of the QueueHandler,
+// which must have been started, bypassing the underlying queue. It returns the error of the
+// handlers.
+func Receiver(q *queue.QueueHandler) Target {
+	return func(ctx context.Context, rec Record) error {
+		msgCtx := options.ContextWithPublishOptions(options.ContextWithMessageDelete(ctx), publishOptions(rec))
+		msgCtx = options.ContextWithMessageID(msgCtx, rec.MessageID)
+		if rec.SentTime != nil {
+			msgCtx = options.ContextWithSentTime(msgCtx, *rec.SentTime)
+		}
+		select {
+		case err := <-q.Receive(msgCtx, rec.Payload):
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// publishOptions returns the correlation ID and headers of a record. Headers describing the
+// transformations applied to the payload are omitted as recorded payloads are decoded.
+func publishOptions(rec Record) options.PublishOptions {
+	headers := make(map[string]string)
+	for k, v := range rec.Headers {
+		headers[k] = v
+	}
+	for _, k := range queue.PayloadHeaders() {
+		delete(headers, k)
+	}
+	opts := options.WithHeaders(headers)
+	if rec.CorrelationID != "" {
+		opts = options.Merge(opts, options.WithCorrelationID(rec.CorrelationID))
+	}
+	return opts
+}
+
+// ReplayOptions configures a replay.
+type ReplayOptions struct {
+	// Directions are the directions of the records to replay, nil replays all records.
+	Directions []Direction
+	// Speed is the factor by which the original timing of the records is accelerated, i.e. 1
+	// replays with the original timing and 10 replays ten times faster. Zero replays the
+	// records without delay.
+	Speed float64
+	// ContinueOnError continues the replay when a record fails to replay, otherwise the
+	// replay stops and the error is returned.
+	ContinueOnError bool
+}
+
+// Replay replays the records, in order, to the Target. It returns the number of records replayed.
+func Replay(ctx context.Context, records []Record, target Target, opts ReplayOptions) (int, error) {
+	var first time.Time
+	start := time.Now()
+	replayed := 0
+	for _, rec := range records {
+		if !includes(opts.Directions, rec.Direction) {
+			continue
+		}
+		if first.IsZero() {
+			first = rec.Time
+		}
+		if opts.Speed > 0 {
+			offset := time.Duration(float64(rec.Time.Sub(first)) / opts.Speed)
+			err := sleep(ctx, time.Until(start.Add(offset)))
+			if err != nil {
+				return replayed, err
+			}
+		}
+		err := target(ctx, rec)
+		if err != nil && !opts.ContinueOnError {
+			return replayed, fmt.Errorf("replaying message %s: %w", rec.MessageID, err)
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// ReplayURI publishes the records to the queue with the URI, see Replay.
+func ReplayURI(ctx context.Context, uri string, records []Record, opts ReplayOptions) (int, error) {
+	q, err := queue.Queue(uri)
+	if err != nil {
+		return 0, err
+	}
+	defer q.Close()
+	return Replay(ctx, records, Publisher(q), opts)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
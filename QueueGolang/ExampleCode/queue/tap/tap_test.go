@@ -0,0 +1,185 @@
+package tap
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"queue"
+	"queue/compression"
+	_ "queue/mem"
+	"queue/options"
+)
+
+func TestRecordReplay(t *testing.T) {
+	recorder, err := NewRecorder(RecorderOptions{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := queue.Queue("mem://tap-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.SetCompression(compression.Gzip).SetTap(recorder)
+	received := make(chan struct{}, 2)
+	q.AddHandler(func(ctx context.Context, data []byte) error {
+		received <- struct{}{}
+		return nil
+	})
+	q.Start()
+	for _, payload := range []string{"a", "b"} {
+		err = q.Publish([]byte(payload), options.WithCorrelationID("cid-"+payload), options.WithHeader("source", "test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected messages to be received")
+		}
+	}
+	if err = recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := Files(recorder.opts.Dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := Load(files...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[Direction]int{}
+	for _, rec := range records {
+		counts[rec.Direction]++
+		if rec.URI != q.URI() || rec.Headers["source"] != "test" {
+			t.Errorf("expected uri and headers to be recorded, got %+v", rec)
+		}
+		if rec.Direction == Published && rec.CorrelationID != "cid-"+string(rec.Payload) {
+			t.Errorf("expected decoded payload and correlation ID to be recorded, got %+v", rec)
+		}
+		if rec.Direction == Received && (rec.MessageID == "" || rec.SentTime == nil) {
+			t.Errorf("expected message ID and sent time to be recorded, got %+v", rec)
+		}
+	}
+	if counts[Received] != 2 || counts[Published] != 2 {
+		t.Fatalf("expected 2 received and 2 published records, got %v", counts)
+	}
+
+	// Replay the received messages directly into the handlers of another queue.
+	target := queue.NewQueueHandler("mem://tap-replay", 1)
+	var mtx sync.Mutex
+	replayed := map[string]string{}
+	target.AddHandler(func(ctx context.Context, data []byte) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if options.HeaderFromContext(ctx, compression.Header) != "" {
+			t.Error("expected payload headers not to be replayed")
+		}
+		replayed[string(data)] = options.CorrelationIDFromContext(ctx)
+		return nil
+	})
+	target.Start()
+	defer target.Close()
+	n, err := Replay(context.Background(), records, Receiver(target), ReplayOptions{Directions: []Direction{Received}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 messages to be replayed, got %d", n)
+	}
+	for _, rec := range records {
+		if rec.Direction == Received && replayed[string(rec.Payload)] != rec.CorrelationID {
+			t.Errorf("expected message to be replayed with its correlation ID, got %v", replayed)
+		}
+	}
+}
+
+func TestRecorder_Rotate(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRecorder(RecorderOptions{Dir: dir, Directions: []Direction{Published}, MaxBytes: 1, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	recorder.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	ctx := options.NewMessageContext()
+	for _, payload := range []string{"a", "b", "c"} {
+		recorder.Published(ctx, "mem://tap", []byte(payload))
+		recorder.Received(ctx, "mem://tap", []byte(payload))
+	}
+	if err = recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := Files(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected the oldest file to be removed, got %v", files)
+	}
+	records, err := Load(files...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || string(records[0].Payload) != "b" || string(records[1].Payload) != "c" {
+		t.Errorf("expected the latest published records, got %+v", records)
+	}
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0o600 {
+			t.Errorf("expected plaintext recordings to only be readable by their owner, got %s", perm)
+		}
+	}
+	// Messages recorded after Close are dropped.
+	recorder.Published(ctx, "mem://tap", []byte("d"))
+}
+
+func TestReplay_Timing(t *testing.T) {
+	start := time.Now()
+	records := []Record{
+		{Direction: Received, Time: start},
+		{Direction: Received, Time: start.Add(time.Second)},
+	}
+	var offsets []time.Duration
+	target := func(ctx context.Context, rec Record) error {
+		offsets = append(offsets, time.Since(start))
+		return nil
+	}
+	_, err := Replay(context.Background(), records, target, ReplayOptions{Speed: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offsets[1]-offsets[0] < 90*time.Millisecond {
+		t.Errorf("expected records to be replayed 100ms apart, got %v", offsets)
+	}
+}
+
+func TestReplay_Error(t *testing.T) {
+	errTarget := errors.New("target failed")
+	records := []Record{{Direction: Received}, {Direction: Received}}
+	target := func(ctx context.Context, rec Record) error {
+		return errTarget
+	}
+	n, err := Replay(context.Background(), records, target, ReplayOptions{})
+	if !errors.Is(err, errTarget) || n != 0 {
+		t.Errorf("expected replay to stop on error, got %d %v", n, err)
+	}
+	n, err = Replay(context.Background(), records, target, ReplayOptions{ContinueOnError: true})
+	if err != nil || n != 2 {
+		t.Errorf("expected replay to continue on error, got %d %v", n, err)
+	}
+}
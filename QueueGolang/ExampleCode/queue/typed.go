@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"queue/options"
+)
+
+var (
+	messageTypesMtx sync.Mutex
+	messageTypes    = make(map[string]reflect.Type)
+)
+
+// RegisterMessageType registers T as a message type, making it available to tooling that
+// describes the messages of a service such as schema generation. It is called by generated code.
+func RegisterMessageType[T any]() {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	messageTypesMtx.Lock()
+	defer messageTypesMtx.Unlock()
+	messageTypes[t.Name()] = t
+}
+
+// MessageTypes returns the registered message types sorted by name.
+func MessageTypes() []reflect.Type {
+	messageTypesMtx.Lock()
+	defer messageTypesMtx.Unlock()
+	types := make([]reflect.Type, 0, len(messageTypes))
+	for _, t := range messageTypes {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].Name() < types[j].Name()
+	})
+	return types
+}
+
+// Handle adds a handler for messages of type T to the QueueHandler. Received payloads are
+// unmarshaled into T using Unmarshal before the handler is called. It returns the QueueHandler
+// for chaining.
+func Handle[T any](q *QueueHandler, handler func(ctx context.Context, m T) error) *QueueHandler {
+	q.addType(&q.handledTypes, reflect.TypeOf((*T)(nil)).Elem())
+	return q.AddHandler(func(ctx context.Context, data []byte) error {
+		var msg T
+		err := q.Unmarshal(ctx, data, &msg)
+		if err != nil {
+			return fmt.Errorf("parsing message json: %w", err)
+		}
+		err = handler(ctx, msg)
+		if err != nil {
+			return fmt.Errorf("handling message: %w", err)
+		}
+		return nil
+	})
+}
+
+// Publisher publishes messages of type T.
+type Publisher[T any] interface {
+	Publish(m T, opts ...options.PublishOptions) error
+}
+
+// NewPublisher returns a Publisher that publishes messages of type T to the QueueHandler.
+func NewPublisher[T any](q *QueueHandler) Publisher[T] {
+	q.addType(&q.publishedTypes, reflect.TypeOf((*T)(nil)).Elem())
+	return publisher[T]{q: q}
+}
+
+type publisher[T any] struct {
+	q *QueueHandler
+}
+
+// Publish marshals the message using Marshal and publishes it to the queue.
+func (p publisher[T]) Publish(m T, opts ...options.PublishOptions) error {
+	byt, msgOpts, err := p.q.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshaling message into json: %w", err)
+	}
+	err = p.q.Publish(byt, options.Merge(opts...), msgOpts)
+	if err != nil {
+		return fmt.Errorf("publishing to queue: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"queue/codec"
+)
+
+type typedMessage struct {
+	ID string `json:"id"`
+}
+
+func TestHandle(t *testing.T) {
+	received := make(chan typedMessage, 1)
+	q := NewQueueHandler("test://typed", 1)
+	Handle(q, func(ctx context.Context, m typedMessage) error {
+		received <- m
+		return nil
+	})
+	q.Start()
+	loopback(q)
+	defer q.Close()
+
+	var p Publisher[typedMessage] = NewPublisher[typedMessage](q)
+	m := typedMessage{ID: "1"}
+	if err := p.Publish(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != m {
+		t.Errorf("expected %+v, got %+v", m, got)
+	}
+}
+
+func TestHandle_Protobuf(t *testing.T) {
+	received := make(chan *wrapperspb.StringValue, 1)
+	q := NewQueueHandler("test://typed", 1).SetCodec(codec.Protobuf)
+	Handle(q, func(ctx context.Context, m *wrapperspb.StringValue) error {
+		received <- m
+		return nil
+	})
+	q.Start()
+	loopback(q)
+	defer q.Close()
+
+	if err := NewPublisher[*wrapperspb.StringValue](q).Publish(wrapperspb.String("value")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got.GetValue() != "value" {
+		t.Errorf("expected value, got %s", got.GetValue())
+	}
+}
+
+func TestHandle_Errors(t *testing.T) {
+	errHandler := errors.New("handler error")
+	q := Handle(NewQueueHandler("test://typed", 1), func(ctx context.Context, m typedMessage) error {
+		return errHandler
+	})
+	q.Start()
+	defer q.Close()
+
+	err := <-q.Receive(context.Background(), []byte(`{"id":"1"}`))
+	if !errors.Is(err, errHandler) || !strings.HasPrefix(err.Error(), "handling message: ") {
+		t.Errorf("expected wrapped handler error, got %v", err)
+	}
+	err = <-q.Receive(context.Background(), []byte(`not json`))
+	if err == nil || !strings.HasPrefix(err.Error(), "parsing message json: ") {
+		t.Errorf("expected parsing error, got %v", err)
+	}
+}
+
+func TestPublisher_Errors(t *testing.T) {
+	q := NewQueueHandler("test://typed", 1)
+	err := NewPublisher[chan int](q).Publish(make(chan int))
+	if err == nil || !strings.HasPrefix(err.Error(), "marshaling message into json: ") {
+		t.Errorf("expected marshaling error, got %v", err)
+	}
+}
+
+func TestFakePublisher(t *testing.T) {
+	var p EmailMessagePublisher = &FakeEmailMessagePublisher{}
+	if err := p.PublishEmailMessage(EmailMessage{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	fake := p.(*FakeEmailMessagePublisher)
+	fake.Err = errors.New("publish error")
+	if err := p.PublishEmailMessage(EmailMessage{ID: "2"}); !errors.Is(err, fake.Err) {
+		t.Errorf("expected publish error, got %v", err)
+	}
+	if published := fake.Published(); len(published) != 1 || published[0].ID != "1" {
+		t.Errorf("expected one published message, got %+v", published)
+	}
+}
+
+func TestMessageTypes(t *testing.T) {
+	var names []string
+	for _, typ := range MessageTypes() {
+		names = append(names, typ.Name())
+	}
+	expected := []string{
+		"BigQueryUploadMessage", "DV360ImportMessage", "DeduplicationMessage", "EmailMessage",
+		"ImportJobRunMessage", "LumenScriptJobMessage", "Measurement", "MediaGridActivation",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected registered message types %v, got %v", expected, names)
+	}
+}
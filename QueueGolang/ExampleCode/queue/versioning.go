@@ -0,0 +1,136 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"queue/codec"
+)
+
+// SchemaVersionHeader is the message header recording the schema version of a published message.
+const SchemaVersionHeader = "schema_version"
+
+// defaultSchemaVersion is the schema version of message types without a registered version and
+// of messages published without a schema version header.
+const defaultSchemaVersion = 1
+
+// ErrNoUpcaster is returned when a received message cannot be upgraded to the current schema
+// version of its type.
+var ErrNoUpcaster = errors.New("no upcaster")
+
+// Upcaster upgrades a message from one schema version to the next. The message is decoded into
+// a map using the Codec it was published with, so fields can be added, renamed or transformed
+// before it is unmarshaled into the current version of the message type. Numbers in JSON
+// messages are decoded as json.Number, so large integers are preserved.
+type Upcaster func(m map[string]interface{}) (map[string]interface{}, error)
+
+var (
+	schemaMtx      sync.RWMutex
+	schemaVersions = make(map[reflect.Type]int)
+	upcasters      = make(map[reflect.Type]map[int]Upcaster)
+)
+
+// SetSchemaVersion sets the current schema version of the message type of m, which is stamped
+// on messages published using the generated Publish methods. Message types default to version 1.
+// It should be incremented whenever a change to the message type would break handlers of
+// messages published using the previous version, with an Upcaster registered to upgrade them.
+func SetSchemaVersion(m interface{}, version int) {
+	schemaMtx.Lock()
+	defer schemaMtx.Unlock()
+	schemaVersions[reflect.TypeOf(m)] = version
+}
+
+// RegisterUpcaster registers an Upcaster that upgrades messages of the type of m from the
+// provided schema version to the next. Protobuf messages cannot be decoded into a map, so an
+// error is returned for them, their schema should instead evolve compatibly.
+func RegisterUpcaster(m interface{}, from int, upcaster Upcaster) error {
+	t := reflect.TypeOf(m)
+	if t.Implements(protoMessage) || reflect.PtrTo(t).Implements(protoMessage) {
+		return fmt.Errorf("cannot register an upcaster for protobuf message %s", t)
+	}
+	schemaMtx.Lock()
+	defer schemaMtx.Unlock()
+	if upcasters[t] == nil {
+		upcasters[t] = make(map[int]Upcaster)
+	}
+	upcasters[t][from] = upcaster
+	return nil
+}
+
+var protoMessage = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+// SchemaVersion returns the current schema version of a message type.
+func SchemaVersion(t reflect.Type) int {
+	schemaMtx.RLock()
+	defer schemaMtx.RUnlock()
+	if version, ok := schemaVersions[t]; ok {
+		return version
+	}
+	return defaultSchemaVersion
+}
+
+// parseSchemaVersion parses the schema version header of a received message.
+func parseSchemaVersion(header string) (int, error) {
+	if header == "" {
+		return defaultSchemaVersion, nil
+	}
+	version, err := strconv.Atoi(header)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q", header)
+	}
+	return version, nil
+}
+
+// decodeFields decodes a message published with an older schema version into a map so that it
+// can be upcast. JSON numbers are kept as json.Number, as decoding them as float64 would round
+// integers larger than 2^53.
+func decodeFields(c codec.Codec, t reflect.Type, data []byte) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	switch c.ContentType() {
+	case codec.ContentTypeJSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err := dec.Decode(&fields)
+		if err != nil {
+			return nil, err
+		}
+	case codec.ContentTypeProtobuf:
+		return nil, fmt.Errorf("protobuf message %s cannot be upcast", t)
+	default:
+		err := c.Unmarshal(data, &fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
+// upcast upgrades a message of type t from the provided schema version to the current version.
+func upcast(t reflect.Type, from int, m map[string]interface{}) (map[string]interface{}, error) {
+	current := SchemaVersion(t)
+	if from > current {
+		return nil, fmt.Errorf("schema version %d of %s is newer than the current version %d", from, t, current)
+	}
+	schemaMtx.RLock()
+	fns := upcasters[t]
+	schemaMtx.RUnlock()
+	for version := from; version < current; version++ {
+		fn, ok := fns[version]
+		if !ok {
+			return nil, fmt.Errorf("upgrading %s from schema version %d: %w", t, version, ErrNoUpcaster)
+		}
+		var err error
+		m, err = fn(m)
+		if err != nil {
+			return nil, fmt.Errorf("upgrading %s from schema version %d: %w", t, version, err)
+		}
+	}
+	return m, nil
+}
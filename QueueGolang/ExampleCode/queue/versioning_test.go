@@ -0,0 +1,141 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"queue/codec"
+	"queue/options"
+)
+
+type versionedMessage struct {
+	Name    string
+	Account string
+	ID      int64
+}
+
+func TestQueueHandler_Upcast(t *testing.T) {
+	SetSchemaVersion(versionedMessage{}, 3)
+	// Version 2 renamed Title to Name.
+	err := RegisterUpcaster(versionedMessage{}, 1, func(m map[string]interface{}) (map[string]interface{}, error) {
+		m["Name"] = m["Title"]
+		delete(m, "Title")
+		return m, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Version 3 added Account.
+	err = RegisterUpcaster(versionedMessage{}, 2, func(m map[string]interface{}) (map[string]interface{}, error) {
+		m["Account"] = "default"
+		return m, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewQueueHandler("test://versioning", 1)
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		payload  string
+		expected versionedMessage
+	}{
+		{
+			name:     "unversioned",
+			payload:  `{"Title":"a"}`,
+			expected: versionedMessage{Name: "a", Account: "default"},
+		},
+		{
+			name:     "version 2",
+			headers:  map[string]string{SchemaVersionHeader: "2"},
+			payload:  `{"Name":"b"}`,
+			expected: versionedMessage{Name: "b", Account: "default"},
+		},
+		{
+			name:     "large integer",
+			headers:  map[string]string{SchemaVersionHeader: "2"},
+			payload:  `{"Name":"d","ID":9007199254740993}`,
+			expected: versionedMessage{Name: "d", Account: "default", ID: 9007199254740993},
+		},
+		{
+			name:     "message pack",
+			headers:  map[string]string{SchemaVersionHeader: "2", codec.Header: codec.ContentTypeMessagePack},
+			payload:  mustMarshal(t, codec.MessagePack, versionedMessage{Name: "e", ID: 9007199254740993}),
+			expected: versionedMessage{Name: "e", Account: "default", ID: 9007199254740993},
+		},
+		{
+			name:     "current version",
+			headers:  map[string]string{SchemaVersionHeader: "3", codec.Header: codec.ContentTypeJSON},
+			payload:  `{"Name":"c","Account":"account"}`,
+			expected: versionedMessage{Name: "c", Account: "account"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := options.ContextWithPublishOptions(options.NewMessageContext(), options.WithHeaders(tt.headers))
+			var m versionedMessage
+			err := q.Unmarshal(ctx, []byte(tt.payload), &m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, m)
+			}
+		})
+	}
+}
+
+func TestQueueHandler_UpcastNoPath(t *testing.T) {
+	type message struct {
+		Name string
+	}
+	SetSchemaVersion(message{}, 3)
+	err := RegisterUpcaster(message{}, 2, func(m map[string]interface{}) (map[string]interface{}, error) {
+		return m, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewQueueHandler("test://versioning", 1)
+
+	var m message
+	if err := q.Unmarshal(options.NewMessageContext(), []byte(`{}`), &m); !errors.Is(err, ErrNoUpcaster) {
+		t.Errorf("expected ErrNoUpcaster, got %v", err)
+	}
+	ctx := options.ContextWithPublishOptions(options.NewMessageContext(), options.WithHeader(SchemaVersionHeader, "4"))
+	if err := q.Unmarshal(ctx, []byte(`{}`), &m); err == nil {
+		t.Error("expected error unmarshaling a newer schema version")
+	}
+}
+
+func TestRegisterUpcaster_Protobuf(t *testing.T) {
+	err := RegisterUpcaster(&wrapperspb.StringValue{}, 1, func(m map[string]interface{}) (map[string]interface{}, error) {
+		return m, nil
+	})
+	if err == nil {
+		t.Error("expected error registering an upcaster for a protobuf message")
+	}
+}
+
+func mustMarshal(t *testing.T, c codec.Codec, m interface{}) string {
+	t.Helper()
+	data, err := c.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestQueueHandler_PublishSchemaVersion(t *testing.T) {
+	q := NewQueueHandler("test://versioning", 1)
+	_, opts, err := q.Marshal(BigQueryUploadMessage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := opts.Headers[SchemaVersionHeader]; version != "1" {
+		t.Errorf("expected schema version 1, got %s", version)
+	}
+}